@@ -0,0 +1,14 @@
+// fake-consul is a stand-in for the consul executable that the live package
+// can run instead of a real agent. See the fakeconsul package for what it
+// does and doesn't do.
+package main
+
+import (
+	"os"
+
+	"github.com/hashicorp/consul-live/live/fakeconsul"
+)
+
+func main() {
+	os.Exit(fakeconsul.Main(os.Args[1:]))
+}
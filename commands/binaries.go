@@ -0,0 +1,340 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-getter"
+)
+
+// releaseURL is where plain version strings are downloaded from.
+const releaseURL = "https://releases.hashicorp.com/consul/%s/consul_%s_%s_%s.zip"
+
+// plainVersion matches version strings like "1.0.6", "v1.2.0-rc1" or
+// "1.4.0+ent".
+var plainVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+([-+][0-9A-Za-z.+-]*)?$`)
+
+// binaryCache keeps Consul executables in a directory per version, so each
+// one is only downloaded once. Next to each executable is its own SHA256
+// and the checksum its download was verified against, if any, which are
+// checked every time it's used.
+type binaryCache struct {
+	Dir string
+}
+
+// defaultCacheDir returns ~/.consul-live/bin, falling back to the temp dir
+// if there's no home directory.
+func defaultCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "consul-live", "bin")
+	}
+	return filepath.Join(home, ".consul-live", "bin")
+}
+
+// resolve returns paths to executables for the given sources, downloading
+// any that aren't already cached. See binaryCache.get for the kinds of
+// sources that are understood.
+func (c *binaryCache) resolve(sources []string) ([]string, error) {
+	var executables []string
+	for _, source := range sources {
+		executable, err := c.get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Consul from %q: %v", source, err)
+		}
+		executables = append(executables, executable)
+	}
+	return executables, nil
+}
+
+// get returns the path to an executable for a single source, which can be:
+//
+//   - a plain version like "1.0.6", which is downloaded from the releases site
+//   - a path to a local executable, which is used where it is
+//   - the name of an executable on the PATH, like "consul"
+//   - a path to a local archive, such as a zip file
+//   - a URL or anything else go-getter understands
+//
+// Any of these can have a "?checksum=sha256:<hex>" suffix, which is checked
+// against the download (or the archive, for archives) before it's used.
+func (c *binaryCache) get(source string) (string, error) {
+	src, checksum := splitChecksum(source)
+
+	// Local executables, including ones on the PATH, are used as is, since
+	// they're likely to be rebuilt between runs.
+	local := src
+	if !strings.ContainsAny(src, `/\:`) && !plainVersion.MatchString(src) {
+		if path, err := exec.LookPath(src); err == nil {
+			local = path
+		}
+	}
+	if info, err := os.Stat(local); err == nil && info.Mode().IsRegular() && !isArchive(local) {
+		if checksum != "" {
+			if err := verifySHA256(local, checksum); err != nil {
+				return "", err
+			}
+		}
+		return filepath.Abs(local)
+	}
+
+	var key string
+	switch {
+	case plainVersion.MatchString(src):
+		version := strings.TrimPrefix(src, "v")
+		key = version
+		src = fmt.Sprintf(releaseURL, version, version, runtime.GOOS, runtime.GOARCH)
+
+	case isLocalFile(src):
+		// Local archives are keyed by their contents, since the same
+		// path might hold something different next time.
+		sum, err := fileSHA256(src)
+		if err != nil {
+			return "", err
+		}
+		if checksum != "" && sum != checksum {
+			return "", fmt.Errorf("checksum mismatch for %q: want %s, got %s", src, checksum, sum)
+		}
+		key = "file-" + sum[:16]
+		checksum = ""
+
+	default:
+		sum := sha256.Sum256([]byte(source))
+		key = "src-" + hex.EncodeToString(sum[:8])
+	}
+
+	dir := filepath.Join(c.Dir, key)
+	executable, err := checkCached(dir, checksum)
+	if err == nil {
+		log.Printf("Using cached Consul %q for %q", executable, source)
+		return executable, nil
+	}
+	replace := !os.IsNotExist(err)
+	if replace {
+		log.Printf("Can't use cached Consul in %q for %q (will download again): %v", dir, source, err)
+	}
+
+	if checksum != "" {
+		src += "?checksum=sha256:" + checksum
+	}
+	return c.install(key, src, source, checksum, replace)
+}
+
+// checkCached returns the executable in the given cache dir if it's still
+// the one that was installed there, and was verified against the given
+// checksum when it was downloaded. This returns an error that satisfies
+// os.IsNotExist if there's nothing cached.
+func checkCached(dir, checksum string) (string, error) {
+	executable := filepath.Join(dir, "consul")
+	if _, err := os.Stat(executable); err != nil {
+		return "", err
+	}
+
+	want, err := ioutil.ReadFile(filepath.Join(dir, "sha256"))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("there's no SHA256 for the executable")
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := verifySHA256(executable, strings.TrimSpace(string(want))); err != nil {
+		return "", err
+	}
+
+	if checksum != "" {
+		verified, err := ioutil.ReadFile(filepath.Join(dir, "checksum"))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if got := strings.TrimSpace(string(verified)); got != checksum {
+			return "", fmt.Errorf("download was verified with checksum %q, not %q", got, checksum)
+		}
+	}
+	return executable, nil
+}
+
+// install downloads the source into a scratch directory in the cache, finds
+// the executable in whatever was downloaded, and then moves it into place
+// along with its SHA256 and the checksum the download was verified against.
+// Other runs sharing the cache never see a partial download. If replace is
+// set then whatever is cached under the key already is thrown away.
+func (c *binaryCache) install(key, src, source, checksum string, replace bool) (string, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", err
+	}
+	scratch, err := ioutil.TempDir(c.Dir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(scratch)
+
+	log.Printf("Downloading Consul from %q...", source)
+	download := filepath.Join(scratch, "download")
+	if err := getter.GetAny(download, src); err != nil {
+		return "", err
+	}
+	found, err := findExecutable(download)
+	if err != nil {
+		return "", err
+	}
+
+	staged := filepath.Join(scratch, "staged")
+	if err := os.Mkdir(staged, 0755); err != nil {
+		return "", err
+	}
+	executable := filepath.Join(staged, "consul")
+	if err := copyFile(found, executable, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staged, "source"), []byte(source+"\n"), 0644); err != nil {
+		return "", err
+	}
+	sum, err := fileSHA256(executable)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staged, "sha256"), []byte(sum+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if checksum != "" {
+		if err := ioutil.WriteFile(filepath.Join(staged, "checksum"), []byte(checksum+"\n"), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	// If another run beat us to it then use theirs.
+	dir := filepath.Join(c.Dir, key)
+	if replace {
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(staged, dir); err != nil {
+		if _, statErr := os.Stat(filepath.Join(dir, "consul")); statErr != nil {
+			return "", err
+		}
+	}
+	log.Printf("Cached Consul from %q in %q", source, dir)
+	return filepath.Join(dir, "consul"), nil
+}
+
+// findExecutable looks through a download for the Consul executable. A file
+// named consul is preferred, otherwise there must be exactly one executable
+// file, wherever it is.
+func findExecutable(dir string) (string, error) {
+	var named, executables, all []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Local downloads may be symlinks, so look at what they point to.
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		all = append(all, rel)
+		switch {
+		case info.Name() == "consul" || info.Name() == "consul.exe":
+			named = append(named, path)
+		case info.Mode()&0111 != 0:
+			executables = append(executables, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(named) > 0 {
+		sort.Slice(named, func(i, j int) bool { return len(named[i]) < len(named[j]) })
+		return named[0], nil
+	}
+	if len(executables) == 1 {
+		return executables[0], nil
+	}
+	sort.Strings(all)
+	return "", fmt.Errorf("couldn't find a Consul executable in the download, it has: %s", strings.Join(all, ", "))
+}
+
+// splitChecksum pulls a "?checksum=sha256:<hex>" suffix off a source.
+func splitChecksum(source string) (string, string) {
+	idx := strings.LastIndex(source, "?checksum=sha256:")
+	if idx < 0 {
+		return source, ""
+	}
+	return source[:idx], strings.ToLower(source[idx+len("?checksum=sha256:"):])
+}
+
+func isArchive(path string) bool {
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".gz", ".bz2"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLocalFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func verifySHA256(path, want string) error {
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("checksum mismatch for %q: want %s, got %s", path, want, got)
+	}
+	return nil
+}
+
+func copyFile(from, to string, mode os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArchive writes a zip file holding a fake consul executable with the
+// given contents.
+func testArchive(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "consul.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	header := &zip.FileHeader{Name: "consul", Method: zip.Deflate}
+	header.SetMode(0755)
+	out, err := w.CreateHeader(header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := out.Write([]byte(contents)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return path
+}
+
+func readString(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(content)
+}
+
+func TestBinaryCache_Archive(t *testing.T) {
+	cache := &binaryCache{Dir: t.TempDir()}
+	archive := testArchive(t, "consul v1")
+
+	executable, err := cache.get(archive)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := readString(t, executable); got != "consul v1" {
+		t.Fatalf("bad: %q", got)
+	}
+
+	// A second get uses the cache.
+	again, err := cache.get(archive)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if again != executable {
+		t.Fatalf("bad: %q != %q", again, executable)
+	}
+
+	// A cached executable that's changed gets downloaded again.
+	if err := ioutil.WriteFile(executable, []byte("swapped"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	again, err = cache.get(archive)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := readString(t, again); got != "consul v1" {
+		t.Fatalf("bad: %q", got)
+	}
+}
+
+func TestBinaryCache_Checksum(t *testing.T) {
+	cache := &binaryCache{Dir: t.TempDir()}
+	archive := testArchive(t, "consul v1")
+	sum, err := fileSHA256(archive)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Local archives are checked on every get.
+	if _, err := cache.get(archive + "?checksum=sha256:" + sum); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := cache.get(archive + "?checksum=sha256:0000"); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// URLs are verified by the download and the checksum is recorded for
+	// later hits.
+	source := "file://" + filepath.ToSlash(archive) + "?checksum=sha256:" + sum
+	executable, err := cache.get(source)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir := filepath.Dir(executable)
+	if got := readString(t, filepath.Join(dir, "checksum")); got != sum+"\n" {
+		t.Fatalf("bad: %q", got)
+	}
+	if _, err := checkCached(dir, sum); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := checkCached(dir, "0000"); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// An entry that wasn't verified with the checksum is downloaded again.
+	if err := os.Remove(filepath.Join(dir, "checksum")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := cache.get(source); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := checkCached(dir, sum); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An entry without its SHA256 can't be trusted.
+	if err := os.Remove(filepath.Join(dir, "sha256")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := checkCached(dir, ""); err == nil {
+		t.Fatalf("should have failed")
+	}
+	if _, err := checkCached(filepath.Join(cache.Dir, "nope"), ""); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
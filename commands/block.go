@@ -27,7 +27,9 @@ Usage consul-live block <options>
 
 Options:
 
--queries=<int>         Number of blocking queries, defaults to 1
+-queries=<int>          Number of blocking queries, defaults to 1
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -38,14 +40,16 @@ func (c *Block) Synopsis() string {
 
 func (c *Block) Run(args []string) int {
 	var queries int
+	rep := newReport("block")
 	cmdFlags := flag.NewFlagSet("block", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
 	cmdFlags.IntVar(&queries, "queries", 1, "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if err := c.run(queries); err != nil {
+	if err := rep.finish(c.run(queries)); err != nil {
 		log.Println(err)
 		return 1
 	}
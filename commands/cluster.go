@@ -24,12 +24,21 @@ Usage consul-live cluster <options>
 
 Options:
 
--consul=<string>       Consul executable, defaults to "consul" from PATH
--servers=<int>         Number of servers, defaults to 3
--server-args=<string>  Additional args to pass to servers, may be given multiple times
--clients=<int>         Number of clients, defaults to 10
--client-args=<string>  Additional args to pass to clients, may be given multiple times
--nice-ports=<bool>     If true, uses the Consul default ports for the first agent, defaults to true
+-consul=<string>         Consul executable, defaults to "consul" from PATH
+-servers=<int>           Number of servers, defaults to 3
+-server-args=<string>    Additional args to pass to servers, may be given multiple times
+-clients=<int>           Number of clients, defaults to 10
+-client-args=<string>    Additional args to pass to clients, may be given multiple times
+-nice-ports=<bool>       If true, uses the Consul default ports for the first agent, defaults to true
+-log-dir=<string>        Directory for agent log files, defaults to a directory under the cluster's data dir
+-tee-logs=<bool>         If true, also copies agent logs to stdout prefixed by node name, defaults to false
+-lan-latency=<duration>  Latency to add to traffic between agents, defaults to none
+-lan-jitter=<duration>   Random variation in the LAN latency, defaults to none
+-lan-loss=<float>        Fraction of LAN UDP packets to drop, from 0 to 1, defaults to 0
+-lan-bandwidth=<int>     Limit on traffic between agents in bytes/second, defaults to no limit
+-seed=<int>              Seed for the random LAN loss and jitter, defaults to a time-based seed
+-report-json=<string>    If given, writes a JSON report of the run to this file
+-report-junit=<string>   If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -40,6 +49,8 @@ func (c *Cluster) Synopsis() string {
 
 func (c *Cluster) Run(args []string) int {
 	cfg := &live.ClusterConfig{}
+	var lan live.LinkConfig
+	rep := newReport("cluster")
 	cmdFlags := flag.NewFlagSet("cluster", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
 	cmdFlags.StringVar(&cfg.Executable, "consul", "consul", "")
@@ -48,11 +59,18 @@ func (c *Cluster) Run(args []string) int {
 	cmdFlags.IntVar(&cfg.Clients, "clients", 10, "")
 	cmdFlags.Var(&stringsFlag{&cfg.ClientArgs}, "client-args", "")
 	cmdFlags.BoolVar(&cfg.NicePorts, "nice-ports", true, "")
+	cmdFlags.StringVar(&cfg.LogDir, "log-dir", "", "")
+	cmdFlags.BoolVar(&cfg.TeeLogs, "tee-logs", false, "")
+	linkFlags(cmdFlags, "lan", &lan)
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
 
-	if err := c.run(cfg); err != nil {
+	if err := rep.finish(c.run(cfg, lan, rep)); err != nil {
 		log.Println(err)
 		return 1
 	}
@@ -60,12 +78,17 @@ func (c *Cluster) Run(args []string) int {
 	return 0
 }
 
-func (c *Cluster) run(cfg *live.ClusterConfig) error {
+func (c *Cluster) run(cfg *live.ClusterConfig, lan live.LinkConfig, rep *report) (err error) {
+	cfg.Partitionable = shaped(lan)
 	cluster, err := live.NewCluster(cfg)
 	if err != nil {
 		return err
 	}
+	if cluster.Network != nil {
+		cluster.Network.ShapeAll(lan)
+	}
 	defer func() {
+		cluster.Preserve = err != nil
 		if err := cluster.Shutdown(); err != nil {
 			log.Println(err)
 		}
@@ -74,6 +97,11 @@ func (c *Cluster) run(cfg *live.ClusterConfig) error {
 	if err := cluster.Start(); err != nil {
 		return err
 	}
+	if err := waitForStable(cluster); err != nil {
+		return err
+	}
+	log.Printf("Agent logs are in %q", cluster.LogDir)
+	rep.logDir(cluster.LogDir)
 
 	wait := make(chan os.Signal, 1)
 	signal.Notify(wait, os.Interrupt)
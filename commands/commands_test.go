@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul-live/live/fakeconsul"
+)
+
+// TestMain runs the fake agent when the test binary is started as an agent,
+// so the commands can manage clusters without a real Consul.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_CONSUL") == "1" {
+		os.Exit(fakeconsul.Main(os.Args[1:]))
+	}
+	os.Setenv("FAKE_CONSUL", "1")
+	os.Exit(m.Run())
+}
+
+// fakeConsul returns the executable to run fake agents with.
+func fakeConsul(t *testing.T) string {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return exe
+}
@@ -25,13 +25,26 @@ Usage consul-live federation <options>
 
 Options:
 
--consul=<string>       Consul executable, defaults to "consul" from PATH
--datacenters=<int>     Number of datacenters, defaults to 3
--servers=<int>         Number of servers in each datacenter, defaults to 3
--server-args=<string>  Additional args to pass to servers, may be given multiple times
--clients=<int>         Number of clients in each datacenter, defaults to 3
--client-args=<string>  Additional args to pass to clients, may be given multiple times
--nice-ports=<bool>     If true, uses the Consul default ports for the first agent, defaults to true
+-consul=<string>         Consul executable, defaults to "consul" from PATH
+-datacenters=<int>       Number of datacenters, defaults to 3
+-servers=<int>           Number of servers in each datacenter, defaults to 3
+-server-args=<string>    Additional args to pass to servers, may be given multiple times
+-clients=<int>           Number of clients in each datacenter, defaults to 3
+-client-args=<string>    Additional args to pass to clients, may be given multiple times
+-nice-ports=<bool>       If true, uses the Consul default ports for the first agent, defaults to true
+-log-dir=<string>        Directory for agent log files, defaults to a directory under each cluster's data dir
+-tee-logs=<bool>         If true, also copies agent logs to stdout prefixed by node name, defaults to false
+-lan-latency=<duration>  Latency to add to traffic between agents in a datacenter, defaults to none
+-lan-jitter=<duration>   Random variation in the LAN latency, defaults to none
+-lan-loss=<float>        Fraction of LAN UDP packets to drop, from 0 to 1, defaults to 0
+-lan-bandwidth=<int>     Limit on traffic between agents in a datacenter in bytes/second, defaults to no limit
+-wan-latency=<duration>  Latency to add to traffic between datacenters, defaults to none
+-wan-jitter=<duration>   Random variation in the WAN latency, defaults to none
+-wan-loss=<float>        Fraction of WAN UDP packets to drop, from 0 to 1, defaults to 0
+-wan-bandwidth=<int>     Limit on traffic between datacenters in bytes/second, defaults to no limit
+-seed=<int>              Seed for the random loss and jitter, defaults to a time-based seed
+-report-json=<string>    If given, writes a JSON report of the run to this file
+-report-junit=<string>   If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -42,7 +55,9 @@ func (c *Federation) Synopsis() string {
 
 func (c *Federation) Run(args []string) int {
 	var dcs int
+	var lan, wan live.LinkConfig
 	cfg := &live.ClusterConfig{}
+	rep := newReport("federation")
 	cmdFlags := flag.NewFlagSet("federation", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
 	cmdFlags.StringVar(&cfg.Executable, "consul", "consul", "")
@@ -52,11 +67,19 @@ func (c *Federation) Run(args []string) int {
 	cmdFlags.IntVar(&cfg.Clients, "clients", 3, "")
 	cmdFlags.Var(&stringsFlag{&cfg.ClientArgs}, "client-args", "")
 	cmdFlags.BoolVar(&cfg.NicePorts, "nice-ports", true, "")
+	cmdFlags.StringVar(&cfg.LogDir, "log-dir", "", "")
+	cmdFlags.BoolVar(&cfg.TeeLogs, "tee-logs", false, "")
+	linkFlags(cmdFlags, "lan", &lan)
+	linkFlags(cmdFlags, "wan", &wan)
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
 
-	if err := c.run(dcs, cfg); err != nil {
+	if err := rep.finish(c.run(dcs, cfg, lan, wan, rep)); err != nil {
 		log.Println(err)
 		return 1
 	}
@@ -64,17 +87,18 @@ func (c *Federation) Run(args []string) int {
 	return 0
 }
 
-func (c *Federation) run(dcs int, cfg *live.ClusterConfig) error {
+func (c *Federation) run(dcs int, cfg *live.ClusterConfig, lan, wan live.LinkConfig, rep *report) (err error) {
 	if dcs < 1 {
 		return fmt.Errorf("At least one datacenter is required")
 	}
+	cfg.Partitionable = shaped(lan) || shaped(wan)
 
 	var wanJoin string
 	for i := 0; i < dcs; i++ {
 		dc := fmt.Sprintf("dc%d", i+1)
 		cc := *cfg
-		cc.ServerArgs = append(cc.ServerArgs, "-datacenter", dc)
-		cc.ClientArgs = append(cc.ClientArgs, "-datacenter", dc)
+		cc.Datacenter = dc
+		cc.Seed = cfg.Seed + int64(i)
 		if i > 0 {
 			cc.NicePorts = false
 		}
@@ -83,7 +107,18 @@ func (c *Federation) run(dcs int, cfg *live.ClusterConfig) error {
 		if err != nil {
 			return err
 		}
+		if cluster.Network != nil {
+			// Traffic from other datacenters comes from outside the
+			// cluster's network, so it gets the WAN conditions both
+			// ways.
+			cluster.Network.ShapeAll(lan)
+			for _, consul := range cluster.Agents {
+				cluster.Network.Shape("", consul.Name, wan)
+				cluster.Network.Shape(consul.Name, "", wan)
+			}
+		}
 		defer func() {
+			cluster.Preserve = err != nil
 			if err := cluster.Shutdown(); err != nil {
 				log.Println(err)
 			}
@@ -91,6 +126,11 @@ func (c *Federation) run(dcs int, cfg *live.ClusterConfig) error {
 		if err := cluster.Start(); err != nil {
 			return err
 		}
+		if err := waitForStable(cluster); err != nil {
+			return err
+		}
+		log.Printf("Agent logs for %s are in %q", dc, cluster.LogDir)
+		rep.logDir(cluster.LogDir)
 
 		if i > 0 {
 			agent := cluster.Client.Agent()
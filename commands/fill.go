@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/go-uuid"
 	"github.com/mitchellh/cli"
 )
 
@@ -21,7 +20,7 @@ type Fill struct {
 
 func (c *Fill) Help() string {
 	helpText := `
-Usage consul-live fill -keys=<n> -size=<bytes>
+Usage consul-live fill -keys=<n> -size=<bytes> -seed=<n> -report-json=<path> -report-junit=<path>
 `
 	return strings.TrimSpace(helpText)
 }
@@ -33,10 +32,14 @@ func (c *Fill) Synopsis() string {
 func (c *Fill) Run(args []string) int {
 	var keys int
 	var size int
+	var seed int64
+	rep := newReport("fill")
 	cmdFlags := flag.NewFlagSet("fill", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
 	cmdFlags.IntVar(&keys, "keys", 1024, "")
 	cmdFlags.IntVar(&size, "size", 128, "")
+	cmdFlags.Int64Var(&seed, "seed", 0, "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -52,7 +55,9 @@ func (c *Fill) Run(args []string) int {
 		return 1
 	}
 
-	if err := c.run(client, keys, size); err != nil {
+	rep.Seed = resolveSeed(seed)
+	r := rand.New(rand.NewSource(rep.Seed))
+	if err := rep.finish(c.run(client, r, keys, size)); err != nil {
 		log.Println(err)
 		return 1
 	}
@@ -60,20 +65,12 @@ func (c *Fill) Run(args []string) int {
 	return 0
 }
 
-func (c *Fill) run(client *api.Client, keys int, size int) error {
+func (c *Fill) run(client *api.Client, r *rand.Rand, keys int, size int) error {
 	kv := client.KV()
 
-	root, err := uuid.GenerateUUID()
-	if err != nil {
-		return err
-	}
-
+	root := randomUUID(r)
 	for i := 0; i < keys; i++ {
-		buf := make([]byte, size)
-		if _, err := rand.Read(buf); err != nil {
-			return err
-		}
-
+		buf := randomValue(r, size)
 		inner := fmt.Sprintf("%s/%d", root, i+1)
 		if _, err := kv.Put(&api.KVPair{Key: inner, Value: buf}, nil); err != nil {
 			return err
@@ -1,7 +1,12 @@
 package commands
 
 import (
+	"flag"
+	"log"
 	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
 )
 
 type stringsFlag struct {
@@ -16,3 +21,28 @@ func (s *stringsFlag) Set(value string) error {
 	*s.target = append(*s.target, value)
 	return nil
 }
+
+// resolveSeed returns the given seed, or picks one based on the time if it's
+// zero. The seed is always logged so the run can be reproduced.
+func resolveSeed(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("Using random seed %d (pass -seed=%d to reproduce this run)", seed, seed)
+	return seed
+}
+
+// linkFlags adds flags for the conditions on a link, with names like
+// "<prefix>-latency".
+func linkFlags(f *flag.FlagSet, prefix string, cfg *live.LinkConfig) {
+	f.DurationVar(&cfg.Latency, prefix+"-latency", 0, "")
+	f.DurationVar(&cfg.Jitter, prefix+"-jitter", 0, "")
+	f.Float64Var(&cfg.Loss, prefix+"-loss", 0.0, "")
+	f.IntVar(&cfg.Bandwidth, prefix+"-bandwidth", 0, "")
+}
+
+// shaped returns true if the link config asks for anything other than a
+// perfect link.
+func shaped(cfg live.LinkConfig) bool {
+	return cfg != live.LinkConfig{}
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
 	"time"
 
+	"github.com/hashicorp/consul-live/live"
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
 )
@@ -21,7 +24,29 @@ type Kill struct {
 
 func (c *Kill) Help() string {
 	helpText := `
-Usage consul-live kill -token=<token>
+Usage consul-live kill <options>
+
+  Waits for the cluster to be able to tolerate a failure, then takes out the
+  current leader and measures how long it takes for a new leader to be
+  elected. By default this runs against the local agent, but it can also
+  start up and manage its own cluster.
+
+Options:
+
+-token=<string>         ACL token to use, defaults to none
+-mode=<string>          How to take out the leader, one of "leave", "kill" (SIGKILL), "pause" (SIGSTOP),
+                        or "partition" (cut off from the other agents), defaults to "leave"; all but
+                        "leave" require a managed cluster
+-iterations=<int>       Number of leaders to take out, defaults to 0 which runs until interrupted
+-http-port=<int>        HTTP port of the leader when not using a managed cluster, defaults to 8500;
+                        the agent on that port is checked to be the leader before it's taken out
+-consul=<string>        If given, starts a managed cluster using this Consul executable
+-servers=<int>          Number of servers in a managed cluster, defaults to 3
+-server-args=<string>   Additional args to pass to managed servers, may be given multiple times
+-clients=<int>          Number of clients in a managed cluster, defaults to 0
+-client-args=<string>   Additional args to pass to managed clients, may be given multiple times
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -30,21 +55,51 @@ func (c *Kill) Synopsis() string {
 	return "Kills the current leader once the cluster is stable"
 }
 
+type killConfig struct {
+	Token      string
+	Mode       string
+	Iterations int
+	HTTPPort   int
+	Cluster    live.ClusterConfig
+}
+
 func (c *Kill) Run(args []string) int {
-	var token string
+	cfg := &killConfig{}
+	rep := newReport("kill")
 	cmdFlags := flag.NewFlagSet("kill", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
-	cmdFlags.StringVar(&token, "token", "", "")
+	cmdFlags.StringVar(&cfg.Token, "token", "", "")
+	cmdFlags.StringVar(&cfg.Mode, "mode", "leave", "")
+	cmdFlags.IntVar(&cfg.Iterations, "iterations", 0, "")
+	cmdFlags.IntVar(&cfg.HTTPPort, "http-port", 8500, "")
+	cmdFlags.StringVar(&cfg.Cluster.Executable, "consul", "", "")
+	cmdFlags.IntVar(&cfg.Cluster.Servers, "servers", 3, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ServerArgs}, "server-args", "")
+	cmdFlags.IntVar(&cfg.Cluster.Clients, "clients", 0, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ClientArgs}, "client-args", "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	config := func() *api.Config {
-		c := api.DefaultConfig()
-		c.Token = token
-		return c
+	switch cfg.Mode {
+	case "leave":
+	case "kill", "pause", "partition":
+		if cfg.Cluster.Executable == "" {
+			log.Printf("Mode %q requires a managed cluster, use -consul", cfg.Mode)
+			return 1
+		}
+		cfg.Cluster.Partitionable = cfg.Mode == "partition"
+	default:
+		log.Printf("Unknown mode %q", cfg.Mode)
+		return 1
 	}
-	if err := c.run(config); err != nil {
+	if cfg.Iterations < 0 {
+		log.Println("Iterations can't be negative")
+		return 1
+	}
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
 		log.Println(err)
 		return 1
 	}
@@ -52,12 +107,59 @@ func (c *Kill) Run(args []string) int {
 	return 0
 }
 
-func (c *Kill) run(config func() *api.Config) error {
+// killTarget is a leader that's been picked to be taken out.
+type killTarget struct {
+	// Address is the server RPC address of the leader, which is how the
+	// leader is reported by the status endpoint.
+	Address string
+
+	// Client talks to the leader's HTTP API.
+	Client *api.Client
+
+	// Agent and Network are set if the leader is part of a managed cluster.
+	Agent   *live.Consul
+	Network *live.Network
+}
+
+func (c *Kill) run(cfg *killConfig, rep *report) (err error) {
+	config := func() *api.Config {
+		c := api.DefaultConfig()
+		c.Token = cfg.Token
+		return c
+	}
+
 	client, err := api.NewClient(config())
 	if err != nil {
 		return err
 	}
 
+	var cluster *live.Cluster
+	if cfg.Cluster.Executable != "" {
+		cluster, err = live.NewCluster(&cfg.Cluster)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			cluster.Preserve = err != nil
+			if err := cluster.Shutdown(); err != nil {
+				log.Println(err)
+			}
+		}()
+		if err := cluster.Start(); err != nil {
+			return err
+		}
+		if err := waitForStable(cluster); err != nil {
+			return err
+		}
+		log.Printf("Agent logs are in %q", cluster.LogDir)
+		rep.logDir(cluster.LogDir)
+		client = cluster.Client
+	}
+
+	if self, err := client.Agent().Self(); err == nil {
+		log.Printf("Running against Consul %v", self["Config"]["Version"])
+	}
+
 	// Set a default Autopilot configuration that makes recovery quicker.
 	ap, err := client.Operator().AutopilotGetConfiguration(nil)
 	if err != nil {
@@ -65,60 +167,277 @@ func (c *Kill) run(config func() *api.Config) error {
 	}
 	ap.ServerStabilizationTime = api.NewReadableDuration(1 * time.Second)
 	if ok, err := client.Operator().AutopilotCASConfiguration(ap, nil); !ok || err != nil {
-		return err
+		return fmt.Errorf("failed to update Autopilot configuration: %v", err)
 	}
 
-	delay := func() {
-		time.Sleep(2 * time.Second)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	delay := func() bool {
+		select {
+		case <-interrupt:
+			return false
+		case <-time.After(2 * time.Second):
+			return true
+		}
 	}
 
-	// Wait for the cluster to be able to take a fault and then ask the
-	// current leader to leave.
-	for {
+	// observers returns the clients we can use to watch for a new leader,
+	// skipping the leader we just took out.
+	observers := func(target *killTarget) []*api.Client {
+		if cluster == nil {
+			return []*api.Client{client}
+		}
+
+		var clients []*api.Client
+		for _, consul := range cluster.Agents {
+			if consul != target.Agent && consul.Running() {
+				clients = append(clients, consul.Client)
+			}
+		}
+		return clients
+	}
+
+	var failovers []time.Duration
+	defer func() {
+		reportFailovers(failovers, rep)
+	}()
+
+	for cfg.Iterations == 0 || len(failovers) < cfg.Iterations {
+		// Wait for the cluster to be able to take a fault.
 		sh, err := client.Operator().AutopilotServerHealth(nil)
 		if err != nil {
 			log.Printf("Could not get cluster health (will retry): %v", err)
-			delay()
+			if !delay() {
+				return nil
+			}
 			continue
 		}
 
 		if sh.FailureTolerance < 1 {
 			log.Printf("Cluster can't tolerate a failure (will retry)")
-			delay()
+			if !delay() {
+				return nil
+			}
 			continue
 		}
 
-		var leader string
-		for _, server := range sh.Servers {
-			if server.Leader {
-				leader = server.Address
-				break
+		target, err := c.findLeader(cfg, config, cluster, sh)
+		if _, ok := err.(*wrongLeaderError); ok {
+			return err
+		}
+		if err != nil {
+			log.Printf("Could not find the leader (will retry): %v", err)
+			if !delay() {
+				return nil
 			}
+			continue
 		}
 
-		if leader == "" {
-			log.Printf("Cluster doesn't have a leader (will retry)")
-			delay()
+		log.Printf("Attempting to %s leader %q...", cfg.Mode, target.Address)
+		start := time.Now()
+		if err := faultLeader(cfg.Mode, target); err != nil {
+			log.Printf("Failed to %s leader %q: %v", cfg.Mode, target.Address, err)
+			if !delay() {
+				return nil
+			}
 			continue
 		}
 
-		log.Printf("Attempting to kill %q...", leader)
-		c := config()
-		host, _, err := net.SplitHostPort(leader)
+		name := fmt.Sprintf("failover %d (%s)", len(failovers)+1, cfg.Mode)
+		elapsed, err := waitForNewLeader(observers(target), target.Address, start, interrupt)
 		if err != nil {
+			rep.addStep(name, time.Now().Sub(start), err)
 			return err
 		}
-		c.Address = fmt.Sprintf("%s:%d", host, 8500)
-		tc, err := api.NewClient(c)
+		log.Printf("New leader elected %s after %s", cfg.Mode, elapsed)
+		rep.addStep(name, elapsed, nil)
+		failovers = append(failovers, elapsed)
+
+		if cluster != nil {
+			rep.begin(fmt.Sprintf("recovery %d", len(failovers)))
+			if err := recoverLeader(cfg.Mode, target); err != nil {
+				return err
+			}
+			if err := waitForStable(cluster); err != nil {
+				return err
+			}
+			rep.end()
+		}
+	}
+
+	return nil
+}
+
+// findLeader picks out the leader from the given Autopilot health report.
+func (c *Kill) findLeader(cfg *killConfig, config func() *api.Config, cluster *live.Cluster, sh *api.OperatorHealthReply) (*killTarget, error) {
+	var address, name string
+	for _, server := range sh.Servers {
+		if server.Leader {
+			address, name = server.Address, server.Name
+			break
+		}
+	}
+	if address == "" {
+		return nil, fmt.Errorf("cluster doesn't have a leader")
+	}
+
+	if cluster != nil {
+		leader, err := cluster.Leader()
 		if err != nil {
+			return nil, err
+		}
+		if fmt.Sprintf("127.0.0.1:%d", leader.Ports.Server) != address {
+			return nil, fmt.Errorf("leader changed while looking it up")
+		}
+		return &killTarget{
+			Address: address,
+			Client:  leader.Client,
+			Agent:   leader,
+			Network: cluster.Network,
+		}, nil
+	}
+
+	// Without a managed cluster all we know is the leader's RPC address, so
+	// we assume its HTTP API is on the same host at the given port. That
+	// doesn't hold when several servers share a host, so make sure the agent
+	// we reach there really is the leader before we take it out.
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	lc := config()
+	lc.Address = net.JoinHostPort(host, fmt.Sprintf("%d", cfg.HTTPPort))
+	client, err := api.NewClient(lc)
+	if err != nil {
+		return nil, err
+	}
+	node, err := client.Agent().NodeName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach leader %q at %q: %v", name, lc.Address, err)
+	}
+	if node != name {
+		return nil, &wrongLeaderError{Address: lc.Address, Node: node, Leader: name}
+	}
+	return &killTarget{
+		Address: address,
+		Client:  client,
+	}, nil
+}
+
+// wrongLeaderError means the HTTP address we worked out for the leader of an
+// unmanaged cluster belongs to some other agent. Retrying won't help with
+// this, so it stops the run.
+type wrongLeaderError struct {
+	Address string
+	Node    string
+	Leader  string
+}
+
+func (e *wrongLeaderError) Error() string {
+	return fmt.Sprintf("agent at %q is %q, not leader %q; servers sharing a host need a managed cluster (-consul)",
+		e.Address, e.Node, e.Leader)
+}
+
+// faultLeader takes out the given leader using the given mode.
+func faultLeader(mode string, target *killTarget) error {
+	switch mode {
+	case "leave":
+		return target.Client.Agent().Leave()
+
+	case "kill":
+		return target.Agent.Shutdown()
+
+	case "pause":
+		return target.Agent.Pause()
+
+	case "partition":
+		return target.Network.Isolate(target.Agent.Name)
+
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// recoverLeader brings a leader from a managed cluster back after it's been
+// taken out.
+func recoverLeader(mode string, target *killTarget) error {
+	consul := target.Agent
+	switch mode {
+	case "leave":
+		// The agent exits on its own after leaving, so make sure it's
+		// gone before we start it back up.
+		if err := consul.Stop(os.Interrupt, 30*time.Second); err != nil {
 			return err
 		}
-		if err := tc.Agent().Leave(); err != nil {
-			log.Printf("Failed to leave for %q: %v", leader, err)
-			delay()
-			continue
+		return consul.Start()
+
+	case "kill":
+		return consul.Start()
+
+	case "pause":
+		return consul.Resume()
+
+	case "partition":
+		target.Network.Heal()
+		return nil
+
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// waitForNewLeader polls the given clients until one of them reports a leader
+// other than the old one, and returns how long that took since start.
+func waitForNewLeader(clients []*api.Client, old string, start time.Time, interrupt <-chan os.Signal) (time.Duration, error) {
+	const timeout = 2 * time.Minute
+
+	if len(clients) == 0 {
+		return 0, fmt.Errorf("no agents left to watch for a new leader")
+	}
+
+	deadline := start.Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, client := range clients {
+			leader, err := client.Status().Leader()
+			if err == nil && leader != "" && leader != old {
+				return time.Now().Sub(start), nil
+			}
+		}
+
+		select {
+		case <-interrupt:
+			return 0, fmt.Errorf("interrupted while waiting for a new leader")
+		case <-time.After(50 * time.Millisecond):
 		}
 	}
+	return 0, fmt.Errorf("no new leader after %s", timeout)
+}
 
-	return nil
+// reportFailovers logs a summary of the measured leader failover times and
+// adds it to the report.
+func reportFailovers(failovers []time.Duration, rep *report) {
+	rep.metric("failovers", float64(len(failovers)))
+	if len(failovers) == 0 {
+		log.Println("No leader failovers were measured")
+		return
+	}
+
+	min, max := failovers[0], failovers[0]
+	var total time.Duration
+	for _, d := range failovers {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		total += d
+	}
+	mean := total / time.Duration(len(failovers))
+	log.Printf("Measured %d leader failovers: min=%s mean=%s max=%s", len(failovers), min, mean, max)
+	rep.metric("failover_min_ms", millis(min))
+	rep.metric("failover_mean_ms", millis(mean))
+	rep.metric("failover_max_ms", millis(max))
 }
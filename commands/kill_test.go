@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul-live/live"
+)
+
+func TestKill_Modes(t *testing.T) {
+	for _, mode := range []string{"leave", "kill", "pause"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := &killConfig{
+				Mode:       mode,
+				Iterations: 2,
+				Cluster: live.ClusterConfig{
+					Executable: fakeConsul(t),
+					Servers:    3,
+				},
+			}
+			rep := newReport("kill")
+			if err := (&Kill{}).run(cfg, rep); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			if got := rep.Metrics["failovers"]; got != 2 {
+				t.Fatalf("bad: %v failovers", got)
+			}
+			var failovers int
+			for _, step := range rep.Steps {
+				if !step.Passed {
+					t.Fatalf("step %q failed: %s", step.Name, step.Error)
+				}
+				if strings.HasPrefix(step.Name, "failover") {
+					failovers++
+				}
+			}
+			if failovers != 2 {
+				t.Fatalf("bad: %#v", rep.Steps)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
+	"github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
+)
+
+// faultInterval is how long we let the clients run against a stable cluster
+// before and after each fault.
+const faultInterval = 5 * time.Second
+
+func LinearizeCommandFactory() (cli.Command, error) {
+	return &Linearize{}, nil
+}
+
+type Linearize struct {
+}
+
+func (c *Linearize) Help() string {
+	helpText := `
+Usage consul-live linearize <options>
+
+  Starts a managed cluster and runs concurrent clients doing KV reads, writes,
+  and CAS operations against a small set of keys while the leader is taken
+  out repeatedly, either by stopping it or by partitioning it away from the
+  rest of the cluster. The history of operations is then checked to make sure
+  it's linearizable.
+
+Options:
+
+-consul=<string>        Consul executable to use for the managed cluster
+-servers=<int>          Number of servers, defaults to 3
+-server-args=<string>   Additional args to pass to servers, may be given multiple times
+-clients=<int>          Number of client agents, defaults to 0
+-client-args=<string>   Additional args to pass to clients, may be given multiple times
+-mode=<string>          How to take out the leader, one of "leave", "kill" (SIGKILL), "pause" (SIGSTOP),
+                        or "partition" (cut off from the other agents), defaults to "kill"
+-faults=<int>           Number of leaders to take out, defaults to 3
+-workers=<int>          Number of concurrent clients, defaults to 5
+-rate=<float>           Operations per second for each client, defaults to 20
+-keys=<int>             Number of keys to operate on, defaults to 5
+-consistency=<string>   Consistency mode for reads, one of "default", "consistent", or "stale",
+                        defaults to "consistent"
+-timeout=<duration>     Timeout for each request, defaults to 5s
+-history=<string>       If given, writes the history as JSON to this file
+-check=<string>         Checks a history written by -history instead of running a cluster
+-seed=<int>             Seed for the random choices made by the clients, defaults to a random seed
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Linearize) Synopsis() string {
+	return "Checks KV operations for linearizability while leaders fail"
+}
+
+type linearizeConfig struct {
+	Cluster     live.ClusterConfig
+	Mode        string
+	Faults      int
+	Workers     int
+	Rate        float64
+	Keys        int
+	Consistency string
+	Timeout     time.Duration
+	History     string
+	Seed        int64
+}
+
+func (c *Linearize) Run(args []string) int {
+	cfg := &linearizeConfig{}
+	var check string
+	rep := newReport("linearize")
+	cmdFlags := flag.NewFlagSet("linearize", flag.ContinueOnError)
+	cmdFlags.Usage = func() { log.Println(c.Help()) }
+	cmdFlags.StringVar(&cfg.Cluster.Executable, "consul", "", "")
+	cmdFlags.IntVar(&cfg.Cluster.Servers, "servers", 3, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ServerArgs}, "server-args", "")
+	cmdFlags.IntVar(&cfg.Cluster.Clients, "clients", 0, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ClientArgs}, "client-args", "")
+	cmdFlags.StringVar(&cfg.Mode, "mode", "kill", "")
+	cmdFlags.IntVar(&cfg.Faults, "faults", 3, "")
+	cmdFlags.IntVar(&cfg.Workers, "workers", 5, "")
+	cmdFlags.Float64Var(&cfg.Rate, "rate", 20.0, "")
+	cmdFlags.IntVar(&cfg.Keys, "keys", 5, "")
+	cmdFlags.StringVar(&cfg.Consistency, "consistency", "consistent", "")
+	cmdFlags.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "")
+	cmdFlags.StringVar(&cfg.History, "history", "", "")
+	cmdFlags.StringVar(&check, "check", "", "")
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	rep.flags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if check != "" {
+		history, err := live.ReadHistory(check)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		rep.begin("check history")
+		if err := rep.finish(checkHistory(history, rep)); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	if cfg.Cluster.Executable == "" {
+		log.Println("A Consul executable is required, use -consul")
+		return 1
+	}
+	switch cfg.Mode {
+	case "leave", "kill", "pause":
+	case "partition":
+		cfg.Cluster.Partitionable = true
+	default:
+		log.Printf("Unknown mode %q", cfg.Mode)
+		return 1
+	}
+	switch cfg.Consistency {
+	case "default", "consistent", "stale":
+	default:
+		log.Printf("Unknown consistency mode %q", cfg.Consistency)
+		return 1
+	}
+	if cfg.Faults < 0 || cfg.Workers < 1 || cfg.Keys < 1 || cfg.Rate <= 0.0 {
+		log.Println("Faults can't be negative, and workers, keys, and rate must be positive")
+		return 1
+	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+func (c *Linearize) run(cfg *linearizeConfig, rep *report) (err error) {
+	cluster, err := live.NewCluster(&cfg.Cluster)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cluster.Preserve = err != nil
+		if err := cluster.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	if err := waitForStable(cluster); err != nil {
+		return err
+	}
+	log.Printf("Agent logs are in %q", cluster.LogDir)
+	rep.logDir(cluster.LogDir)
+
+	// Set a default Autopilot configuration that makes recovery quicker.
+	operator := cluster.Client.Operator()
+	ap, err := operator.AutopilotGetConfiguration(nil)
+	if err != nil {
+		return err
+	}
+	ap.ServerStabilizationTime = api.NewReadableDuration(1 * time.Second)
+	if ok, err := operator.AutopilotCASConfiguration(ap, nil); !ok || err != nil {
+		return fmt.Errorf("failed to update Autopilot configuration: %v", err)
+	}
+
+	var keys []string
+	for i := 0; i < cfg.Keys; i++ {
+		keys = append(keys, fmt.Sprintf("linearize/%d/key-%d", cfg.Seed, i))
+	}
+
+	// Spread the clients out over all the agents so some of them are
+	// talking to the leader when it gets taken out.
+	history := live.NewHistory()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		agent := cluster.Agents[i%len(cluster.Agents)]
+		client, err := linearizeClient(agent, cfg.Timeout)
+		if err != nil {
+			close(stop)
+			wg.Wait()
+			return err
+		}
+
+		r := rand.New(rand.NewSource(cfg.Seed + int64(i)))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runLinearizeWorker(cfg, client, r, i, keys, history, stop)
+		}(i)
+	}
+
+	faultErr := c.injectFaults(cfg, cluster, rep)
+	close(stop)
+	wg.Wait()
+
+	if cfg.History != "" {
+		if err := history.Write(cfg.History); err != nil {
+			log.Printf("Failed to write history: %v", err)
+		} else {
+			log.Printf("Wrote history to %q", cfg.History)
+		}
+	}
+	if faultErr != nil {
+		return faultErr
+	}
+	rep.begin("check history")
+	return checkHistory(history, rep)
+}
+
+// linearizeClient returns a client for the given agent with a timeout, so
+// requests to a paused agent don't hang forever.
+func linearizeClient(agent *live.Consul, timeout time.Duration) (*api.Client, error) {
+	cc := agent.APIConfig()
+	hc, err := api.NewHttpClient(cc.Transport, cc.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	hc.Timeout = timeout
+	cc.HttpClient = hc
+	return api.NewClient(cc)
+}
+
+// injectFaults takes out the leader the configured number of times, letting
+// the cluster recover and run for a while between each fault.
+func (c *Linearize) injectFaults(cfg *linearizeConfig, cluster *live.Cluster, rep *report) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	delay := func() bool {
+		select {
+		case <-interrupt:
+			return false
+		case <-time.After(faultInterval):
+			return true
+		}
+	}
+
+	for i := 0; i < cfg.Faults; i++ {
+		if !delay() {
+			return nil
+		}
+
+		leader, err := cluster.Leader()
+		if err != nil {
+			return err
+		}
+		target := &killTarget{
+			Address: fmt.Sprintf("127.0.0.1:%d", leader.Ports.Server),
+			Client:  leader.Client,
+			Agent:   leader,
+			Network: cluster.Network,
+		}
+
+		log.Printf("Attempting to %s leader %q...", cfg.Mode, target.Address)
+		start := time.Now()
+		if err := faultLeader(cfg.Mode, target); err != nil {
+			return err
+		}
+
+		var observers []*api.Client
+		for _, consul := range cluster.Agents {
+			if consul != leader && consul.Running() {
+				observers = append(observers, consul.Client)
+			}
+		}
+		name := fmt.Sprintf("fault %d (%s)", i+1, cfg.Mode)
+		elapsed, err := waitForNewLeader(observers, target.Address, start, interrupt)
+		if err != nil {
+			rep.addStep(name, time.Now().Sub(start), err)
+			return err
+		}
+		log.Printf("New leader elected after %s", elapsed)
+		rep.addStep(name, elapsed, nil)
+
+		rep.begin(fmt.Sprintf("recovery %d", i+1))
+		if err := recoverLeader(cfg.Mode, target); err != nil {
+			return err
+		}
+		if err := waitForStable(cluster); err != nil {
+			return err
+		}
+		rep.end()
+	}
+
+	delay()
+	return nil
+}
+
+// runLinearizeWorker does random operations against the keys, recording them
+// in the history, until stop is closed.
+func runLinearizeWorker(cfg *linearizeConfig, client *api.Client, r *rand.Rand, w int, keys []string, history *live.History, stop <-chan struct{}) {
+	kv := client.KV()
+	q := &api.QueryOptions{
+		AllowStale:        cfg.Consistency == "stale",
+		RequireConsistent: cfg.Consistency == "consistent",
+	}
+
+	// Every value we write is unique, which lets the checker work out
+	// which write a read saw.
+	var seq int
+	nextValue := func() string {
+		seq++
+		return fmt.Sprintf("%d-%d", w, seq)
+	}
+
+	read := func(key string) (*api.KVPair, bool) {
+		op := history.Invoke(w, live.OpRead, key)
+		pair, _, err := kv.Get(key, q)
+		if err != nil {
+			history.Fail(op)
+			return nil, false
+		}
+		if pair != nil {
+			op.Value, op.Found = string(pair.Value), true
+		}
+		history.Complete(op)
+		return pair, true
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		key := keys[r.Intn(len(keys))]
+		switch r.Intn(3) {
+		case 0:
+			read(key)
+
+		case 1:
+			op := history.Invoke(w, live.OpWrite, key)
+			op.Value = nextValue()
+			p := &api.KVPair{Key: key, Value: []byte(op.Value)}
+			if _, err := kv.Put(p, nil); err != nil {
+				history.Fail(op)
+				continue
+			}
+			history.Complete(op)
+
+		case 2:
+			// Consul's CAS works off the modify index, so read the key
+			// first and then expect the value we saw. Since values are
+			// unique, this is the same as a CAS on the value.
+			pair, ok := read(key)
+			if !ok {
+				continue
+			}
+
+			op := history.Invoke(w, live.OpCAS, key)
+			op.Value = nextValue()
+			p := &api.KVPair{Key: key, Value: []byte(op.Value)}
+			if pair != nil {
+				op.Expect, op.ExpectFound = string(pair.Value), true
+				p.ModifyIndex = pair.ModifyIndex
+			}
+			applied, _, err := kv.CAS(p, nil)
+			if err != nil {
+				history.Fail(op)
+				continue
+			}
+			op.OK = applied
+			history.Complete(op)
+		}
+	}
+}
+
+// checkHistory checks the history for linearizability and logs the
+// operations for any keys that fail.
+func checkHistory(history *live.History, rep *report) error {
+	var unknown int
+	for _, op := range history.Ops {
+		if op.Unknown {
+			unknown++
+		}
+	}
+	log.Printf("Checking %d operations (%d with unknown outcomes)...", len(history.Ops), unknown)
+
+	bad := live.CheckLinearizable(history)
+	rep.metric("operations", float64(len(history.Ops)))
+	rep.metric("unknown_operations", float64(unknown))
+	rep.metric("nonlinearizable_keys", float64(len(bad)))
+	if len(bad) == 0 {
+		log.Println("History is linearizable")
+		return nil
+	}
+
+	for _, key := range bad {
+		log.Printf("Operations on key %q aren't linearizable:", key)
+		for _, op := range history.Ops {
+			if op.Key == key {
+				log.Printf("  %s", live.FormatOp(op))
+			}
+		}
+	}
+	return fmt.Errorf("history isn't linearizable for %d of the keys", len(bad))
+}
@@ -8,12 +8,12 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/go-uuid"
 	"github.com/miekg/dns"
 	"github.com/mitchellh/cli"
 )
@@ -27,7 +27,47 @@ type Load struct {
 
 func (c *Load) Help() string {
 	helpText := `
-Usage consul-live load -actors=<n> -rate=<rate> -token=<token>
+Usage consul-live load <options>
+
+  Runs a realistic mix of operations against the local Consul agent until
+  interrupted, periodically logging throughput, latency and error stats for
+  each operation, along with a final report for the whole run.
+
+  By default each actor runs a fast and a slow worker, each picking uniformly
+  from its own set of ops. A different workload can be given with -ops, or
+  with -profile pointing at a JSON file like this:
+
+    {
+      "workers": [
+        {
+          "name": "reads",
+          "rate": 50,
+          "ops": [
+            {"op": "key-crud", "weight": 1, "value_size": 1024},
+            {"op": "global-service-dns-udp", "weight": 9}
+          ]
+        }
+      ]
+    }
+
+  Workers without a rate use -rate, and ops without a weight get a weight of
+  1; a weight of 0 turns an op off. The available ops are agent-self,
+  global-lock, global-service-register, global-service-dns-udp,
+  global-service-dns-tcp, key-crud, key-tree, metrics and snapshot.
+
+Options:
+
+-actors=<int>              Number of actors running ops, defaults to 1
+-rate=<int>                Max ops/second for each worker, defaults to 10
+-token=<string>            ACL token to use, defaults to none
+-profile=<string>          JSON workload profile to run
+-ops=<string>              Runs a single worker with the given ops, as "op[:weight],..."
+-keys=<int>                Number of keys or instances for ops given with -ops
+-value-size=<int>          Size of values in bytes for ops given with -ops
+-seed=<int>                Seed for all random choices, defaults to a time-based seed
+-report-interval=<string>  How often to log stats, defaults to 10s
+-report-json=<string>      If given, writes a JSON report of the run with the final stats to this file
+-report-junit=<string>     If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -36,83 +76,140 @@ func (c *Load) Synopsis() string {
 	return "Loads the local Consul agent with realistic usage"
 }
 
+type loadConfig struct {
+	Actors         int
+	Rate           int
+	Token          string
+	ReportInterval time.Duration
+	Profile        *loadProfile
+	Seed           int64
+}
+
 func (c *Load) Run(args []string) int {
-	var actors int
-	var rate int
-	var token string
+	cfg := &loadConfig{}
+	rep := newReport("load")
 	cmdFlags := flag.NewFlagSet("load", flag.ContinueOnError)
 	cmdFlags.Usage = func() { log.Println(c.Help()) }
-	cmdFlags.IntVar(&actors, "actors", 1, "")
-	cmdFlags.IntVar(&rate, "rate", 10, "")
-	cmdFlags.StringVar(&token, "token", "", "")
+	cmdFlags.IntVar(&cfg.Actors, "actors", 1, "")
+	cmdFlags.IntVar(&cfg.Rate, "rate", 10, "")
+	cmdFlags.StringVar(&cfg.Token, "token", "", "")
+	cmdFlags.DurationVar(&cfg.ReportInterval, "report-interval", 10*time.Second, "")
+	var profile, ops string
+	var params opParams
+	cmdFlags.StringVar(&profile, "profile", "", "")
+	cmdFlags.StringVar(&ops, "ops", "", "")
+	cmdFlags.IntVar(&params.Keys, "keys", 0, "")
+	cmdFlags.IntVar(&params.ValueSize, "value-size", 0, "")
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	rep.flags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if actors < 1 {
+	if cfg.Actors < 1 {
 		log.Println("At least one actor is required")
 		return 1
 	}
-	if rate < 1 {
+	if cfg.Rate < 1 {
 		log.Println("Rate must be at least 1 event/second")
 		return 1
 	}
+	if cfg.ReportInterval <= 0 {
+		log.Println("Report interval must be positive")
+		return 1
+	}
+
+	var err error
+	switch {
+	case profile != "" && ops != "":
+		err = fmt.Errorf("Only one of -profile and -ops can be given")
+	case profile != "":
+		cfg.Profile, err = readProfile(profile)
+	case ops != "":
+		cfg.Profile, err = parseOpsFlag(ops, cfg.Rate, params)
+	default:
+		cfg.Profile = defaultProfile(cfg.Rate)
+	}
+	if err == nil {
+		err = cfg.Profile.finalize(cfg.Rate)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
 
+func (c *Load) run(cfg *loadConfig, rep *report) error {
 	config := func() *api.Config {
 		c := api.DefaultConfig()
-		c.Token = token
+		c.Token = cfg.Token
 		return c
 	}
 
-	var wg sync.WaitGroup
-	for i := 0; i < actors; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
+	// Each worker gets its own source of randomness derived from the seed,
+	// since they run concurrently.
+	rec := newRecorder()
+	stop := make(chan struct{})
+	seed := cfg.Seed
+	for i := 0; i < cfg.Actors; i++ {
+		for _, w := range cfg.Profile.Workers {
 			client, err := api.NewClient(config())
 			if err != nil {
-				log.Println("Could not make client: %s", err.Error())
-				return
+				return fmt.Errorf("Could not make client: %v", err)
 			}
-			if err := fast(client, rate); err != nil {
-				log.Println(err.Error())
-			}
-		}()
+			r := rand.New(rand.NewSource(seed))
+			seed++
+			go runWorker(client, r, w, rec, stop)
+		}
+	}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
 
-			client, err := api.NewClient(config())
-			if err != nil {
-				log.Println("Could not make client: %s", err.Error())
-				return
-			}
-			if err := slow(client, rate); err != nil {
-				log.Println(err.Error())
-			}
-		}()
+	ticker := time.NewTicker(cfg.ReportInterval)
+	defer ticker.Stop()
+
+WAIT:
+	for {
+		select {
+		case <-ticker.C:
+			logSummaries("Stats for the last interval", rec.Interval())
+		case <-interrupt:
+			log.Println("Got interrupt, stopping...")
+			break WAIT
+		}
 	}
-	wg.Wait()
+	close(stop)
 
-	return 0
+	rep.Ops = rec.Total()
+	logSummaries("Stats for the whole run", rep.Ops)
+	return nil
 }
 
-func maybeStale() *api.QueryOptions {
+func maybeStale(r *rand.Rand) *api.QueryOptions {
 	var q api.QueryOptions
-	if rand.Intn(50) > 50 {
+	if r.Intn(50) > 50 {
 		q.AllowStale = true
 	}
 	return &q
 }
 
-func opAgentSelf(client *api.Client) error {
+func opAgentSelf(client *api.Client, r *rand.Rand, p *opParams) error {
 	_, err := client.Agent().Self()
 	return err
 }
 
-func opGlobalLock(client *api.Client) error {
+func opGlobalLock(client *api.Client, r *rand.Rand, p *opParams) error {
 	opts := &api.LockOptions{
 		Key:          "global",
 		SessionTTL:   "10s",
@@ -135,8 +232,8 @@ func opGlobalLock(client *api.Client) error {
 	return nil
 }
 
-func opGlobalServiceRegister(client *api.Client) error {
-	index := rand.Intn(128)
+func opGlobalServiceRegister(client *api.Client, r *rand.Rand, p *opParams) error {
+	index := r.Intn(p.Keys)
 	service := &api.AgentServiceRegistration{
 		ID:   fmt.Sprintf("fuzz-test:%d", index),
 		Name: "fuzz-test",
@@ -151,7 +248,7 @@ func opGlobalServiceRegister(client *api.Client) error {
 	return nil
 }
 
-func opGlobalServiceDNSLookupUDP(client *api.Client) error {
+func opGlobalServiceDNSLookupUDP(client *api.Client, r *rand.Rand, p *opParams) error {
 	c := new(dns.Client)
 
 	m := new(dns.Msg)
@@ -168,7 +265,7 @@ func opGlobalServiceDNSLookupUDP(client *api.Client) error {
 	return nil
 }
 
-func opGlobalServiceDNSLookupTCP(client *api.Client) error {
+func opGlobalServiceDNSLookupTCP(client *api.Client, r *rand.Rand, p *opParams) error {
 	c := new(dns.Client)
 	c.Net = "tcp"
 
@@ -186,21 +283,17 @@ func opGlobalServiceDNSLookupTCP(client *api.Client) error {
 	return nil
 }
 
-func opKeyCRUD(client *api.Client) error {
+func opKeyCRUD(client *api.Client, r *rand.Rand, p *opParams) error {
 	kv := client.KV()
 
-	root, err := uuid.GenerateUUID()
-	if err != nil {
-		return err
-	}
-
-	_, err = kv.Put(&api.KVPair{Key: root}, nil)
+	root := randomUUID(r)
+	_, err := kv.Put(&api.KVPair{Key: root}, nil)
 	if err != nil {
 		return err
 	}
 
 	inner := fmt.Sprintf("%s/inner", root)
-	value := []byte("hello")
+	value := randomValue(r, p.ValueSize)
 	_, err = kv.Put(&api.KVPair{Key: inner, Value: value}, nil)
 	if err != nil {
 		return err
@@ -217,7 +310,7 @@ func opKeyCRUD(client *api.Client) error {
 		return fmt.Errorf("bad value: %#v", *pair)
 	}
 
-	value = []byte("world")
+	value = randomValue(r, p.ValueSize)
 	_, err = kv.Put(&api.KVPair{Key: inner, Value: value}, nil)
 	if err != nil {
 		return err
@@ -242,30 +335,24 @@ func opKeyCRUD(client *api.Client) error {
 	return nil
 }
 
-func opKeyTree(client *api.Client) error {
+func opKeyTree(client *api.Client, r *rand.Rand, p *opParams) error {
 	kv := client.KV()
 
-	root, err := uuid.GenerateUUID()
-	if err != nil {
-		return err
-	}
-
-	_, err = kv.Put(&api.KVPair{Key: root}, nil)
+	root := randomUUID(r)
+	_, err := kv.Put(&api.KVPair{Key: root}, nil)
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < 500; i++ {
+	for i := 0; i < p.Keys; i++ {
 		key := fmt.Sprintf("%s/lots/%d", root, i)
-		buf := make([]byte, 0, 128)
-		rand.Read(buf)
-		_, err = kv.Put(&api.KVPair{Key: key, Value: buf}, nil)
+		_, err = kv.Put(&api.KVPair{Key: key, Value: randomValue(r, p.ValueSize)}, nil)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, _, err = kv.List(root, maybeStale())
+	_, _, err = kv.List(root, maybeStale(r))
 	if err != nil {
 		return err
 	}
@@ -278,14 +365,14 @@ func opKeyTree(client *api.Client) error {
 	return nil
 }
 
-func opMetrics(client *api.Client) error {
+func opMetrics(client *api.Client, r *rand.Rand, p *opParams) error {
 	agent := client.Agent()
 	_, err := agent.Metrics()
 	return err
 }
 
-func opSnapshot(client *api.Client) error {
-	snap, _, err := client.Snapshot().Save(maybeStale())
+func opSnapshot(client *api.Client, r *rand.Rand, p *opParams) error {
+	snap, _, err := client.Snapshot().Save(maybeStale(r))
 	if err != nil {
 		return err
 	}
@@ -298,47 +385,70 @@ func opSnapshot(client *api.Client) error {
 	return nil
 }
 
-func slow(client *api.Client, rate int) error {
-	ops := []func(*api.Client) error{
-		opKeyTree,
-		opGlobalLock,
-		opGlobalServiceRegister,
-		opSnapshot,
-	}
+func randomValue(r *rand.Rand, size int) []byte {
+	buf := make([]byte, size)
+	r.Read(buf)
+	return buf
+}
 
-	minTimePerOp := time.Second / time.Duration(rate)
-	for {
-		start := time.Now()
-		opIndex := rand.Intn(len(ops))
-		if err := ops[opIndex](client); err != nil {
-			log.Printf("Op error: %s", err.Error())
-		}
-		elapsed := time.Now().Sub(start)
-		time.Sleep(minTimePerOp - elapsed)
-	}
+// randomUUID returns a UUID-formatted string generated from the given source
+// of randomness, so it's reproducible from a seed.
+func randomUUID(r *rand.Rand) string {
+	buf := randomValue(r, 16)
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%12x",
+		buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16])
+}
 
-	return nil
+// opParams tune what an op does. Each op only looks at the params that make
+// sense for it.
+type opParams struct {
+	// Keys is the number of keys an op writes, or the number of distinct
+	// instances it works with.
+	Keys int `json:"keys"`
+
+	// ValueSize is the size in bytes of any values an op writes.
+	ValueSize int `json:"value_size"`
 }
 
-func fast(client *api.Client, rate int) error {
-	ops := []func(*api.Client) error{
-		opAgentSelf,
-		opKeyCRUD,
-		opGlobalServiceDNSLookupUDP,
-		opGlobalServiceDNSLookupTCP,
-		opMetrics,
-	}
+// loadOpDef describes an op that can be used in a workload profile.
+type loadOpDef struct {
+	Fn       func(*api.Client, *rand.Rand, *opParams) error
+	Defaults opParams
+}
+
+// loadOps has all the ops that can be used in a workload profile, by name.
+var loadOps = map[string]loadOpDef{
+	"agent-self":              {Fn: opAgentSelf},
+	"global-lock":             {Fn: opGlobalLock},
+	"global-service-register": {Fn: opGlobalServiceRegister, Defaults: opParams{Keys: 128}},
+	"global-service-dns-udp":  {Fn: opGlobalServiceDNSLookupUDP},
+	"global-service-dns-tcp":  {Fn: opGlobalServiceDNSLookupTCP},
+	"key-crud":                {Fn: opKeyCRUD, Defaults: opParams{ValueSize: 5}},
+	"key-tree":                {Fn: opKeyTree, Defaults: opParams{Keys: 500, ValueSize: 128}},
+	"metrics":                 {Fn: opMetrics},
+	"snapshot":                {Fn: opSnapshot},
+}
 
-	minTimePerOp := time.Second / time.Duration(rate)
+// runWorker runs ops picked from the worker's weighted mix at up to the
+// worker's rate until the stop channel is closed, recording the outcome of
+// each one. All random choices come from the given source.
+func runWorker(client *api.Client, r *rand.Rand, w *loadWorker, rec *recorder, stop <-chan struct{}) {
+	minTimePerOp := time.Second / time.Duration(w.Rate)
 	for {
-		start := time.Now()
-		opIndex := rand.Intn(len(ops))
-		if err := ops[opIndex](client); err != nil {
-			log.Printf("Op error: %s", err.Error())
+		select {
+		case <-stop:
+			return
+		default:
 		}
+
+		start := time.Now()
+		op := w.pick(r)
+		err := loadOps[op.Op].Fn(client, r, &op.opParams)
 		elapsed := time.Now().Sub(start)
+		rec.Record(op.Op, elapsed, err)
+		if err != nil {
+			log.Printf("Op %s error: %s", op.Op, err.Error())
+		}
 		time.Sleep(minTimePerOp - elapsed)
 	}
-
-	return nil
 }
@@ -0,0 +1,202 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLatencySamples bounds how many latency samples we keep per op, after
+// which we switch to reservoir sampling.
+const maxLatencySamples = 10000
+
+// opStats holds the stats for a single op over some period.
+type opStats struct {
+	count   int
+	errors  map[string]int
+	samples []time.Duration
+	max     time.Duration
+}
+
+func (s *opStats) record(d time.Duration, err error) {
+	s.count++
+	if err != nil {
+		if s.errors == nil {
+			s.errors = make(map[string]int)
+		}
+		s.errors[errorType(err)]++
+	}
+
+	if d > s.max {
+		s.max = d
+	}
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, d)
+	} else if i := rand.Intn(s.count); i < maxLatencySamples {
+		s.samples[i] = d
+	}
+}
+
+// opSummary is a report of how an op performed over some period.
+type opSummary struct {
+	Op           string         `json:"op"`
+	Count        int            `json:"count"`
+	Errors       int            `json:"errors"`
+	ErrorsByType map[string]int `json:"errors_by_type,omitempty"`
+	Throughput   float64        `json:"throughput"`
+	P50          float64        `json:"p50_ms"`
+	P95          float64        `json:"p95_ms"`
+	P99          float64        `json:"p99_ms"`
+	Max          float64        `json:"max_ms"`
+}
+
+func (s *opStats) summarize(op string, elapsed time.Duration) opSummary {
+	sorted := append([]time.Duration{}, s.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+		idx := int(p * float64(len(sorted)-1))
+		return millis(sorted[idx])
+	}
+
+	summary := opSummary{
+		Op:           op,
+		Count:        s.count,
+		ErrorsByType: s.errors,
+		P50:          percentile(0.50),
+		P95:          percentile(0.95),
+		P99:          percentile(0.99),
+		Max:          millis(s.max),
+	}
+	for _, n := range s.errors {
+		summary.Errors += n
+	}
+	if elapsed > 0 {
+		summary.Throughput = float64(s.count) / elapsed.Seconds()
+	}
+	return summary
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recorder collects latency and error stats by op name, both for the whole
+// run and for the current reporting interval.
+type recorder struct {
+	lock          sync.Mutex
+	start         time.Time
+	total         map[string]*opStats
+	intervalStart time.Time
+	interval      map[string]*opStats
+}
+
+func newRecorder() *recorder {
+	now := time.Now()
+	return &recorder{
+		start:         now,
+		total:         make(map[string]*opStats),
+		intervalStart: now,
+		interval:      make(map[string]*opStats),
+	}
+}
+
+// Record adds the outcome of a single run of the given op.
+func (r *recorder) Record(op string, d time.Duration, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, stats := range []map[string]*opStats{r.total, r.interval} {
+		s, ok := stats[op]
+		if !ok {
+			s = &opStats{}
+			stats[op] = s
+		}
+		s.record(d, err)
+	}
+}
+
+// Interval returns summaries for the current interval and starts a new one.
+func (r *recorder) Interval() []opSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	summaries := summarize(r.interval, now.Sub(r.intervalStart))
+	r.intervalStart = now
+	r.interval = make(map[string]*opStats)
+	return summaries
+}
+
+// Total returns summaries for the whole run so far.
+func (r *recorder) Total() []opSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return summarize(r.total, time.Now().Sub(r.start))
+}
+
+func summarize(stats map[string]*opStats, elapsed time.Duration) []opSummary {
+	var ops []string
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var summaries []opSummary
+	for _, op := range ops {
+		summaries = append(summaries, stats[op].summarize(op, elapsed))
+	}
+	return summaries
+}
+
+// logSummaries writes the given summaries to the log as a table.
+func logSummaries(title string, summaries []opSummary) {
+	log.Printf("%s:", title)
+	if len(summaries) == 0 {
+		log.Println("  (no ops)")
+		return
+	}
+
+	for _, s := range summaries {
+		log.Printf("  %-28s count=%-6d errors=%-4d rate=%7.2f/s p50=%8.2fms p95=%8.2fms p99=%8.2fms max=%8.2fms",
+			s.Op, s.Count, s.Errors, s.Throughput, s.P50, s.P95, s.P99, s.Max)
+		var types []string
+		for t := range s.ErrorsByType {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			log.Printf("    %s: %d", t, s.ErrorsByType[t])
+		}
+	}
+}
+
+var responseCodeRe = regexp.MustCompile(`Unexpected response code: (\d+)`)
+
+// errorType boils an error down to a short category so errors can be counted
+// by type.
+func errorType(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	if m := responseCodeRe.FindStringSubmatch(err.Error()); m != nil {
+		return "http-" + m[1]
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return fmt.Sprintf("net-%s", opErr.Op)
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -0,0 +1,174 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestOpStats_Summarize(t *testing.T) {
+	ms := time.Millisecond
+	var hundred []time.Duration
+	for i := 1; i <= 100; i++ {
+		hundred = append(hundred, time.Duration(i)*ms)
+	}
+
+	cases := []struct {
+		name      string
+		latencies []time.Duration
+		errs      []error
+		elapsed   time.Duration
+		want      opSummary
+	}{
+		{
+			"empty",
+			nil,
+			nil,
+			time.Second,
+			opSummary{Op: "op"},
+		},
+		{
+			"single",
+			[]time.Duration{5 * ms},
+			nil,
+			0,
+			opSummary{Op: "op", Count: 1, P50: 5, P95: 5, P99: 5, Max: 5},
+		},
+		{
+			"out of order",
+			[]time.Duration{30 * ms, 10 * ms, 20 * ms},
+			nil,
+			time.Second,
+			opSummary{Op: "op", Count: 3, Throughput: 3, P50: 20, P95: 20, P99: 20, Max: 30},
+		},
+		{
+			"hundred",
+			hundred,
+			nil,
+			10 * time.Second,
+			opSummary{Op: "op", Count: 100, Throughput: 10, P50: 50, P95: 95, P99: 99, Max: 100},
+		},
+		{
+			"errors",
+			[]time.Duration{ms, 2 * ms, 3 * ms},
+			[]error{nil, timeoutError{}, errors.New("Unexpected response code: 500 (oops)")},
+			time.Second,
+			opSummary{
+				Op:           "op",
+				Count:        3,
+				Errors:       2,
+				ErrorsByType: map[string]int{"timeout": 1, "http-500": 1},
+				Throughput:   3,
+				P50:          2,
+				P95:          2,
+				P99:          2,
+				Max:          3,
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var s opStats
+			for i, d := range tc.latencies {
+				var err error
+				if i < len(tc.errs) {
+					err = tc.errs[i]
+				}
+				s.record(d, err)
+			}
+			if got := s.summarize("op", tc.elapsed); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("bad: %#v", got)
+			}
+		})
+	}
+}
+
+func TestOpStats_Reservoir(t *testing.T) {
+	var s opStats
+	n := 3 * maxLatencySamples
+	for i := 0; i < n; i++ {
+		s.record(time.Duration(i)*time.Microsecond, nil)
+	}
+	if s.count != n || len(s.samples) != maxLatencySamples {
+		t.Fatalf("bad: %d ops with %d samples", s.count, len(s.samples))
+	}
+	if s.max != time.Duration(n-1)*time.Microsecond {
+		t.Fatalf("bad: %s", s.max)
+	}
+
+	// Later ops should have made it into the samples, so the median moves
+	// up past the first batch.
+	summary := s.summarize("op", time.Second)
+	first := millis(time.Duration(maxLatencySamples) * time.Microsecond)
+	if summary.P50 <= first {
+		t.Fatalf("bad: %v", summary.P50)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := newRecorder()
+	r.Record("write", time.Millisecond, nil)
+	r.Record("read", 2*time.Millisecond, nil)
+	r.Record("read", 4*time.Millisecond, errors.New("Unexpected response code: 429"))
+
+	ops := func(summaries []opSummary) map[string]int {
+		counts := make(map[string]int)
+		for _, s := range summaries {
+			counts[s.Op] = s.Count
+		}
+		return counts
+	}
+
+	interval := r.Interval()
+	if len(interval) != 2 || interval[0].Op != "read" || interval[1].Op != "write" {
+		t.Fatalf("bad: %#v", interval)
+	}
+	if interval[0].Errors != 1 || interval[0].ErrorsByType["http-429"] != 1 || interval[0].Max != 4 {
+		t.Fatalf("bad: %#v", interval[0])
+	}
+
+	// The interval starts over but the total keeps going.
+	r.Record("write", time.Millisecond, nil)
+	if got := ops(r.Interval()); !reflect.DeepEqual(got, map[string]int{"write": 1}) {
+		t.Fatalf("bad: %v", got)
+	}
+	if got := ops(r.Interval()); len(got) != 0 {
+		t.Fatalf("bad: %v", got)
+	}
+	if got := ops(r.Total()); !reflect.DeepEqual(got, map[string]int{"read": 2, "write": 2}) {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{timeoutError{}, "timeout"},
+		{fmt.Errorf("get failed: %w", timeoutError{}), "timeout"},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, "timeout"},
+		{errors.New("Unexpected response code: 500 (rpc error)"), "http-500"},
+		{fmt.Errorf("put failed: %v", errors.New("Unexpected response code: 403 (ACL not found)")), "http-403"},
+		{dial, "net-dial"},
+		{fmt.Errorf("get failed: %w", dial), "net-dial"},
+		{errors.New("something else"), "*errors.errorString"},
+	}
+	for _, tc := range cases {
+		if got := errorType(tc.err); got != tc.want {
+			t.Fatalf("bad: %v is %q, not %q", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
+	"github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
+)
+
+func PauseCommandFactory() (cli.Command, error) {
+	return &Pause{}, nil
+}
+
+type Pause struct {
+}
+
+func (c *Pause) Help() string {
+	helpText := `
+Usage consul-live pause <options>
+
+  Starts a managed cluster and freezes a server with SIGSTOP for a while
+  before letting it continue with SIGCONT, which looks a lot like a long
+  garbage collection pause. Reports whether the rest of the cluster elected a
+  new leader during the pause and how long it took to settle down afterwards.
+
+Options:
+
+-consul=<string>        Consul executable to use for the managed cluster
+-servers=<int>          Number of servers, defaults to 3
+-server-args=<string>   Additional args to pass to servers, may be given multiple times
+-clients=<int>          Number of client agents, defaults to 0
+-client-args=<string>   Additional args to pass to clients, may be given multiple times
+-target=<string>        Which server to pause, either "leader" or "random", defaults to "leader"
+-duration=<duration>    How long to pause the server for, defaults to 10s
+-interval=<duration>    How long to wait between pauses once the cluster is stable, defaults to 10s
+-iterations=<int>       Number of pauses, defaults to 1; 0 runs until interrupted
+-seed=<int>             Seed for picking random servers, defaults to a time-based seed
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Pause) Synopsis() string {
+	return "Freezes a server for a while to simulate a long GC pause"
+}
+
+type pauseConfig struct {
+	Cluster    live.ClusterConfig
+	Target     string
+	Duration   time.Duration
+	Interval   time.Duration
+	Iterations int
+	Seed       int64
+}
+
+func (c *Pause) Run(args []string) int {
+	cfg := &pauseConfig{}
+	rep := newReport("pause")
+	cmdFlags := flag.NewFlagSet("pause", flag.ContinueOnError)
+	cmdFlags.Usage = func() { log.Println(c.Help()) }
+	cmdFlags.StringVar(&cfg.Cluster.Executable, "consul", "", "")
+	cmdFlags.IntVar(&cfg.Cluster.Servers, "servers", 3, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ServerArgs}, "server-args", "")
+	cmdFlags.IntVar(&cfg.Cluster.Clients, "clients", 0, "")
+	cmdFlags.Var(&stringsFlag{&cfg.Cluster.ClientArgs}, "client-args", "")
+	cmdFlags.StringVar(&cfg.Target, "target", "leader", "")
+	cmdFlags.DurationVar(&cfg.Duration, "duration", 10*time.Second, "")
+	cmdFlags.DurationVar(&cfg.Interval, "interval", 10*time.Second, "")
+	cmdFlags.IntVar(&cfg.Iterations, "iterations", 1, "")
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	rep.flags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if cfg.Cluster.Executable == "" {
+		log.Println("A Consul executable is required, use -consul")
+		return 1
+	}
+	switch cfg.Target {
+	case "leader", "random":
+	default:
+		log.Printf("Unknown target %q", cfg.Target)
+		return 1
+	}
+	if cfg.Iterations < 0 {
+		log.Println("Iterations can't be negative")
+		return 1
+	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+func (c *Pause) run(cfg *pauseConfig, rep *report) (err error) {
+	cluster, err := live.NewCluster(&cfg.Cluster)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cluster.Preserve = err != nil
+		if err := cluster.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	if err := waitForStable(cluster); err != nil {
+		return err
+	}
+	log.Printf("Agent logs are in %q", cluster.LogDir)
+	rep.logDir(cluster.LogDir)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	r := rand.New(rand.NewSource(cfg.Seed))
+	for i := 0; cfg.Iterations == 0 || i < cfg.Iterations; i++ {
+		select {
+		case <-interrupt:
+			return nil
+		case <-time.After(cfg.Interval):
+		}
+
+		leader, err := cluster.Leader()
+		if err != nil {
+			return err
+		}
+		target := leader
+		if cfg.Target == "random" {
+			servers := cluster.Servers()
+			target = servers[r.Intn(len(servers))]
+		}
+
+		rep.begin(fmt.Sprintf("pause %d (%s)", i+1, target.Name))
+		interrupted, err := c.pause(cfg, cluster, leader, target, interrupt)
+		if err != nil || interrupted {
+			return err
+		}
+		rep.end()
+	}
+	return nil
+}
+
+// pause freezes the target for the configured duration, watching the rest of
+// the cluster for a new leader, and then waits for the cluster to recover.
+// This returns true if it was interrupted, after resuming the target.
+func (c *Pause) pause(cfg *pauseConfig, cluster *live.Cluster, leader, target *live.Consul, interrupt <-chan os.Signal) (bool, error) {
+	old := fmt.Sprintf("127.0.0.1:%d", leader.Ports.Server)
+	var observers []*api.Client
+	for _, consul := range cluster.Agents {
+		if consul != target && consul.Running() {
+			observers = append(observers, consul.Client)
+		}
+	}
+
+	role := "follower"
+	if target == leader {
+		role = "leader"
+	}
+	log.Printf("Pausing %s %q for %s...", role, target.Name, cfg.Duration)
+	if err := target.Pause(); err != nil {
+		return false, err
+	}
+	start := time.Now()
+
+	var elected time.Duration
+	var interrupted bool
+	deadline := time.After(cfg.Duration)
+WATCH:
+	for {
+		if elected == 0 {
+			for _, client := range observers {
+				addr, err := client.Status().Leader()
+				if err == nil && addr != "" && addr != old {
+					elected = time.Now().Sub(start)
+					log.Printf("New leader %q elected after %s", addr, elected)
+					break
+				}
+			}
+		}
+
+		select {
+		case <-interrupt:
+			interrupted = true
+			break WATCH
+		case <-deadline:
+			break WATCH
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if elected == 0 {
+		log.Printf("Leader didn't change during the pause")
+	}
+
+	if err := target.Resume(); err != nil {
+		return false, err
+	}
+	if interrupted {
+		return true, nil
+	}
+
+	resumed := time.Now()
+	if err := waitForStable(cluster); err != nil {
+		return false, err
+	}
+	log.Printf("Resumed %q, cluster was stable again after %s", target.Name, time.Now().Sub(resumed))
+	return false, nil
+}
@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadProfile describes the shape of the traffic the load command generates.
+// Every actor runs all of the profile's workers.
+type loadProfile struct {
+	Workers []*loadWorker `json:"workers"`
+}
+
+// loadWorker runs a weighted mix of ops at a fixed rate.
+type loadWorker struct {
+	Name string        `json:"name"`
+	Rate int           `json:"rate"`
+	Ops  []*loadOpSpec `json:"ops"`
+
+	totalWeight int
+}
+
+// loadOpSpec configures a single op within a worker's mix. Weight is a
+// pointer so an explicit 0 can turn an op off, while leaving it out gives
+// the op a weight of 1.
+type loadOpSpec struct {
+	Op     string `json:"op"`
+	Weight *int   `json:"weight"`
+	opParams
+}
+
+// weight returns the op's weight, which is only valid after finalize.
+func (s *loadOpSpec) weight() int {
+	return *s.Weight
+}
+
+// defaultProfile returns the profile used when none is given, which splits
+// each actor into a fast and a slow worker with the ops picked uniformly.
+func defaultProfile(rate int) *loadProfile {
+	uniform := func(ops ...string) []*loadOpSpec {
+		var specs []*loadOpSpec
+		for _, op := range ops {
+			specs = append(specs, &loadOpSpec{Op: op})
+		}
+		return specs
+	}
+
+	return &loadProfile{
+		Workers: []*loadWorker{
+			{
+				Name: "fast",
+				Rate: rate,
+				Ops: uniform("agent-self", "key-crud", "global-service-dns-udp",
+					"global-service-dns-tcp", "metrics"),
+			},
+			{
+				Name: "slow",
+				Rate: rate,
+				Ops:  uniform("key-tree", "global-lock", "global-service-register", "snapshot"),
+			},
+		},
+	}
+}
+
+// readProfile loads a JSON profile from the given file.
+func readProfile(path string) (*loadProfile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile loadProfile
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse profile %q: %v", path, err)
+	}
+	return &profile, nil
+}
+
+// parseOpsFlag builds a single worker profile from a list of ops in the form
+// "op[:weight],...", using the given params for all of the ops.
+func parseOpsFlag(ops string, rate int, params opParams) (*loadProfile, error) {
+	worker := &loadWorker{Name: "ops", Rate: rate}
+	for _, entry := range strings.Split(ops, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		spec := &loadOpSpec{Op: entry, opParams: params}
+		if idx := strings.Index(entry, ":"); idx >= 0 {
+			weight, err := strconv.Atoi(entry[idx+1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad weight in %q: %v", entry, err)
+			}
+			spec.Op, spec.Weight = entry[:idx], &weight
+		}
+		worker.Ops = append(worker.Ops, spec)
+	}
+	return &loadProfile{Workers: []*loadWorker{worker}}, nil
+}
+
+// finalize checks the profile and fills in defaults, using the given rate
+// for any workers that don't set their own.
+func (p *loadProfile) finalize(rate int) error {
+	if len(p.Workers) == 0 {
+		return fmt.Errorf("profile must have at least one worker")
+	}
+
+	for i, w := range p.Workers {
+		if w.Name == "" {
+			w.Name = fmt.Sprintf("worker-%d", i+1)
+		}
+		if w.Rate == 0 {
+			w.Rate = rate
+		}
+		if w.Rate < 1 {
+			return fmt.Errorf("worker %q: rate must be at least 1 op/second", w.Name)
+		}
+		if len(w.Ops) == 0 {
+			return fmt.Errorf("worker %q: at least one op is required", w.Name)
+		}
+
+		w.totalWeight = 0
+		for _, op := range w.Ops {
+			def, ok := loadOps[op.Op]
+			if !ok {
+				return fmt.Errorf("worker %q: unknown op %q (valid ops are %s)",
+					w.Name, op.Op, strings.Join(loadOpNames(), ", "))
+			}
+			if op.Weight == nil {
+				weight := 1
+				op.Weight = &weight
+			}
+			if op.weight() < 0 {
+				return fmt.Errorf("worker %q: op %q has a negative weight", w.Name, op.Op)
+			}
+			if op.Keys == 0 {
+				op.Keys = def.Defaults.Keys
+			}
+			if op.ValueSize == 0 {
+				op.ValueSize = def.Defaults.ValueSize
+			}
+			if op.Keys < 0 || op.ValueSize < 0 {
+				return fmt.Errorf("worker %q: op %q has negative params", w.Name, op.Op)
+			}
+			if op.Op == "global-service-register" && op.Keys < 1 {
+				return fmt.Errorf("worker %q: op %q needs at least one key", w.Name, op.Op)
+			}
+			w.totalWeight += op.weight()
+		}
+		if w.totalWeight == 0 {
+			return fmt.Errorf("worker %q: at least one op needs a non-zero weight", w.Name)
+		}
+	}
+	return nil
+}
+
+// pick chooses an op from the worker's mix according to the weights.
+func (w *loadWorker) pick(r *rand.Rand) *loadOpSpec {
+	n := r.Intn(w.totalWeight)
+	for _, op := range w.Ops {
+		if n < op.weight() {
+			return op
+		}
+		n -= op.weight()
+	}
+	panic("weights don't add up")
+}
+
+func loadOpNames() []string {
+	var names []string
+	for name := range loadOps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
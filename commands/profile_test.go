@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// weights returns the ops and their weights in the given worker, with -1 for
+// ops that didn't give a weight.
+func weights(w *loadWorker) map[string]int {
+	got := make(map[string]int)
+	for _, op := range w.Ops {
+		if op.Weight == nil {
+			got[op.Op] = -1
+		} else {
+			got[op.Op] = *op.Weight
+		}
+	}
+	return got
+}
+
+func TestParseOpsFlag(t *testing.T) {
+	cases := []struct {
+		ops  string
+		want map[string]int
+		ok   bool
+	}{
+		{"key-crud", map[string]int{"key-crud": -1}, true},
+		{"key-crud,agent-self:3", map[string]int{"key-crud": -1, "agent-self": 3}, true},
+		{" key-crud:2 , ,metrics:0", map[string]int{"key-crud": 2, "metrics": 0}, true},
+		{"", map[string]int{}, true},
+		{"key-crud:x", nil, false},
+		{"key-crud:", nil, false},
+	}
+	for _, tc := range cases {
+		params := opParams{Keys: 7, ValueSize: 64}
+		profile, err := parseOpsFlag(tc.ops, 10, params)
+		if !tc.ok {
+			if err == nil {
+				t.Fatalf("%q should have failed", tc.ops)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(profile.Workers) != 1 {
+			t.Fatalf("bad: %#v", profile)
+		}
+		w := profile.Workers[0]
+		if w.Name != "ops" || w.Rate != 10 {
+			t.Fatalf("bad: %#v", w)
+		}
+		if got := weights(w); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("bad: %q gave %v", tc.ops, got)
+		}
+		for _, op := range w.Ops {
+			if op.opParams != params {
+				t.Fatalf("bad: %#v", op.opParams)
+			}
+		}
+	}
+}
+
+func TestLoadProfile_Finalize(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile string
+		total   int
+		ok      bool
+	}{
+		{"no workers", `{"workers": []}`, 0, false},
+		{"defaults", `{"workers": [{"ops": [{"op": "key-crud"}, {"op": "agent-self"}]}]}`, 2, true},
+		{"weights", `{"workers": [{"ops": [{"op": "key-crud", "weight": 3}, {"op": "agent-self"}]}]}`, 4, true},
+		{"zero weight", `{"workers": [{"ops": [{"op": "key-crud", "weight": 0}, {"op": "agent-self"}]}]}`, 1, true},
+		{"all zero weights", `{"workers": [{"ops": [{"op": "key-crud", "weight": 0}]}]}`, 0, false},
+		{"negative weight", `{"workers": [{"ops": [{"op": "key-crud", "weight": -1}]}]}`, 0, false},
+		{"negative rate", `{"workers": [{"rate": -1, "ops": [{"op": "key-crud"}]}]}`, 0, false},
+		{"no ops", `{"workers": [{"name": "empty"}]}`, 0, false},
+		{"unknown op", `{"workers": [{"ops": [{"op": "nope"}]}]}`, 0, false},
+		{"negative params", `{"workers": [{"ops": [{"op": "key-crud", "value_size": -1}]}]}`, 0, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var profile loadProfile
+			if err := json.Unmarshal([]byte(tc.profile), &profile); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			err := profile.finalize(25)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			w := profile.Workers[0]
+			if w.Name != "worker-1" || w.Rate != 25 || w.totalWeight != tc.total {
+				t.Fatalf("bad: %#v", w)
+			}
+			for _, op := range w.Ops {
+				if op.Weight == nil {
+					t.Fatalf("bad: op %q has no weight", op.Op)
+				}
+				if op.opParams != loadOps[op.Op].Defaults {
+					t.Fatalf("bad: op %q has params %#v", op.Op, op.opParams)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadWorker_Pick(t *testing.T) {
+	profile, err := parseOpsFlag("key-crud:1,agent-self:3,metrics:0", 10, opParams{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := profile.finalize(10); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w := profile.Workers[0]
+
+	picks := func(seed int64) []string {
+		r := rand.New(rand.NewSource(seed))
+		var ops []string
+		for i := 0; i < 10000; i++ {
+			ops = append(ops, w.pick(r).Op)
+		}
+		return ops
+	}
+
+	ops := picks(1)
+	counts := make(map[string]int)
+	for _, op := range ops {
+		counts[op]++
+	}
+	if counts["metrics"] != 0 {
+		t.Fatalf("bad: zero weight op was picked %d times", counts["metrics"])
+	}
+	if n := counts["key-crud"]; n < 2250 || n > 2750 {
+		t.Fatalf("bad: %v", counts)
+	}
+	if n := counts["agent-self"]; n < 7250 || n > 7750 {
+		t.Fatalf("bad: %v", counts)
+	}
+
+	// The same seed picks the same ops.
+	if !reflect.DeepEqual(picks(1), ops) {
+		t.Fatalf("bad: seed didn't reproduce the picks")
+	}
+}
@@ -0,0 +1,269 @@
+package commands
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// report collects the outcome of a command so it can be written out as JSON
+// and JUnit XML for CI systems.
+type report struct {
+	Command  string             `json:"command"`
+	Start    time.Time          `json:"start"`
+	Duration float64            `json:"duration_s"`
+	Passed   bool               `json:"passed"`
+	Error    string             `json:"error,omitempty"`
+	Seed     int64              `json:"seed,omitempty"`
+	LogDirs  []string           `json:"log_dirs,omitempty"`
+	Steps    []*reportStep      `json:"steps"`
+	Metrics  map[string]float64 `json:"metrics,omitempty"`
+	Ops      []opSummary        `json:"ops,omitempty"`
+
+	jsonPath  string
+	junitPath string
+
+	// open is the step that's running, if any.
+	open      *reportStep
+	openStart time.Time
+}
+
+// reportStep is a single step of a command, such as one fault or one
+// upgrade.
+type reportStep struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_s"`
+	Passed   bool    `json:"passed"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func newReport(command string) *report {
+	return &report{
+		Command: command,
+		Start:   time.Now(),
+		Steps:   []*reportStep{},
+		Metrics: make(map[string]float64),
+	}
+}
+
+// flags adds the flags that say where to write the report.
+func (r *report) flags(f *flag.FlagSet) {
+	f.StringVar(&r.jsonPath, "report-json", "", "")
+	f.StringVar(&r.junitPath, "report-junit", "", "")
+}
+
+// begin starts a new step, ending any open step as passed. The open step
+// fails if the command fails before it's ended.
+func (r *report) begin(name string) {
+	r.end()
+	r.open = &reportStep{Name: name}
+	r.openStart = time.Now()
+}
+
+// end marks the open step as passed, if there is one.
+func (r *report) end() {
+	r.endWith(nil)
+}
+
+func (r *report) endWith(err error) {
+	if r.open == nil {
+		return
+	}
+	r.addStep(r.open.Name, time.Now().Sub(r.openStart), err)
+	r.open = nil
+}
+
+// addStep records a step that was timed elsewhere.
+func (r *report) addStep(name string, d time.Duration, err error) {
+	step := &reportStep{
+		Name:     name,
+		Duration: d.Seconds(),
+		Passed:   err == nil,
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+}
+
+// logDir records where agent logs for the run can be found. Dirs that are
+// cleaned up by the end of the run are left out of the report, see finish.
+func (r *report) logDir(dir string) {
+	r.LogDirs = append(r.LogDirs, dir)
+}
+
+// metric records a named measurement from the run.
+func (r *report) metric(name string, value float64) {
+	r.Metrics[name] = value
+}
+
+// finish records the result of the command and writes out any reports that
+// were asked for. This returns the given error, or an error writing the
+// reports if the command itself succeeded.
+func (r *report) finish(err error) error {
+	r.endWith(err)
+	r.Duration = time.Now().Sub(r.Start).Seconds()
+	r.Passed = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	// Log dirs under a cluster's data dir get removed along with it when
+	// the run passes, so only report the ones that are being kept.
+	var kept []string
+	for _, dir := range r.LogDirs {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			kept = append(kept, dir)
+		}
+	}
+	r.LogDirs = kept
+
+	var writeErr error
+	if r.jsonPath != "" {
+		if err := r.writeJSON(r.jsonPath); err != nil {
+			writeErr = fmt.Errorf("failed to write JSON report: %v", err)
+		} else {
+			log.Printf("Wrote JSON report to %q", r.jsonPath)
+		}
+	}
+	if r.junitPath != "" {
+		if err := r.writeJUnit(r.junitPath); err != nil {
+			writeErr = fmt.Errorf("failed to write JUnit report: %v", err)
+		} else {
+			log.Printf("Wrote JUnit report to %q", r.junitPath)
+		}
+	}
+
+	if err != nil {
+		if writeErr != nil {
+			log.Println(writeErr)
+		}
+		return err
+	}
+	return writeErr
+}
+
+func (r *report) writeJSON(path string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr"`
+	Properties *junitProperties `xml:"properties,omitempty"`
+	Cases      []junitCase      `xml:"testcase"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+type junitProperties struct {
+	Properties []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the report as a single test suite with a test case for
+// each step. Commands that don't break down into steps, or that fail
+// outside of a step, get a test case for the whole command.
+func (r *report) writeJUnit(path string) error {
+	class := "consul-live." + r.Command
+	suite := junitSuite{
+		Name:      class,
+		Time:      junitTime(r.Duration),
+		Timestamp: r.Start.UTC().Format("2006-01-02T15:04:05"),
+	}
+
+	steps := r.Steps
+	var failed bool
+	for _, step := range steps {
+		failed = failed || !step.Passed
+	}
+	if len(steps) == 0 || (!r.Passed && !failed) {
+		steps = append(steps, &reportStep{
+			Name:     r.Command,
+			Duration: r.Duration,
+			Passed:   r.Passed,
+			Error:    r.Error,
+		})
+	}
+	for _, step := range steps {
+		tc := junitCase{
+			ClassName: class,
+			Name:      step.Name,
+			Time:      junitTime(step.Duration),
+		}
+		if !step.Passed {
+			tc.Failure = &junitFailure{Message: step.Error, Text: step.Error}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(suite.Cases)
+
+	var props []junitProperty
+	if r.Seed != 0 {
+		props = append(props, junitProperty{"seed", fmt.Sprintf("%d", r.Seed)})
+	}
+	var out []string
+	for _, dir := range r.LogDirs {
+		props = append(props, junitProperty{"log_dir", dir})
+		out = append(out, fmt.Sprintf("Agent logs are in %s", dir))
+	}
+	suite.SystemOut = strings.Join(out, "\n")
+	var names []string
+	for name := range r.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		props = append(props, junitProperty{name, fmt.Sprintf("%g", r.Metrics[name])})
+	}
+	if len(props) > 0 {
+		suite.Properties = &junitProperties{props}
+	}
+
+	content, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append([]byte(xml.Header), content...)
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// junitTime formats seconds the way JUnit expects.
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
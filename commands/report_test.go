@@ -0,0 +1,226 @@
+package commands
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// junitResult is what a test case in a JUnit report boils down to.
+type junitResult struct {
+	name   string
+	failed string
+}
+
+func TestReport_Finish(t *testing.T) {
+	failure := errors.New("boom")
+
+	cases := []struct {
+		name   string
+		run    func(r *report) error
+		passed bool
+		steps  []junitResult
+		cases  []junitResult
+	}{
+		{
+			"passing",
+			func(r *report) error {
+				r.begin("one")
+				r.begin("two")
+				return nil
+			},
+			true,
+			[]junitResult{{"one", ""}, {"two", ""}},
+			[]junitResult{{"one", ""}, {"two", ""}},
+		},
+		{
+			"failing step",
+			func(r *report) error {
+				r.begin("one")
+				r.begin("two")
+				return failure
+			},
+			false,
+			[]junitResult{{"one", ""}, {"two", "boom"}},
+			[]junitResult{{"one", ""}, {"two", "boom"}},
+		},
+		{
+			"failing recorded step",
+			func(r *report) error {
+				r.begin("one")
+				r.endWith(failure)
+				r.begin("two")
+				return nil
+			},
+			true,
+			[]junitResult{{"one", "boom"}, {"two", ""}},
+			[]junitResult{{"one", "boom"}, {"two", ""}},
+		},
+		{
+			"failing outside a step",
+			func(r *report) error {
+				r.begin("one")
+				r.end()
+				return failure
+			},
+			false,
+			[]junitResult{{"one", ""}},
+			[]junitResult{{"one", ""}, {"test", "boom"}},
+		},
+		{
+			"passing without steps",
+			func(r *report) error {
+				return nil
+			},
+			true,
+			nil,
+			[]junitResult{{"test", ""}},
+		},
+		{
+			"failing without steps",
+			func(r *report) error {
+				return failure
+			},
+			false,
+			nil,
+			[]junitResult{{"test", "boom"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := newReport("test")
+			r.jsonPath = filepath.Join(dir, "report.json")
+			r.junitPath = filepath.Join(dir, "report.xml")
+			r.Seed = 42
+			r.metric("ops", 12)
+
+			runErr := tc.run(r)
+			if err := r.finish(runErr); err != runErr {
+				t.Fatalf("bad: %v", err)
+			}
+
+			// Round trip the JSON.
+			content, err := ioutil.ReadFile(r.jsonPath)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			var got report
+			if err := json.Unmarshal(content, &got); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if got.Command != "test" || got.Passed != tc.passed || got.Seed != 42 || got.Metrics["ops"] != 12 {
+				t.Fatalf("bad: %#v", got)
+			}
+			if !tc.passed && got.Error != "boom" {
+				t.Fatalf("bad: %q", got.Error)
+			}
+			var steps []junitResult
+			for _, step := range got.Steps {
+				if step.Passed != (step.Error == "") {
+					t.Fatalf("bad: %#v", step)
+				}
+				steps = append(steps, junitResult{step.Name, step.Error})
+			}
+			if !reflect.DeepEqual(steps, tc.steps) {
+				t.Fatalf("bad: %v", steps)
+			}
+
+			// Parse the JUnit XML.
+			content, err = ioutil.ReadFile(r.junitPath)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			var suites junitSuites
+			if err := xml.Unmarshal(content, &suites); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if len(suites.Suites) != 1 {
+				t.Fatalf("bad: %#v", suites)
+			}
+			suite := suites.Suites[0]
+			var results []junitResult
+			var failures int
+			for _, c := range suite.Cases {
+				if c.ClassName != "consul-live.test" {
+					t.Fatalf("bad: %q", c.ClassName)
+				}
+				result := junitResult{name: c.Name}
+				if c.Failure != nil {
+					result.failed = c.Failure.Message
+					failures++
+				}
+				results = append(results, result)
+			}
+			if !reflect.DeepEqual(results, tc.cases) {
+				t.Fatalf("bad: %v", results)
+			}
+			if suite.Tests != len(tc.cases) || suite.Failures != failures {
+				t.Fatalf("bad: %d tests with %d failures", suite.Tests, suite.Failures)
+			}
+			want := []junitProperty{{"seed", "42"}, {"ops", "12"}}
+			if suite.Properties == nil || !reflect.DeepEqual(suite.Properties.Properties, want) {
+				t.Fatalf("bad: %#v", suite.Properties)
+			}
+		})
+	}
+}
+
+func TestReport_FinishLogDirs(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept")
+	removed := filepath.Join(dir, "removed")
+	if err := ioutil.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r := newReport("test")
+	r.junitPath = filepath.Join(dir, "report.xml")
+	r.logDir(kept)
+	r.logDir(removed)
+	if err := r.finish(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(r.LogDirs, []string{kept}) {
+		t.Fatalf("bad: %v", r.LogDirs)
+	}
+
+	content, err := ioutil.ReadFile(r.junitPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal(content, &suites); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	suite := suites.Suites[0]
+	want := []junitProperty{{"log_dir", kept}}
+	if suite.Properties == nil || !reflect.DeepEqual(suite.Properties.Properties, want) {
+		t.Fatalf("bad: %#v", suite.Properties)
+	}
+	if suite.SystemOut != "Agent logs are in "+kept {
+		t.Fatalf("bad: %q", suite.SystemOut)
+	}
+}
+
+func TestReport_FinishWriteError(t *testing.T) {
+	failure := errors.New("boom")
+	path := filepath.Join(t.TempDir(), "missing", "report.json")
+
+	// A failed write is only returned if the command passed.
+	r := newReport("test")
+	r.jsonPath = path
+	if err := r.finish(nil); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	r = newReport("test")
+	r.jsonPath = path
+	if err := r.finish(failure); err != failure {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/consul-live/live"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// rollbackData starts the previous version on the data dir as the
+	// upgraded version left it.
+	rollbackData = "data"
+
+	// rollbackSnapshot starts the previous version on an empty data dir and
+	// restores a snapshot taken before the upgrade.
+	rollbackSnapshot = "snapshot"
+)
+
+// tryRollback starts the previous version of Consul the way the mode says,
+// using prepare to do anything else it needs once there's a leader, and then
+// checks the data with the fuzzer. The agent must already be stopped. The
+// upgraded data dir is put back afterwards either way.
+//
+// The first error returned is the outcome of the rollback. The second is for
+// problems that mean the run can't carry on, like failing to put the data
+// dir back.
+func tryRollback(dataDir, mode string, start func() (*live.Consul, error), prepare func(*live.Consul) error, fuzz *live.Fuzz) (rbErr error, err error) {
+	backup := dataDir + ".upgraded"
+	if err := os.Rename(dataDir, backup); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(dataDir); rmErr != nil && err == nil {
+			err = rmErr
+		}
+		if mvErr := os.Rename(backup, dataDir); mvErr != nil && err == nil {
+			err = mvErr
+		}
+	}()
+
+	switch mode {
+	case rollbackData:
+		if err := copyDir(backup, dataDir); err != nil {
+			return nil, err
+		}
+
+	case rollbackSnapshot:
+		// The node ID is kept, the way an operator would when only
+		// throwing away the Raft data on a server.
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, err
+		}
+		id := filepath.Join(backup, "node-id")
+		if info, err := os.Stat(id); err == nil {
+			if err := copyFile(id, filepath.Join(dataDir, "node-id"), info.Mode().Perm()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	consul, err := start()
+	if err != nil {
+		return nil, err
+	}
+	if err := consul.Start(); err != nil {
+		return err, nil
+	}
+	defer consul.Shutdown()
+
+	if err := waitForLeader(consul); err != nil {
+		return err, nil
+	}
+	if prepare != nil {
+		if err := prepare(consul); err != nil {
+			return err, nil
+		}
+	}
+	return fuzz.Verify(), nil
+}
+
+// saveSnapshot writes a snapshot of the cluster's state to the given file.
+func saveSnapshot(client *api.Client, path string) error {
+	snap, _, err := client.Snapshot().Save(nil)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, snap); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restoreSnapshot replaces the cluster's state with the snapshot in the
+// given file.
+func restoreSnapshot(client *api.Client, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.Snapshot().Restore(nil, f)
+}
+
+// copyDir copies the directories and regular files under from into to.
+func copyDir(from, to string) error {
+	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,769 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
+	"github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
+)
+
+func RunCommandFactory() (cli.Command, error) {
+	return &Run{}, nil
+}
+
+type Run struct {
+}
+
+func (c *Run) Help() string {
+	helpText := `
+Usage consul-live run <options> scenario.json
+
+  Runs a scenario described by a JSON file, which gives the topology of one
+  or more managed clusters and a list of steps to run against them in order,
+  like this:
+
+    {
+      "datacenters": [
+        {
+          "name": "dc1",
+          "consul": "/path/to/consul",
+          "servers": 3,
+          "clients": 1,
+          "server_args": ["-hcl", "acl_datacenter=\"dc1\"", "-hcl", "acl_master_token=\"root\""],
+          "lan": {"latency": "5ms", "jitter": "2ms"}
+        }
+      ],
+      "steps": [
+        {"action": "fuzz-populate", "count": 5},
+        {"action": "load", "ops": "key-crud,agent-self", "rate": 20, "background": true},
+        {"action": "kill", "target": "leader", "after": "10s"},
+        {"action": "assert-leader", "within": "10s"},
+        {"action": "start", "target": "server-1"},
+        {"action": "partition", "groups": [["server-1"], ["server-2", "server-3"]]},
+        {"action": "heal", "after": "10s"},
+        {"action": "upgrade", "target": "server-2", "consul": "1.0.7"},
+        {"action": "wait-stable", "within": "1m"},
+        {"action": "fuzz-verify"}
+      ]
+    }
+
+  Consul executables for datacenters and upgrades can be given any way the
+  upgrade command accepts them, such as a release version like "1.0.6", a
+  local path or a URL. They're all fetched before any clusters start.
+
+  Datacenters after the first are joined to it over the WAN. Each one takes
+  a "lan" and a "wan" link with "latency", "jitter", "loss", and "bandwidth"
+  like the cluster command's flags.
+
+  Every step can have a "name", a "datacenter" (defaults to the first one),
+  and an "after" delay. Agents are targeted with "leader", "random-server",
+  "random-client", "server-N", "client-N" (counting from 1), or a node name.
+  Fault steps default to the leader, and random targets are picked from the
+  agents that are running and not paused. The actions are:
+
+    sleep          Waits for "duration"
+    kill           Kills the target with SIGKILL
+    leave          Has the target gracefully leave, then stops it
+    start          Starts a stopped target back up
+    restart        Gracefully restarts the target
+    pause          Freezes the target with SIGSTOP
+    resume         Unfreezes a paused target
+    isolate        Cuts the target off from the other agents
+    partition      Splits the agents into the given "groups" of targets
+    heal           Removes any partition
+    upgrade        Restarts the target using the "consul" version or executable
+    wait-stable    Waits up to "within" for every agent to be up and the servers
+                   to have a leader, defaults to 2m
+    assert-leader  Fails unless a quorum of servers agree on a leader within
+                   "within", defaults to 2m
+    load           Runs a workload like the load command, given with "ops" or as a
+                   "profile", at "rate" (defaults to 10) for "duration"
+    fill           Writes "keys" KV entries of "size" bytes (defaults to 1024 and 128)
+    block          Runs "queries" blocking queries (defaults to 1)
+    fuzz-populate  Writes fuzz data "count" times (defaults to 1), which needs ACLs
+                   to be enabled with "root" as the master token
+    fuzz-verify    Checks that all the fuzz data is still intact
+
+  Workloads use the first client agent, or the first server if there aren't
+  any clients, unless they are given a target. A "load" or "block" step with
+  "background" set keeps running during the following steps, until its
+  "duration" is up or the scenario ends; "block" always runs in the
+  background.
+
+  The scenario stops at the first step that fails, preserving the clusters'
+  data dirs and logs.
+
+Options:
+
+-seed=<int>             Seed for all random choices, defaults to the scenario's seed or a
+                        time-based seed
+-log-dir=<string>       Directory for agent log files, with a directory for each datacenter,
+                        defaults to a directory under each cluster's data dir
+-tee-logs=<bool>        If true, also copies agent logs to stdout prefixed by node name,
+                        defaults to false
+-cache-dir=<string>     Directory to keep downloaded executables in, defaults to ~/.consul-live/bin
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Run) Synopsis() string {
+	return "Runs a scenario from a file against managed clusters"
+}
+
+type runConfig struct {
+	Scenario *scenario
+	LogDir   string
+	TeeLogs  bool
+	CacheDir string
+	Seed     int64
+}
+
+func (c *Run) Run(args []string) int {
+	cfg := &runConfig{}
+	rep := newReport("run")
+	cmdFlags := flag.NewFlagSet("run", flag.ContinueOnError)
+	cmdFlags.Usage = func() { log.Println(c.Help()) }
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	cmdFlags.StringVar(&cfg.LogDir, "log-dir", "", "")
+	cmdFlags.BoolVar(&cfg.TeeLogs, "tee-logs", false, "")
+	cmdFlags.StringVar(&cfg.CacheDir, "cache-dir", defaultCacheDir(), "")
+	rep.flags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) != 1 {
+		log.Println("A single scenario file is required")
+		return 1
+	}
+
+	var err error
+	cfg.Scenario, err = readScenario(args[0])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = cfg.Scenario.Seed
+	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+// scenarioCluster is a running datacenter from a scenario.
+type scenarioCluster struct {
+	cluster *live.Cluster
+
+	// fuzz is made by the first fuzz-populate step.
+	fuzz *live.Fuzz
+}
+
+// scenarioRun holds the state of a scenario while its steps run.
+type scenarioRun struct {
+	rand      *rand.Rand
+	clusters  map[string]*scenarioCluster
+	interrupt chan os.Signal
+
+	// stops are called to stop background workloads at the end.
+	stops []func()
+}
+
+func (c *Run) run(cfg *runConfig, rep *report) (err error) {
+	s := cfg.Scenario
+	run := &scenarioRun{
+		rand:      rand.New(rand.NewSource(cfg.Seed)),
+		clusters:  make(map[string]*scenarioCluster),
+		interrupt: make(chan os.Signal, 1),
+	}
+	signal.Notify(run.interrupt, os.Interrupt)
+	defer signal.Stop(run.interrupt)
+
+	defer func() {
+		for _, dc := range s.Datacenters {
+			if sc, ok := run.clusters[dc.Name]; ok {
+				sc.cluster.Preserve = err != nil
+				if err := sc.cluster.Shutdown(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	rep.begin("fetch executables")
+	cache := &binaryCache{Dir: cfg.CacheDir}
+	if err := s.resolveExecutables(cache); err != nil {
+		return err
+	}
+	rep.end()
+
+	var wanJoin string
+	for i, dc := range s.Datacenters {
+		cc := &live.ClusterConfig{
+			Executable:    dc.executable,
+			Servers:       dc.Servers,
+			ServerArgs:    dc.ServerArgs,
+			Clients:       dc.Clients,
+			ClientArgs:    dc.ClientArgs,
+			Datacenter:    dc.Name,
+			TeeLogs:       cfg.TeeLogs,
+			Partitionable: dc.partitionable,
+			Seed:          cfg.Seed + int64(i),
+		}
+		if cfg.LogDir != "" {
+			cc.LogDir = filepath.Join(cfg.LogDir, dc.Name)
+		}
+
+		var cluster *live.Cluster
+		cluster, err = live.NewCluster(cc)
+		if err != nil {
+			return err
+		}
+		if cluster.Network != nil {
+			cluster.Network.ShapeAll(dc.LAN.config())
+			for _, consul := range cluster.Agents {
+				cluster.Network.Shape("", consul.Name, dc.WAN.config())
+				cluster.Network.Shape(consul.Name, "", dc.WAN.config())
+			}
+		}
+		run.clusters[dc.Name] = &scenarioCluster{cluster: cluster}
+
+		log.Printf("Starting %s with %d servers and %d clients...", dc.Name, dc.Servers, dc.Clients)
+		if err := cluster.Start(); err != nil {
+			return err
+		}
+		if err := waitForStable(cluster); err != nil {
+			return err
+		}
+		log.Printf("Agent logs for %s are in %q", dc.Name, cluster.LogDir)
+		rep.logDir(cluster.LogDir)
+
+		if i > 0 {
+			if err := cluster.Client.Agent().Join(wanJoin, true); err != nil {
+				return err
+			}
+		} else {
+			wanJoin = cluster.WANJoin
+		}
+	}
+
+	defer func() {
+		for _, stop := range run.stops {
+			stop()
+		}
+	}()
+
+	for i, step := range s.Steps {
+		if err := run.sleep(time.Duration(step.After)); err != nil {
+			return err
+		}
+
+		log.Printf("Running step %d/%d %s in %s...", i+1, len(s.Steps), step, step.Datacenter)
+		start := time.Now()
+		rep.begin(fmt.Sprintf("step %d %s", i+1, step))
+		action := scenarioActions[step.Action]
+		if err := action.Fn(run, run.clusters[step.Datacenter], step); err != nil {
+			return fmt.Errorf("step %d %s failed: %v", i+1, step, err)
+		}
+		rep.end()
+		log.Printf("Step %d %s done after %s", i+1, step, time.Now().Sub(start))
+	}
+
+	log.Printf("Scenario passed, all %d steps done", len(s.Steps))
+	return nil
+}
+
+// sleep waits for the given time, returning an error if the run is
+// interrupted.
+func (r *scenarioRun) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	select {
+	case <-r.interrupt:
+		return fmt.Errorf("interrupted")
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// newRand returns a new source of randomness derived from the run's seed, for
+// things that run concurrently.
+func (r *scenarioRun) newRand() *rand.Rand {
+	return rand.New(rand.NewSource(r.rand.Int63()))
+}
+
+// resolveTarget returns the agent the given target refers to.
+func (c *scenarioCluster) resolveTarget(r *rand.Rand, target string) (*live.Consul, error) {
+	switch {
+	case target == "", target == "leader":
+		return c.cluster.Leader()
+
+	case target == "random-server":
+		return pickRunning(r, c.cluster.Servers())
+
+	case target == "random-client":
+		return pickRunning(r, c.cluster.Clients())
+
+	case strings.HasPrefix(target, "server-"):
+		idx, _ := strconv.Atoi(strings.TrimPrefix(target, "server-"))
+		return c.cluster.Servers()[idx-1], nil
+
+	case strings.HasPrefix(target, "client-"):
+		idx, _ := strconv.Atoi(strings.TrimPrefix(target, "client-"))
+		return c.cluster.Clients()[idx-1], nil
+
+	default:
+		consul := c.cluster.AgentByNode(target)
+		if consul == nil {
+			return nil, fmt.Errorf("unknown target %q", target)
+		}
+		return consul, nil
+	}
+}
+
+// pickRunning returns a random agent that's running and not paused.
+func pickRunning(r *rand.Rand, agents []*live.Consul) (*live.Consul, error) {
+	var running []*live.Consul
+	for _, consul := range agents {
+		if consul.Running() && !consul.Paused() {
+			running = append(running, consul)
+		}
+	}
+	if len(running) == 0 {
+		return nil, fmt.Errorf("no agents are running to pick from")
+	}
+	return running[r.Intn(len(running))], nil
+}
+
+// workloadClient returns the client a workload should use.
+func (c *scenarioCluster) workloadClient(r *rand.Rand, target string) (*api.Client, error) {
+	if target != "" {
+		consul, err := c.resolveTarget(r, target)
+		if err != nil {
+			return nil, err
+		}
+		return consul.Client, nil
+	}
+
+	if clients := c.cluster.Clients(); len(clients) > 0 {
+		return clients[0].Client, nil
+	}
+	return c.cluster.Agents[0].Client, nil
+}
+
+// agreedLeader returns the server that a quorum of the servers, including
+// itself, say is the leader, or nil if there isn't one. Paused servers can't
+// answer so they don't count.
+func (c *scenarioCluster) agreedLeader() *live.Consul {
+	servers := c.cluster.Servers()
+	votes := make(map[string]int)
+	for _, server := range servers {
+		if !server.Running() || server.Paused() {
+			continue
+		}
+		addr, err := server.Client.Status().Leader()
+		if err == nil && addr != "" {
+			votes[addr]++
+		}
+	}
+
+	for _, server := range servers {
+		addr := fmt.Sprintf("127.0.0.1:%d", server.Ports.Server)
+		if votes[addr] <= len(servers)/2 || !server.Running() || server.Paused() {
+			continue
+		}
+		if self, err := server.Client.Status().Leader(); err == nil && self == addr {
+			return server
+		}
+	}
+	return nil
+}
+
+// scenarioAction describes an action that can be used in a scenario step.
+type scenarioAction struct {
+	Fn func(*scenarioRun, *scenarioCluster, *scenarioStep) error
+
+	// Check makes sure the step is sensible and fills in defaults before
+	// anything starts.
+	Check func(*scenarioDatacenter, *scenarioStep) error
+
+	// Partition is set for actions that need the datacenter's Network.
+	Partition bool
+}
+
+// scenarioActions has all the actions that can be used in a scenario, by
+// name.
+var scenarioActions = map[string]scenarioAction{
+	"sleep":         {Fn: actionSleep, Check: checkSleep},
+	"kill":          agentAction("Killing", func(consul *live.Consul) error { return consul.Shutdown() }),
+	"leave":         agentAction("Leaving", actionLeave),
+	"start":         agentAction("Starting", func(consul *live.Consul) error { return consul.Start() }),
+	"restart":       agentAction("Restarting", func(consul *live.Consul) error { return consul.Restart(30 * time.Second) }),
+	"pause":         agentAction("Pausing", func(consul *live.Consul) error { return consul.Pause() }),
+	"resume":        agentAction("Resuming", func(consul *live.Consul) error { return consul.Resume() }),
+	"isolate":       {Fn: actionIsolate, Check: checkStepTarget, Partition: true},
+	"partition":     {Fn: actionPartition, Check: checkPartition, Partition: true},
+	"heal":          {Fn: actionHeal, Partition: true},
+	"upgrade":       {Fn: actionUpgrade, Check: checkUpgrade},
+	"wait-stable":   {Fn: actionWaitStable, Check: checkWithin},
+	"assert-leader": {Fn: actionAssertLeader, Check: checkWithin},
+	"load":          {Fn: actionLoad, Check: checkLoad},
+	"fill":          {Fn: actionFill, Check: checkFill},
+	"block":         {Fn: actionBlock, Check: checkBlock},
+	"fuzz-populate": {Fn: actionFuzzPopulate, Check: checkFuzzPopulate},
+	"fuzz-verify":   {Fn: actionFuzzVerify},
+}
+
+// agentAction makes an action that does something to the step's target.
+func agentAction(verb string, fn func(*live.Consul) error) scenarioAction {
+	return scenarioAction{
+		Fn: func(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+			consul, err := c.resolveTarget(r.rand, step.Target)
+			if err != nil {
+				return err
+			}
+			log.Printf("%s %q...", verb, consul.Name)
+			return fn(consul)
+		},
+		Check: checkStepTarget,
+	}
+}
+
+func checkStepTarget(dc *scenarioDatacenter, step *scenarioStep) error {
+	return checkTarget(dc, step.Target)
+}
+
+func checkSleep(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Duration <= 0 {
+		return fmt.Errorf("a positive duration is required")
+	}
+	return nil
+}
+
+func actionSleep(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	return r.sleep(time.Duration(step.Duration))
+}
+
+// actionLeave has the agent leave gracefully. The agent exits on its own
+// after leaving, so we make sure it's gone before carrying on.
+func actionLeave(consul *live.Consul) error {
+	if err := consul.Client.Agent().Leave(); err != nil {
+		return err
+	}
+	return consul.Stop(os.Interrupt, 30*time.Second)
+}
+
+func actionIsolate(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	consul, err := c.resolveTarget(r.rand, step.Target)
+	if err != nil {
+		return err
+	}
+	return c.cluster.Network.Isolate(consul.Name)
+}
+
+func checkPartition(dc *scenarioDatacenter, step *scenarioStep) error {
+	if len(step.Groups) == 0 {
+		return fmt.Errorf("at least one group is required")
+	}
+	for _, group := range step.Groups {
+		for _, target := range group {
+			if err := checkTarget(dc, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func actionPartition(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	var groups [][]string
+	for _, group := range step.Groups {
+		var nodes []string
+		for _, target := range group {
+			consul, err := c.resolveTarget(r.rand, target)
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, consul.Name)
+		}
+		groups = append(groups, nodes)
+	}
+	return c.cluster.Network.Partition(groups...)
+}
+
+func actionHeal(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	c.cluster.Network.Heal()
+	return nil
+}
+
+func checkUpgrade(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Consul == "" {
+		return fmt.Errorf("a version or executable to upgrade to is required")
+	}
+	return checkTarget(dc, step.Target)
+}
+
+func actionUpgrade(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	consul, err := c.resolveTarget(r.rand, step.Target)
+	if err != nil {
+		return err
+	}
+	for i, agent := range c.cluster.Agents {
+		if agent == consul {
+			log.Printf("Upgrading %q to Consul %q from %q...", consul.Name, step.Consul, step.executable)
+			return c.cluster.Upgrade(i, step.executable)
+		}
+	}
+	return fmt.Errorf("agent %q isn't part of the cluster", consul.Name)
+}
+
+func checkWithin(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Within == 0 {
+		step.Within = scenarioDuration(startTimeout)
+	}
+	if step.Within < 0 {
+		return fmt.Errorf("within can't be negative")
+	}
+	return nil
+}
+
+func actionWaitStable(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(step.Within))
+	defer cancel()
+	return c.cluster.WaitForStable(ctx)
+}
+
+func actionAssertLeader(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	start := time.Now()
+	deadline := start.Add(time.Duration(step.Within))
+	for {
+		if leader := c.agreedLeader(); leader != nil {
+			log.Printf("Servers agree %q is the leader after %s", leader.Name, time.Now().Sub(start))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no leader agreed on by a quorum of servers within %s", time.Duration(step.Within))
+		}
+		if err := r.sleep(100 * time.Millisecond); err != nil {
+			return err
+		}
+	}
+}
+
+// checkLoad builds the step's profile the same way the load command does.
+func checkLoad(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Rate == 0 {
+		step.Rate = 10
+	}
+	if step.Rate < 1 {
+		return fmt.Errorf("rate must be at least 1 op/second")
+	}
+	if step.Duration <= 0 && !step.Background {
+		return fmt.Errorf("a positive duration is required unless the load runs in the background")
+	}
+	if step.Target != "" {
+		if err := checkTarget(dc, step.Target); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case step.Profile != nil && step.Ops != "":
+		return fmt.Errorf("only one of profile and ops can be given")
+	case step.Ops != "":
+		step.Profile, err = parseOpsFlag(step.Ops, step.Rate, opParams{Keys: step.Keys, ValueSize: step.Size})
+	case step.Profile == nil:
+		step.Profile = defaultProfile(step.Rate)
+	}
+	if err != nil {
+		return err
+	}
+	return step.Profile.finalize(step.Rate)
+}
+
+func actionLoad(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	client, err := c.workloadClient(r.rand, step.Target)
+	if err != nil {
+		return err
+	}
+
+	rec := newRecorder()
+	stop := make(chan struct{})
+	for _, w := range step.Profile.Workers {
+		go runWorker(client, r.newRand(), w, rec, stop)
+	}
+
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			close(stop)
+			logSummaries(fmt.Sprintf("Stats for load %s", step), rec.Total())
+		})
+	}
+	if step.Background {
+		r.stops = append(r.stops, finish)
+		if step.Duration > 0 {
+			time.AfterFunc(time.Duration(step.Duration), finish)
+		}
+		return nil
+	}
+
+	defer finish()
+	return r.sleep(time.Duration(step.Duration))
+}
+
+func checkFill(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Keys == 0 {
+		step.Keys = 1024
+	}
+	if step.Size == 0 {
+		step.Size = 128
+	}
+	if step.Keys < 0 || step.Size < 0 {
+		return fmt.Errorf("keys and size can't be negative")
+	}
+	if step.Target != "" {
+		return checkTarget(dc, step.Target)
+	}
+	return nil
+}
+
+func actionFill(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	client, err := c.workloadClient(r.rand, step.Target)
+	if err != nil {
+		return err
+	}
+	return (&Fill{}).run(client, r.newRand(), step.Keys, step.Size)
+}
+
+func checkBlock(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Queries == 0 {
+		step.Queries = 1
+	}
+	if step.Queries < 0 {
+		return fmt.Errorf("queries can't be negative")
+	}
+	step.Background = true
+	if step.Target != "" {
+		return checkTarget(dc, step.Target)
+	}
+	return nil
+}
+
+func actionBlock(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	client, err := c.workloadClient(r.rand, step.Target)
+	if err != nil {
+		return err
+	}
+
+	kv := client.KV()
+	stop := make(chan struct{})
+	for i := 0; i < step.Queries; i++ {
+		key := fmt.Sprintf("block/%d", i+1)
+		if _, err := kv.Put(&api.KVPair{Key: key}, nil); err != nil {
+			close(stop)
+			return err
+		}
+		go runBlocker(kv, key, stop)
+	}
+
+	var once sync.Once
+	finish := func() {
+		once.Do(func() { close(stop) })
+	}
+	r.stops = append(r.stops, finish)
+	if step.Duration > 0 {
+		time.AfterFunc(time.Duration(step.Duration), finish)
+	}
+	return nil
+}
+
+// runBlocker keeps a blocking query on the given key going until stop is
+// closed. Errors are expected while faults are going on, so this just backs
+// off and tries again.
+func runBlocker(kv *api.KV, key string, stop <-chan struct{}) {
+	qo := &api.QueryOptions{WaitTime: 10 * time.Second}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		_, qm, err := kv.Get(key, qo)
+		if err != nil {
+			log.Printf("Blocking query on %q failed (will retry): %v", key, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		qo.WaitIndex = qm.LastIndex
+	}
+}
+
+func checkFuzzPopulate(dc *scenarioDatacenter, step *scenarioStep) error {
+	if step.Count == 0 {
+		step.Count = 1
+	}
+	if step.Count < 0 {
+		return fmt.Errorf("count can't be negative")
+	}
+	if step.Target != "" {
+		return checkTarget(dc, step.Target)
+	}
+	return nil
+}
+
+func actionFuzzPopulate(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	if c.fuzz == nil {
+		client, err := c.workloadClient(r.rand, step.Target)
+		if err != nil {
+			return err
+		}
+		c.fuzz, err = live.NewFuzz(client, r.rand.Int63())
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < step.Count; i++ {
+		if err := c.fuzz.Populate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func actionFuzzVerify(r *scenarioRun, c *scenarioCluster, step *scenarioStep) error {
+	if c.fuzz == nil {
+		return fmt.Errorf("there's no fuzz data to verify, use fuzz-populate first")
+	}
+	return c.fuzz.Verify()
+}
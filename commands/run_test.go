@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScenario writes out a scenario for a cluster of fake agents with the
+// given steps, and reads it back in.
+func testScenario(t *testing.T, steps string) *scenario {
+	content := fmt.Sprintf(`{
+  "datacenters": [{"consul": %q, "servers": 3}],
+  "steps": [%s]
+}`, fakeConsul(t), steps)
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s, err := readScenario(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return s
+}
+
+func TestRun_Scenario(t *testing.T) {
+	s := testScenario(t, fmt.Sprintf(`
+    {"action": "pause", "target": "server-1"},
+    {"action": "restart", "target": "leader"},
+    {"action": "assert-leader", "within": "10s"},
+    {"action": "resume", "target": "server-1"},
+    {"action": "upgrade", "target": "server-2", "consul": %q},
+    {"action": "wait-stable", "within": "30s"}`, fakeConsul(t)))
+	cfg := &runConfig{Scenario: s, CacheDir: t.TempDir(), Seed: 1}
+	rep := newReport("run")
+	if err := (&Run{}).run(cfg, rep); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkStepsPassed(t, rep)
+}
+
+func TestRun_WaitStableWithPausedAgent(t *testing.T) {
+	s := testScenario(t, `
+    {"action": "pause", "target": "server-1"},
+    {"action": "wait-stable", "within": "1s"}`)
+	cfg := &runConfig{Scenario: s, CacheDir: t.TempDir(), Seed: 1}
+
+	// The failed run preserves its data dir, so keep it with the test's.
+	t.Setenv("TMPDIR", t.TempDir())
+
+	start := time.Now()
+	err := (&Run{}).run(cfg, newReport("run"))
+	if err == nil || !strings.Contains(err.Error(), "wait-stable") {
+		t.Fatalf("bad: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 30*time.Second {
+		t.Fatalf("took too long to give up: %s", elapsed)
+	}
+}
@@ -0,0 +1,264 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
+)
+
+// scenario describes a whole test run: the datacenters to start and the
+// steps to run against them, in order.
+type scenario struct {
+	Seed        int64                 `json:"seed"`
+	Datacenters []*scenarioDatacenter `json:"datacenters"`
+	Steps       []*scenarioStep       `json:"steps"`
+}
+
+// scenarioDatacenter is the topology of one managed cluster. Datacenters
+// after the first are joined to it over the WAN.
+type scenarioDatacenter struct {
+	Name       string   `json:"name"`
+	Consul     string   `json:"consul"`
+	Servers    int      `json:"servers"`
+	ServerArgs []string `json:"server_args"`
+	Clients    int      `json:"clients"`
+	ClientArgs []string `json:"client_args"`
+
+	// LAN is the conditions between agents in the datacenter, and WAN is
+	// the conditions to and from other datacenters.
+	LAN scenarioLink `json:"lan"`
+	WAN scenarioLink `json:"wan"`
+
+	// partitionable is set if any of the steps need the datacenter's
+	// Network.
+	partitionable bool
+
+	// executable is the path Consul resolves to, see resolveExecutables.
+	executable string
+}
+
+// scenarioLink is the JSON form of a live.LinkConfig.
+type scenarioLink struct {
+	Latency   scenarioDuration `json:"latency"`
+	Jitter    scenarioDuration `json:"jitter"`
+	Loss      float64          `json:"loss"`
+	Bandwidth int              `json:"bandwidth"`
+}
+
+func (l scenarioLink) config() live.LinkConfig {
+	return live.LinkConfig{
+		Latency:   time.Duration(l.Latency),
+		Jitter:    time.Duration(l.Jitter),
+		Loss:      l.Loss,
+		Bandwidth: l.Bandwidth,
+	}
+}
+
+// scenarioStep is a single thing to do during a scenario. Each action only
+// looks at the fields that make sense for it.
+type scenarioStep struct {
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Datacenter string `json:"datacenter"`
+
+	// After is how long to wait before running the step.
+	After scenarioDuration `json:"after"`
+
+	// Target picks the agent the step acts on, see resolveTarget.
+	Target string `json:"target"`
+
+	// Groups are the sides of a partition, given as targets.
+	Groups [][]string `json:"groups"`
+
+	// Consul is the version or executable to upgrade an agent to, and
+	// executable is the path it resolves to.
+	Consul     string `json:"consul"`
+	executable string
+
+	// Duration is how long a sleep or a workload runs for, and Within is
+	// how long an assertion has to pass.
+	Duration scenarioDuration `json:"duration"`
+	Within   scenarioDuration `json:"within"`
+
+	// Background runs a workload while the following steps run.
+	Background bool `json:"background"`
+
+	// These configure the workloads.
+	Rate    int          `json:"rate"`
+	Ops     string       `json:"ops"`
+	Profile *loadProfile `json:"profile"`
+	Keys    int          `json:"keys"`
+	Size    int          `json:"size"`
+	Queries int          `json:"queries"`
+	Count   int          `json:"count"`
+}
+
+// String describes the step for logs and errors.
+func (s *scenarioStep) String() string {
+	if s.Name != "" {
+		return fmt.Sprintf("%q (%s)", s.Name, s.Action)
+	}
+	return s.Action
+}
+
+// scenarioDuration is a time.Duration that's given in JSON as a string like
+// "10s".
+type scenarioDuration time.Duration
+
+func (d *scenarioDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = scenarioDuration(v)
+	return nil
+}
+
+// readScenario loads a JSON scenario from the given file and checks it.
+func readScenario(path string) (*scenario, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s scenario
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %q: %v", path, err)
+	}
+	if err := s.finalize(); err != nil {
+		return nil, fmt.Errorf("bad scenario %q: %v", path, err)
+	}
+	return &s, nil
+}
+
+// finalize checks the scenario and fills in defaults, so that mistakes show
+// up before any agents get started.
+func (s *scenario) finalize() error {
+	if len(s.Datacenters) == 0 {
+		return fmt.Errorf("at least one datacenter is required")
+	}
+
+	dcs := make(map[string]*scenarioDatacenter)
+	for i, dc := range s.Datacenters {
+		if dc.Name == "" {
+			dc.Name = fmt.Sprintf("dc%d", i+1)
+		}
+		if _, ok := dcs[dc.Name]; ok {
+			return fmt.Errorf("datacenter %q is given more than once", dc.Name)
+		}
+		dcs[dc.Name] = dc
+
+		if dc.Consul == "" {
+			dc.Consul = "consul"
+		}
+		if dc.Servers+dc.Clients < 1 {
+			return fmt.Errorf("datacenter %q: at least one client or server is required", dc.Name)
+		}
+		if dc.Servers < 0 || dc.Clients < 0 {
+			return fmt.Errorf("datacenter %q: agent counts can't be negative", dc.Name)
+		}
+		dc.partitionable = shaped(dc.LAN.config()) || shaped(dc.WAN.config())
+	}
+
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("at least one step is required")
+	}
+	for i, step := range s.Steps {
+		if step.Datacenter == "" {
+			step.Datacenter = s.Datacenters[0].Name
+		}
+		dc, ok := dcs[step.Datacenter]
+		if !ok {
+			return fmt.Errorf("step %d %s: unknown datacenter %q", i+1, step, step.Datacenter)
+		}
+
+		action, ok := scenarioActions[step.Action]
+		if !ok {
+			return fmt.Errorf("step %d %s: unknown action (valid actions are %s)",
+				i+1, step, strings.Join(scenarioActionNames(), ", "))
+		}
+		if action.Partition {
+			dc.partitionable = true
+		}
+		if action.Check != nil {
+			if err := action.Check(dc, step); err != nil {
+				return fmt.Errorf("step %d %s: %v", i+1, step, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveExecutables finds or downloads every Consul the scenario uses, so
+// they can be given the same way as to the upgrade command. This is done up
+// front so downloads don't hold up the steps.
+func (s *scenario) resolveExecutables(cache *binaryCache) error {
+	for _, dc := range s.Datacenters {
+		executables, err := cache.resolve([]string{dc.Consul})
+		if err != nil {
+			return fmt.Errorf("datacenter %q: %v", dc.Name, err)
+		}
+		dc.executable = executables[0]
+	}
+	for i, step := range s.Steps {
+		if step.Action != "upgrade" {
+			continue
+		}
+		executables, err := cache.resolve([]string{step.Consul})
+		if err != nil {
+			return fmt.Errorf("step %d %s: %v", i+1, step, err)
+		}
+		step.executable = executables[0]
+	}
+	return nil
+}
+
+// checkTarget makes sure a target could refer to an agent in the given
+// datacenter. Node names can't be checked until the agents are made.
+func checkTarget(dc *scenarioDatacenter, target string) error {
+	switch {
+	case target == "", target == "leader", target == "random-server":
+		if dc.Servers == 0 {
+			return fmt.Errorf("target %q needs servers", target)
+		}
+
+	case target == "random-client":
+		if dc.Clients == 0 {
+			return fmt.Errorf("target %q needs clients", target)
+		}
+
+	case strings.HasPrefix(target, "server-"):
+		return checkTargetIndex(target, "server-", dc.Servers)
+
+	case strings.HasPrefix(target, "client-"):
+		return checkTargetIndex(target, "client-", dc.Clients)
+	}
+	return nil
+}
+
+func checkTargetIndex(target, prefix string, n int) error {
+	idx, err := strconv.Atoi(strings.TrimPrefix(target, prefix))
+	if err != nil || idx < 1 || idx > n {
+		return fmt.Errorf("target %q is out of range, there are %d %ss", target, n, strings.TrimSuffix(prefix, "-"))
+	}
+	return nil
+}
+
+func scenarioActionNames() []string {
+	var names []string
+	for name := range scenarioActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
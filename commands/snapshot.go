@@ -0,0 +1,243 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul-live/live"
+	"github.com/mitchellh/cli"
+)
+
+func SnapshotCommandFactory() (cli.Command, error) {
+	return &Snapshot{}, nil
+}
+
+type Snapshot struct {
+}
+
+func (c *Snapshot) Help() string {
+	helpText := `
+Usage consul-live snapshot <options>
+
+  Checks that a snapshot can be used to recover a cluster. A cluster is
+  populated with test data and a snapshot of it is saved, then the cluster is
+  torn down and the snapshot is restored into a brand new cluster, which can
+  be running a different version of Consul. The test data is verified after
+  the restore.
+
+  The executables can be anything the upgrade command accepts, such as a
+  release version like "1.0.6", a local path or a URL.
+
+Options:
+
+-consul=<string>          Consul to save the snapshot from, defaults to "consul" from PATH
+-restore-consul=<string>  Consul to restore the snapshot into, defaults to the same as -consul
+-servers=<int>            Number of servers in each cluster, defaults to 3
+-rounds=<int>             Rounds of test data to populate the cluster with, defaults to 10
+-log-dir=<string>         Directory for agent log files, with "original" and "restored" dirs for each cluster, defaults to a directory under each cluster's data dir
+-tee-logs=<bool>          If true, also copies agent logs to stdout prefixed by node name, defaults to false
+-seed=<int>               Seed for the generated test data, defaults to a time-based seed
+-cache-dir=<string>       Directory to keep downloaded executables in, defaults to ~/.consul-live/bin
+-report-json=<string>     If given, writes a JSON report of the run to this file
+-report-junit=<string>    If given, writes a JUnit XML report of the run to this file
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Snapshot) Synopsis() string {
+	return "Restores a snapshot of a cluster into a new cluster"
+}
+
+type snapshotConfig struct {
+	Consul        string
+	RestoreConsul string
+	Servers       int
+	Rounds        int
+	LogDir        string
+	TeeLogs       bool
+	Seed          int64
+	CacheDir      string
+}
+
+func (c *Snapshot) Run(args []string) int {
+	cfg := &snapshotConfig{}
+	rep := newReport("snapshot")
+	cmdFlags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	cmdFlags.Usage = func() { log.Println(c.Help()) }
+	cmdFlags.StringVar(&cfg.Consul, "consul", "consul", "")
+	cmdFlags.StringVar(&cfg.RestoreConsul, "restore-consul", "", "")
+	cmdFlags.IntVar(&cfg.Servers, "servers", 3, "")
+	cmdFlags.IntVar(&cfg.Rounds, "rounds", 10, "")
+	cmdFlags.StringVar(&cfg.LogDir, "log-dir", "", "")
+	cmdFlags.BoolVar(&cfg.TeeLogs, "tee-logs", false, "")
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	cmdFlags.StringVar(&cfg.CacheDir, "cache-dir", defaultCacheDir(), "")
+	rep.flags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if cfg.Servers < 1 {
+		log.Println("At least one server is required")
+		return 1
+	}
+	if cfg.Rounds < 1 {
+		log.Println("At least one round of test data is required")
+		return 1
+	}
+	if cfg.RestoreConsul == "" {
+		cfg.RestoreConsul = cfg.Consul
+	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	if err := rep.finish(c.run(cfg, rep)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func (c *Snapshot) run(cfg *snapshotConfig, rep *report) (err error) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			log.Printf("Preserving snapshot dir %q", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+
+	rep.begin("fetch versions")
+	cache := &binaryCache{Dir: cfg.CacheDir}
+	executables, err := cache.resolve([]string{cfg.Consul, cfg.RestoreConsul})
+	if err != nil {
+		return err
+	}
+
+	// Both clusters use the same master token, which is what gets restored
+	// along with the rest of the ACLs. Each cluster keeps its logs in its own
+	// dir, named for its part in the run.
+	newCluster := func(executable, name string) (*live.Cluster, error) {
+		cc := &live.ClusterConfig{
+			Executable: executable,
+			Servers:    cfg.Servers,
+			TeeLogs:    cfg.TeeLogs,
+			ServerArgs: []string{
+				"-hcl", `acl_datacenter="dc1"`,
+				"-hcl", `acl_master_token="root"`,
+				"-hcl", `acl_default_policy="allow"`,
+			},
+		}
+		if cfg.LogDir != "" {
+			cc.LogDir = filepath.Join(cfg.LogDir, name)
+		}
+		return live.NewCluster(cc)
+	}
+	startCluster := func(cluster *live.Cluster) error {
+		if err := cluster.Start(); err != nil {
+			return err
+		}
+		log.Printf("Agent logs are in %q", cluster.LogDir)
+		rep.logDir(cluster.LogDir)
+		return waitForStable(cluster)
+	}
+
+	// Start a cluster and fill it up with test data.
+	rep.begin(fmt.Sprintf("start %s", cfg.Consul))
+	log.Printf("Starting %d server cluster from '%s'...", cfg.Servers, executables[0])
+	original, err := newCluster(executables[0], "original")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		original.Preserve = err != nil
+		if err := original.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := startCluster(original); err != nil {
+		return err
+	}
+
+	rep.begin("populate")
+	log.Printf("Populating with %d rounds of test data...", cfg.Rounds)
+	fuzz, err := live.NewFuzz(original.Client, cfg.Seed)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < cfg.Rounds; i++ {
+		if err := fuzz.Populate(); err != nil {
+			return err
+		}
+	}
+	if err := fuzz.Verify(); err != nil {
+		return err
+	}
+
+	rep.begin("save snapshot")
+	path := filepath.Join(dir, "backup.snap")
+	if err := saveSnapshot(original.Client, path); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved %d byte snapshot to %q", info.Size(), path)
+	rep.metric("snapshot_bytes", float64(info.Size()))
+
+	// Take the original cluster away completely, so nothing can come from
+	// it but the snapshot.
+	rep.begin(fmt.Sprintf("tear down %s", cfg.Consul))
+	log.Println("Tearing down the original cluster...")
+	for _, consul := range original.Agents {
+		if err := consul.Shutdown(); err != nil {
+			return err
+		}
+	}
+
+	rep.begin(fmt.Sprintf("start %s", cfg.RestoreConsul))
+	log.Printf("Starting new %d server cluster from '%s'...", cfg.Servers, executables[1])
+	restored, err := newCluster(executables[1], "restored")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		restored.Preserve = err != nil
+		if err := restored.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := startCluster(restored); err != nil {
+		return err
+	}
+
+	rep.begin("restore snapshot")
+	log.Println("Restoring snapshot into the new cluster...")
+	if err := restoreSnapshot(restored.Client, path); err != nil {
+		return err
+	}
+	if err := waitForStable(restored); err != nil {
+		return err
+	}
+
+	// Everything the fuzzer wrote should be there, just as it was.
+	rep.begin("verify restore")
+	fuzz.Client = restored.Client
+	if err := fuzz.Verify(); err != nil {
+		return err
+	}
+
+	rep.end()
+	log.Println("Snapshot restored and verified")
+	return nil
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	exe := fakeConsul(t)
+	logDir := t.TempDir()
+	cfg := &snapshotConfig{
+		Consul:        exe,
+		RestoreConsul: exe,
+		Servers:       3,
+		Rounds:        2,
+		LogDir:        logDir,
+		Seed:          1,
+		CacheDir:      t.TempDir(),
+	}
+	rep := newReport("snapshot")
+	if err := (&Snapshot{}).run(cfg, rep); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkStepsPassed(t, rep)
+
+	// Each cluster logs to its own dir.
+	want := []string{filepath.Join(logDir, "original"), filepath.Join(logDir, "restored")}
+	if len(rep.LogDirs) != len(want) {
+		t.Fatalf("bad: %v", rep.LogDirs)
+	}
+	for i, dir := range want {
+		if rep.LogDirs[i] != dir {
+			t.Fatalf("bad: %v", rep.LogDirs)
+		}
+		logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(logs) != cfg.Servers {
+			t.Fatalf("bad: %v", logs)
+		}
+	}
+}
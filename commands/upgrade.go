@@ -2,16 +2,17 @@ package commands
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/consul-live/live"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/go-getter"
 	"github.com/mitchellh/cli"
 )
 
@@ -24,11 +25,47 @@ type Upgrade struct {
 
 func (c *Upgrade) Help() string {
 	helpText := `
-Usage consul-live upgrade base version1 ... versionN
+Usage consul-live upgrade <options> base version1 ... versionN
 
   Starts Consul using the base executable then shuts it down and upgrades in
   place using the supplied version executables. The base version is populated
   with some test data and that data is verified after each upgrade.
+
+  With -rolling, a multi-server cluster is started on the base executable and
+  each server is replaced one at a time with the next version, waiting for the
+  cluster to become healthy with a stable leader and verifying the test data
+  after every step.
+
+  Each version can be a release version like "1.0.6", a path to a local
+  executable or archive, or a URL. Downloads are kept in the cache dir, so
+  each one is only fetched once. Add "?checksum=sha256:<hex>" to any of them
+  to verify the download.
+
+  With -rollback, each upgrade is followed by an attempt to go back to the
+  previous version, and whether it worked is recorded without failing the
+  run. The "data" mode starts the previous version on the data dir as the
+  upgraded version left it, and the "snapshot" mode starts it on an empty
+  data dir and restores a snapshot taken before the upgrade. The upgraded
+  data dir is put back afterwards so the series can carry on. Rollbacks
+  aren't supported with -rolling.
+
+  The agents run with ACLs using a default allow policy. With -acl-deny the
+  policy is default deny, and with -tls all traffic uses verified TLS, which
+  is how production clusters are usually set up.
+
+Options:
+
+-rolling=<bool>         If true, performs a rolling upgrade of a cluster, defaults to false
+-servers=<int>          Number of servers for a rolling upgrade, defaults to 3
+-log-dir=<string>       Directory for agent log files, defaults to a directory under the data dir
+-tee-logs=<bool>        If true, also copies agent logs to stdout prefixed by node name, defaults to false
+-tls=<bool>             If true, runs with a generated CA and verified TLS for RPC and HTTPS, defaults to false
+-acl-deny=<bool>        If true, uses a default deny ACL policy instead of default allow, defaults to false
+-rollback=<string>      Tries rolling back after each upgrade, "data" or "snapshot", defaults to none
+-cache-dir=<string>     Directory to keep downloaded executables in, defaults to ~/.consul-live/bin
+-seed=<int>             Seed for the generated test data, defaults to a time-based seed
+-report-json=<string>   If given, writes a JSON report of the run to this file
+-report-junit=<string>  If given, writes a JUnit XML report of the run to this file
 `
 	return strings.TrimSpace(helpText)
 }
@@ -37,13 +74,67 @@ func (c *Upgrade) Synopsis() string {
 	return "Runs Consul through a given series of in-place upgrades"
 }
 
+type upgradeConfig struct {
+	Rolling  bool
+	Servers  int
+	LogDir   string
+	TeeLogs  bool
+	Seed     int64
+	CacheDir string
+	TLS      bool
+	ACLDeny  bool
+	Rollback string
+}
+
 func (c *Upgrade) Run(args []string) int {
-	if len(args) < 2 {
+	cfg := &upgradeConfig{}
+	rep := newReport("upgrade")
+	cmdFlags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	cmdFlags.Usage = func() { log.Println(c.Help()) }
+	cmdFlags.BoolVar(&cfg.Rolling, "rolling", false, "")
+	cmdFlags.IntVar(&cfg.Servers, "servers", 3, "")
+	cmdFlags.StringVar(&cfg.LogDir, "log-dir", "", "")
+	cmdFlags.BoolVar(&cfg.TeeLogs, "tee-logs", false, "")
+	cmdFlags.Int64Var(&cfg.Seed, "seed", 0, "")
+	cmdFlags.StringVar(&cfg.CacheDir, "cache-dir", defaultCacheDir(), "")
+	cmdFlags.BoolVar(&cfg.TLS, "tls", false, "")
+	cmdFlags.BoolVar(&cfg.ACLDeny, "acl-deny", false, "")
+	cmdFlags.StringVar(&cfg.Rollback, "rollback", "", "")
+	rep.flags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	versions := cmdFlags.Args()
+	if len(versions) < 2 {
 		log.Println("At least two versions must be given")
 		return 1
 	}
+	cfg.Seed = resolveSeed(cfg.Seed)
+	rep.Seed = cfg.Seed
+
+	switch cfg.Rollback {
+	case "", rollbackData, rollbackSnapshot:
+	default:
+		log.Printf("Unknown rollback mode %q", cfg.Rollback)
+		return 1
+	}
+	if cfg.Rollback != "" && cfg.Rolling {
+		log.Println("Rollbacks can't be combined with -rolling")
+		return 1
+	}
 
-	if err := c.run(args); err != nil {
+	var err error
+	if cfg.Rolling {
+		if cfg.Servers < 1 {
+			log.Println("At least one server is required")
+			return 1
+		}
+		err = c.runRolling(cfg, versions, rep)
+	} else {
+		err = c.run(cfg, versions, rep)
+	}
+	if err := rep.finish(err); err != nil {
 		log.Println(err)
 		return 1
 	}
@@ -59,29 +150,85 @@ type ServerConfig struct {
 	ACLMasterToken   string `json:"acl_master_token,omitempty"`
 	ACLDatacenter    string `json:"acl_datacenter,omitempty"`
 	ACLDefaultPolicy string `json:"acl_default_policy,omitempty"`
+	ACLAgentToken    string `json:"acl_agent_token,omitempty"`
 	RaftProtocol     int    `json:"raft_protocol,omitempty"`
 	LogLevel         string `json:"log_level,omitempty"`
+
+	Ports                map[string]int `json:"ports,omitempty"`
+	CAFile               string         `json:"ca_file,omitempty"`
+	CertFile             string         `json:"cert_file,omitempty"`
+	KeyFile              string         `json:"key_file,omitempty"`
+	VerifyIncoming       bool           `json:"verify_incoming,omitempty"`
+	VerifyOutgoing       bool           `json:"verify_outgoing,omitempty"`
+	VerifyServerHostname bool           `json:"verify_server_hostname,omitempty"`
 }
 
-func (c *Upgrade) run(versions []string) error {
+func (c *Upgrade) run(cfg *upgradeConfig, versions []string, rep *report) (err error) {
 	var dir string
-	var err error
 	dir, err = ioutil.TempDir("", "consul")
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(dir)
+	defer func() {
+		if err != nil {
+			log.Printf("Preserving data dir %q", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+
+	logDir := cfg.LogDir
+	if logDir == "" {
+		logDir = dir
+	}
+	logPath := filepath.Join(logDir, "consul.log")
 
-	from := path.Join(dir, "consul")
-	for i, version := range versions {
-		if err := getter.GetAny(dir, version); err != nil {
+	// The agent's data dir is kept apart from everything else so it can be
+	// swapped out when trying rollbacks.
+	dataDir := filepath.Join(dir, "data")
+
+	// With TLS the agent only serves HTTPS, using a certificate from a
+	// throwaway CA that our clients present as well.
+	httpAddr := "127.0.0.1:8500"
+	var cert *live.Cert
+	if cfg.TLS {
+		ca, err := live.NewCA(filepath.Join(dir, "tls"))
+		if err != nil {
 			return err
 		}
-		to := path.Join(dir, fmt.Sprintf("version-%d", i))
-		if err := os.Rename(from, to); err != nil {
+		cert, err = ca.Issue("server.dc1.consul", "localhost", "127.0.0.1")
+		if err != nil {
 			return err
 		}
-		versions[i] = to
+		httpAddr = "127.0.0.1:8501"
+	}
+
+	newConsul := func(executable string, args []string) (*live.Consul, error) {
+		consul, err := live.NewConsul(executable, args)
+		if err != nil {
+			return nil, err
+		}
+		consul.Name = "consul"
+		consul.LogPath = logPath
+		consul.Tee = cfg.TeeLogs
+		consul.HTTPAddr = httpAddr
+		consul.Token = "root"
+		if cert != nil {
+			consul.TLS = cert.TLSConfig()
+		}
+		consul.Client, err = api.NewClient(consul.APIConfig())
+		if err != nil {
+			return nil, err
+		}
+		return consul, nil
+	}
+
+	sources := versions
+	rep.begin("fetch versions")
+	cache := &binaryCache{Dir: cfg.CacheDir}
+	versions, err = cache.resolve(versions)
+	if err != nil {
+		return err
 	}
 
 	base := versions[0]
@@ -92,17 +239,31 @@ func (c *Upgrade) run(versions []string) error {
 		return err
 	}
 
-	content, err := json.Marshal(ServerConfig{
+	serverConfig := ServerConfig{
 		Server:           true,
 		Bootstrap:        true,
 		Bind:             "127.0.0.1",
-		DataDir:          dir,
+		DataDir:          dataDir,
 		Datacenter:       "dc1",
 		ACLMasterToken:   "root",
 		ACLDatacenter:    "dc1",
 		ACLDefaultPolicy: "allow",
 		RaftProtocol:     3,
-	})
+	}
+	if cfg.ACLDeny {
+		serverConfig.ACLDefaultPolicy = "deny"
+		serverConfig.ACLAgentToken = "root"
+	}
+	if cert != nil {
+		serverConfig.Ports = map[string]int{"http": -1, "https": 8501}
+		serverConfig.CAFile = cert.CAFile
+		serverConfig.CertFile = cert.CertFile
+		serverConfig.KeyFile = cert.KeyFile
+		serverConfig.VerifyIncoming = true
+		serverConfig.VerifyOutgoing = true
+		serverConfig.VerifyServerHostname = true
+	}
+	content, err := json.Marshal(serverConfig)
 	if err != nil {
 		return err
 	}
@@ -119,19 +280,22 @@ func (c *Upgrade) run(versions []string) error {
 	}
 
 	// Start the first version of Consul, which is our base.
+	rep.begin(fmt.Sprintf("start base %s", sources[0]))
 	log.Printf("Starting base Consul from '%s'...\n", base)
 	args := []string{
 		"agent",
 		"-config-file",
 		target,
 	}
-	consul, err := live.NewConsul(base, args)
+	consul, err := newConsul(base, args)
 	if err != nil {
 		return err
 	}
 	if err := consul.Start(); err != nil {
 		return err
 	}
+	log.Printf("Agent logs are in %q", logPath)
+	rep.logDir(logDir)
 	defer func() {
 		if err := consul.Shutdown(); err != nil {
 			log.Println(err)
@@ -139,17 +303,14 @@ func (c *Upgrade) run(versions []string) error {
 	}()
 
 	// Wait for it to start up and elect itself.
-	if err := consul.WaitForLeader(); err != nil {
+	if err := waitForLeader(consul); err != nil {
 		return err
 	}
 
 	// Populate it with some realistic data, enough to kick out a snapshot.
+	rep.begin("populate base")
 	log.Println("Populating with initial state store data...")
-	client, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
-		return err
-	}
-	fuzz, err := live.NewFuzz(client)
+	fuzz, err := live.NewFuzz(consul.Client, cfg.Seed)
 	if err != nil {
 		return err
 	}
@@ -158,7 +319,7 @@ func (c *Upgrade) run(versions []string) error {
 			return err
 		}
 
-		entries, err := ioutil.ReadDir(dir + "/raft/snapshots/")
+		entries, err := ioutil.ReadDir(filepath.Join(dataDir, "raft", "snapshots"))
 		if err != nil {
 			return err
 		}
@@ -176,15 +337,32 @@ func (c *Upgrade) run(versions []string) error {
 		return err
 	}
 
-	// Now shutdown the base version and try upgrading through the given
-	// versions.
-	if err := consul.Shutdown(); err != nil {
-		return err
-	}
-	for _, version := range versions {
+	// Now try upgrading through the given versions, stopping the previous
+	// version before starting the next one on the same data dir.
+	previous, previousExecutable, previousSource := consul, base, sources[0]
+	var rollbacks []string
+	for i, version := range versions {
+		source := sources[i+1]
+
+		// Save a snapshot on the old version before it's upgraded, which
+		// is the first step of the usual rollback runbook.
+		var snapshot string
+		if cfg.Rollback == rollbackSnapshot {
+			rep.begin(fmt.Sprintf("snapshot %s", previousSource))
+			snapshot = filepath.Join(dir, fmt.Sprintf("snapshot-%d", i))
+			if err := saveSnapshot(previous.Client, snapshot); err != nil {
+				return err
+			}
+		}
+		if err := previous.Shutdown(); err != nil {
+			return err
+		}
+
+		rep.begin(fmt.Sprintf("upgrade to %s", source))
+
 		// Start the upgraded version with the same data-dir.
 		log.Printf("Upgrading to Consul from '%s'...\n", version)
-		upgrade, err := live.NewConsul(version, args)
+		upgrade, err := newConsul(version, args)
 		if err != nil {
 			return err
 		}
@@ -198,7 +376,7 @@ func (c *Upgrade) run(versions []string) error {
 		}()
 
 		// Wait for it to start up and elect itself.
-		if err := upgrade.WaitForLeader(); err != nil {
+		if err := waitForLeader(upgrade); err != nil {
 			return err
 		}
 
@@ -207,6 +385,45 @@ func (c *Upgrade) run(versions []string) error {
 			return err
 		}
 
+		// The snapshot only has the data from before the upgrade, so
+		// restoring it is tried before anything new gets written.
+		rollback := func(mode string, prepare func(*live.Consul) error) error {
+			name := fmt.Sprintf("rollback %s to %s (%s)", source, previousSource, mode)
+			rep.begin(name)
+			if err := upgrade.Shutdown(); err != nil {
+				return err
+			}
+			rbErr, err := tryRollback(dataDir, mode, func() (*live.Consul, error) {
+				return newConsul(previousExecutable, args)
+			}, prepare, fuzz)
+			if err != nil {
+				return err
+			}
+			rep.endWith(rbErr)
+			if rbErr != nil {
+				log.Printf("Rollback from %s to %s failed: %v", source, previousSource, rbErr)
+				rollbacks = append(rollbacks, fmt.Sprintf("%s: failed: %v", name, rbErr))
+			} else {
+				log.Printf("Rollback from %s to %s passed", source, previousSource)
+				rollbacks = append(rollbacks, fmt.Sprintf("%s: passed", name))
+			}
+
+			// Carry on with the upgraded version and its data.
+			rep.begin(fmt.Sprintf("resume %s", source))
+			if err := upgrade.Start(); err != nil {
+				return err
+			}
+			return waitForLeader(upgrade)
+		}
+		if cfg.Rollback == rollbackSnapshot {
+			restore := func(consul *live.Consul) error {
+				return restoreSnapshot(consul.Client, snapshot)
+			}
+			if err := rollback(rollbackSnapshot, restore); err != nil {
+				return err
+			}
+		}
+
 		// Add some new data for this version of Consul.
 		if err := fuzz.Populate(); err != nil {
 			return err
@@ -215,12 +432,198 @@ func (c *Upgrade) run(versions []string) error {
 			return err
 		}
 
-		// Shut it down in anticipation of the next upgrade.
-		if err := upgrade.Shutdown(); err != nil {
-			return err
+		// See if the old version can start up on the data dir as the new
+		// version left it.
+		if cfg.Rollback == rollbackData {
+			if err := rollback(rollbackData, nil); err != nil {
+				return err
+			}
 		}
+
+		previous, previousExecutable, previousSource = upgrade, version, source
+	}
+	if err := previous.Shutdown(); err != nil {
+		return err
 	}
 
+	if len(rollbacks) > 0 {
+		log.Println("Rollback results:")
+		for _, result := range rollbacks {
+			log.Printf("  %s", result)
+		}
+	}
+
+	rep.end()
 	log.Println("Upgrade series complete")
 	return nil
 }
+
+func (c *Upgrade) runRolling(cfg *upgradeConfig, versions []string, rep *report) (err error) {
+	sources := versions
+	rep.begin("fetch versions")
+	cache := &binaryCache{Dir: cfg.CacheDir}
+	versions, err = cache.resolve(versions)
+	if err != nil {
+		return err
+	}
+
+	base := versions[0]
+	versions = versions[1:]
+
+	// Start a cluster of servers on the base version.
+	servers := cfg.Servers
+	rep.begin(fmt.Sprintf("start base %s", sources[0]))
+	log.Printf("Starting %d server cluster from '%s'...\n", servers, base)
+	serverArgs := []string{"-hcl", "raft_protocol=3"}
+	if !cfg.ACLDeny {
+		serverArgs = append(serverArgs, []string{
+			"-hcl", `acl_datacenter="dc1"`,
+			"-hcl", `acl_master_token="root"`,
+			"-hcl", `acl_default_policy="allow"`,
+		}...)
+	}
+	cluster, err := live.NewCluster(&live.ClusterConfig{
+		Executable: base,
+		Servers:    servers,
+		LogDir:     cfg.LogDir,
+		TeeLogs:    cfg.TeeLogs,
+		ServerArgs: serverArgs,
+		TLS:        cfg.TLS,
+		ACLs:       cfg.ACLDeny,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cluster.Preserve = err != nil
+		if err := cluster.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	log.Printf("Agent logs are in %q", cluster.LogDir)
+	rep.logDir(cluster.LogDir)
+	if err := waitForStable(cluster); err != nil {
+		return err
+	}
+	if err := waitForHealthy(cluster.Client, servers); err != nil {
+		return err
+	}
+
+	// Set an Autopilot configuration that lets replaced servers become
+	// healthy voters quickly.
+	operator := cluster.Client.Operator()
+	ap, err := operator.AutopilotGetConfiguration(nil)
+	if err != nil {
+		return err
+	}
+	ap.ServerStabilizationTime = api.NewReadableDuration(1 * time.Second)
+	if ok, err := operator.AutopilotCASConfiguration(ap, nil); !ok || err != nil {
+		return fmt.Errorf("failed to update Autopilot configuration: %v", err)
+	}
+
+	// Populate it with some realistic data, enough to kick out a snapshot.
+	rep.begin("populate base")
+	log.Println("Populating with initial state store data...")
+	fuzz, err := live.NewFuzz(cluster.Client, cfg.Seed)
+	if err != nil {
+		return err
+	}
+	if cluster.Token != "" {
+		fuzz.Token = cluster.Token
+	}
+	for {
+		if err := fuzz.Populate(); err != nil {
+			return err
+		}
+
+		snapshots, err := filepath.Glob(cluster.DataDir + "/*/raft/snapshots/*")
+		if err != nil {
+			return err
+		}
+		if len(snapshots) > 0 {
+			break
+		}
+	}
+
+	// Push some data in post-snapshot to make sure there's some stuff
+	// in the Raft log as well.
+	if err := fuzz.Populate(); err != nil {
+		return err
+	}
+	if err := fuzz.Verify(); err != nil {
+		return err
+	}
+
+	// Now replace the servers one at a time with each of the given
+	// versions, making sure the cluster recovers after each step.
+	for v, version := range versions {
+		for i := range cluster.Agents {
+			rep.begin(fmt.Sprintf("upgrade server %d to %s", i, sources[v+1]))
+			log.Printf("Upgrading server %d to Consul from '%s'...\n", i, version)
+			if err := cluster.Upgrade(i, version); err != nil {
+				return err
+			}
+			if err := waitForHealthy(cluster.Client, servers); err != nil {
+				return err
+			}
+
+			// Make sure the data is still present.
+			if err := fuzz.Verify(); err != nil {
+				return err
+			}
+
+			// Add some new data for this mix of versions.
+			if err := fuzz.Populate(); err != nil {
+				return err
+			}
+			if err := fuzz.Verify(); err != nil {
+				return err
+			}
+		}
+	}
+
+	rep.end()
+	log.Println("Rolling upgrade series complete")
+	return nil
+}
+
+// waitForHealthy waits until Autopilot reports that the expected number of
+// servers are all healthy and the same leader has been seen on consecutive
+// checks.
+func waitForHealthy(client *api.Client, servers int) error {
+	const timeout = 2 * time.Minute
+
+	var lastLeader string
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+
+		sh, err := client.Operator().AutopilotServerHealth(nil)
+		if err != nil {
+			log.Printf("Could not get cluster health (will retry): %v", err)
+			continue
+		}
+		if !sh.Healthy || len(sh.Servers) != servers {
+			log.Printf("Cluster isn't healthy yet (will retry)")
+			lastLeader = ""
+			continue
+		}
+
+		var leader string
+		for _, server := range sh.Servers {
+			if server.Leader {
+				leader = server.ID
+				break
+			}
+		}
+		if leader == "" || leader != lastLeader {
+			lastLeader = leader
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("cluster did not become healthy after %s", timeout)
+}
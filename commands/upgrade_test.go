@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul-live/live"
+)
+
+func TestUpgrade_Single(t *testing.T) {
+	exe := fakeConsul(t)
+	cfg := &upgradeConfig{
+		Seed:     1,
+		CacheDir: t.TempDir(),
+	}
+	rep := newReport("upgrade")
+	if err := (&Upgrade{}).run(cfg, []string{exe, exe, exe}, rep); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkStepsPassed(t, rep)
+}
+
+func TestUpgrade_Rolling(t *testing.T) {
+	exe := fakeConsul(t)
+	cfg := &upgradeConfig{
+		Rolling:  true,
+		Servers:  3,
+		Seed:     1,
+		CacheDir: t.TempDir(),
+	}
+	rep := newReport("upgrade")
+	if err := (&Upgrade{}).runRolling(cfg, []string{exe, exe}, rep); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkStepsPassed(t, rep)
+}
+
+func TestUpgrade_Rollback(t *testing.T) {
+	for _, mode := range []string{rollbackData, rollbackSnapshot} {
+		t.Run(mode, func(t *testing.T) {
+			exe := fakeConsul(t)
+			cfg := &upgradeConfig{
+				Seed:     1,
+				CacheDir: t.TempDir(),
+				Rollback: mode,
+			}
+			rep := newReport("upgrade")
+			if err := (&Upgrade{}).run(cfg, []string{exe, exe, exe}, rep); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			checkStepsPassed(t, rep)
+
+			// There's a rollback after each upgrade, and the upgraded
+			// version carries on with its own data dir afterwards.
+			var rollbacks, resumes int
+			for _, step := range rep.Steps {
+				if strings.HasPrefix(step.Name, "rollback ") && strings.HasSuffix(step.Name, "("+mode+")") {
+					rollbacks++
+				}
+				if strings.HasPrefix(step.Name, "resume ") {
+					resumes++
+				}
+			}
+			if rollbacks != 2 || resumes != 2 {
+				t.Fatalf("bad: %d rollbacks and %d resumes in %v", rollbacks, resumes, rep.Steps)
+			}
+		})
+	}
+}
+
+func TestTryRollback_DataDir(t *testing.T) {
+	cases := []struct {
+		mode string
+		want []string
+	}{
+		{rollbackData, []string{"node-id", "raft/raft.db"}},
+		{rollbackSnapshot, []string{"node-id"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			dataDir := filepath.Join(t.TempDir(), "data")
+			files := map[string]string{
+				"node-id":      "abc",
+				"raft/raft.db": "upgraded",
+			}
+			for name, content := range files {
+				path := filepath.Join(dataDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			}
+
+			// Look at what the previous version would be started on, and
+			// scribble on it the way an agent would, then stop there.
+			stop := errors.New("stop")
+			start := func() (*live.Consul, error) {
+				var got []string
+				err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+					if err != nil || info.IsDir() {
+						return err
+					}
+					rel, err := filepath.Rel(dataDir, path)
+					got = append(got, filepath.ToSlash(rel))
+					return err
+				})
+				if err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+					t.Fatalf("bad: %v", got)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dataDir, "node-id"), []byte("rolled back"), 0644); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				return nil, stop
+			}
+			if _, err := tryRollback(dataDir, tc.mode, start, nil, nil); err != stop {
+				t.Fatalf("bad: %v", err)
+			}
+
+			// The upgraded data dir is back just as it was.
+			for name, content := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dataDir, name))
+				if err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if string(got) != content {
+					t.Fatalf("bad: %s is %q", name, got)
+				}
+			}
+			if _, err := os.Stat(dataDir + ".upgraded"); !os.IsNotExist(err) {
+				t.Fatalf("bad: %v", err)
+			}
+		})
+	}
+}
+
+// checkStepsPassed fails the test if the report has no steps or any of them
+// failed.
+func checkStepsPassed(t *testing.T, rep *report) {
+	rep.end()
+	if len(rep.Steps) == 0 {
+		t.Fatalf("no steps were recorded")
+	}
+	for _, step := range rep.Steps {
+		if !step.Passed {
+			t.Fatalf("step %q failed: %s", step.Name, step.Error)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package commands
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul-live/live"
+)
+
+// startTimeout is how long commands will wait for agents they start to come
+// up and settle down.
+const startTimeout = 2 * time.Minute
+
+func waitForLeader(consul *live.Consul) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	return consul.WaitForLeader(ctx)
+}
+
+func waitForStable(cluster *live.Cluster) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	return cluster.WaitForStable(ctx)
+}
@@ -1,13 +1,26 @@
 package live
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/lib/freeport"
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	// startTimeout is how long we wait for the first agent in a cluster to
+	// come up before starting the rest.
+	startTimeout = 30 * time.Second
+
+	// serfStatusAlive is the member status Serf reports for a live agent.
+	serfStatusAlive = 1
 )
 
 type ClusterConfig struct {
@@ -17,13 +30,58 @@ type ClusterConfig struct {
 	ServerArgs []string
 	Clients    int
 	ClientArgs []string
+
+	// Datacenter is the datacenter the agents join, defaults to "dc1".
+	Datacenter string
+
+	// LogDir is where each agent writes its log file. If this is empty then
+	// the logs go in a "logs" directory under the cluster's data dir.
+	LogDir string
+
+	// TeeLogs also copies each agent's log to stdout, with every line
+	// prefixed by the agent's node name.
+	TeeLogs bool
+
+	// Partitionable routes the agents' Serf and server traffic through
+	// proxies so the cluster's Network can partition them.
+	Partitionable bool
+
+	// Seed drives the random packet loss and jitter on a partitionable
+	// cluster's links, so they can be reproduced.
+	Seed int64
+
+	// TLS generates a CA and certificates for the agents and turns on
+	// verified TLS for RPC and HTTPS. The agents serve HTTPS on their HTTP
+	// port instead of plain HTTP.
+	TLS bool
+
+	// ACLs turns on ACLs with a default deny policy, using a generated
+	// master token which every agent is given as its agent token.
+	ACLs bool
 }
 
 type Cluster struct {
 	DataDir string
+	LogDir  string
 	Agents  []*Consul
 	Client  *api.Client
 	WANJoin string
+
+	// Preserve keeps Shutdown from removing the data dir, which is useful
+	// for looking at the agent logs after a failure.
+	Preserve bool
+
+	// Network is set for partitionable clusters and controls the traffic
+	// between the agents.
+	Network *Network
+
+	// Token is the ACL master token, which is set for clusters with ACLs.
+	// The agents' clients already use it.
+	Token string
+
+	// CA issued the agents' certificates, which is set for clusters with
+	// TLS.
+	CA *CA
 }
 
 func NewCluster(cfg *ClusterConfig) (*Cluster, error) {
@@ -43,109 +101,342 @@ func NewCluster(cfg *ClusterConfig) (*Cluster, error) {
 		}
 	}()
 
-	ports := freeport.Get(5 * n)
-
-	var joinPort int
-	var wanJoin string
-	var client *api.Client
-	baseArgs := func(idx int) []string {
-		dnsPort := ports[5*idx+0]
-		httpPort := ports[5*idx+1]
-		lanPort := ports[5*idx+2]
-		wanPort := ports[5*idx+3]
-		serverPort := ports[5*idx+4]
-
-		// Set the default ports on the first agent for convenience.
-		if idx == 0 {
-			if cfg.NicePorts {
-				dnsPort = 8600
-				httpPort = 8500
-				lanPort = 8301
-				wanPort = 8302
-				serverPort = 8300
-			}
-			joinPort = lanPort
-			wanJoin = fmt.Sprintf("127.0.0.1:%d", wanPort)
+	logDir := cfg.LogDir
+	if logDir == "" {
+		logDir = filepath.Join(dir, "logs")
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
 
-			cc := api.DefaultConfig()
-			cc.Address = fmt.Sprintf("127.0.0.1:%d", httpPort)
-			client, err = api.NewClient(cc)
-			if err != nil {
-				panic(err)
-			}
+	datacenter := cfg.Datacenter
+	if datacenter == "" {
+		datacenter = "dc1"
+	}
+
+	var token string
+	if cfg.ACLs {
+		if token, err = uuid.GenerateUUID(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Servers get certificates they can be verified with, and everything
+	// else, including our clients, shares a client certificate.
+	var ca *CA
+	var serverCert, clientCert *Cert
+	if cfg.TLS {
+		if ca, err = NewCA(filepath.Join(dir, "tls")); err != nil {
+			return nil, err
+		}
+		serverCert, err = ca.Issue(fmt.Sprintf("server.%s.consul", datacenter), "localhost", "127.0.0.1")
+		if err != nil {
+			return nil, err
+		}
+		clientCert, err = ca.Issue(fmt.Sprintf("client.%s.consul", datacenter), "localhost", "127.0.0.1")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	free := freeport.Get(5 * n)
+	ports := make([]Ports, n)
+	for i := range ports {
+		ports[i] = Ports{
+			DNS:     free[5*i+0],
+			HTTP:    free[5*i+1],
+			SerfLAN: free[5*i+2],
+			SerfWAN: free[5*i+3],
+			Server:  free[5*i+4],
+		}
+	}
+
+	// Set the default ports on the first agent for convenience.
+	if cfg.NicePorts {
+		ports[0] = Ports{
+			DNS:     8600,
+			HTTP:    8500,
+			SerfLAN: 8301,
+			SerfWAN: 8302,
+			Server:  8300,
+		}
+	}
+
+	// Partitionable agents bind somewhere else and advertise the addresses
+	// where their proxies listen.
+	bind := []string{"-bind", "127.0.0.1"}
+	if cfg.Partitionable {
+		bind = []string{
+			"-bind", proxyBindAddr,
+			"-advertise", "127.0.0.1",
+			"-advertise-wan", "127.0.0.1",
 		}
+	}
 
-		node := fmt.Sprintf("node-%d", httpPort)
+	newAgent := func(idx int, server bool) (*Consul, error) {
+		p := ports[idx]
+		node := fmt.Sprintf("node-%d", p.HTTP)
+		httpPorts := fmt.Sprintf("http=%d", p.HTTP)
+		if cfg.TLS {
+			httpPorts = fmt.Sprintf("http=-1 https=%d", p.HTTP)
+		}
 		args := []string{
 			"agent",
 			"-node", node,
+			"-datacenter", datacenter,
 			"-data-dir", fmt.Sprintf("%s/%s", dir, node),
-			"-retry-join", fmt.Sprintf("127.0.0.1:%d", joinPort),
-			"-bind", "127.0.0.1",
+			"-retry-join", fmt.Sprintf("127.0.0.1:%d", ports[0].SerfLAN),
 			"-client", "127.0.0.1",
-			"-hcl", fmt.Sprintf("ports={dns=%d http=%d serf_lan=%d serf_wan=%d server=%d}",
-				dnsPort, httpPort, lanPort, wanPort, serverPort),
+			"-hcl", fmt.Sprintf("ports={dns=%d %s serf_lan=%d serf_wan=%d server=%d}",
+				p.DNS, httpPorts, p.SerfLAN, p.SerfWAN, p.Server),
 			"-hcl", "enable_debug=true",
 		}
-		return args
-	}
+		args = append(args, bind...)
+		if cfg.ACLs {
+			args = append(args, []string{
+				"-hcl", fmt.Sprintf("acl_datacenter=%q", datacenter),
+				"-hcl", `acl_default_policy="deny"`,
+				"-hcl", fmt.Sprintf("acl_agent_token=%q", token),
+			}...)
+			if server {
+				args = append(args, "-hcl", fmt.Sprintf("acl_master_token=%q", token))
+			}
+		}
+		if cfg.TLS {
+			cert := clientCert
+			if server {
+				cert = serverCert
+			}
+			args = append(args, cert.Args()...)
+		}
+		if server {
+			args = append(args, []string{
+				"-server",
+				fmt.Sprintf("-bootstrap-expect=%d", cfg.Servers),
+				"-hcl", "performance={raft_multiplier=1}",
+			}...)
+			args = append(args, cfg.ServerArgs...)
+		} else {
+			args = append(args, cfg.ClientArgs...)
+		}
 
-	var agents []*Consul
-	for i := 0; i < cfg.Servers; i++ {
-		args := append(baseArgs(i), []string{
-			"-server",
-			fmt.Sprintf("-bootstrap-expect=%d", cfg.Servers),
-			"-hcl", "performance={raft_multiplier=1}",
-		}...)
-		args = append(args, cfg.ServerArgs...)
 		consul, err := NewConsul(cfg.Executable, args)
 		if err != nil {
 			return nil, err
 		}
-		agents = append(agents, consul)
+		consul.Name = node
+		consul.Server = server
+		consul.Datacenter = datacenter
+		consul.Ports = p
+		consul.HTTPAddr = fmt.Sprintf("127.0.0.1:%d", p.HTTP)
+		consul.LogPath = filepath.Join(logDir, node+".log")
+		consul.Tee = cfg.TeeLogs
+		consul.Token = token
+		if cfg.TLS {
+			consul.TLS = clientCert.TLSConfig()
+		}
+
+		consul.Client, err = api.NewClient(consul.APIConfig())
+		if err != nil {
+			return nil, err
+		}
+		return consul, nil
 	}
-	for i := 0; i < cfg.Clients; i++ {
-		args := append(baseArgs(cfg.Servers+i), cfg.ClientArgs...)
-		consul, err := NewConsul(cfg.Executable, args)
+
+	var agents []*Consul
+	for i := 0; i < n; i++ {
+		consul, err := newAgent(i, i < cfg.Servers)
 		if err != nil {
 			return nil, err
 		}
 		agents = append(agents, consul)
 	}
 
-	disarm = true
-	return &Cluster{
+	cluster := &Cluster{
 		DataDir: dir,
+		LogDir:  logDir,
 		Agents:  agents,
-		Client:  client,
-		WANJoin: wanJoin,
-	}, nil
+		Client:  agents[0].Client,
+		WANJoin: fmt.Sprintf("127.0.0.1:%d", ports[0].SerfWAN),
+		Token:   token,
+		CA:      ca,
+	}
+	if cfg.Partitionable {
+		cluster.Network = newNetwork(agents, cfg.Seed)
+	}
+
+	disarm = true
+	return cluster, nil
 }
 
 func (c *Cluster) Start() error {
+	if c.Network != nil {
+		if err := c.Network.start(); err != nil {
+			return err
+		}
+	}
+
 	for i, consul := range c.Agents {
 		if err := consul.Start(); err != nil {
 			return err
 		}
 
-		// Sleep a bit so the later agents will have something to join
-		// to without a backoff.
+		// Wait for the first agent to come up so the later agents will
+		// have something to join to without a backoff.
 		if i == 0 {
-			time.Sleep(3 * time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+			err := consul.WaitForReady(ctx)
+			cancel()
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// WaitForStable waits until every agent is ready, all of them are alive LAN
+// members, and all of the servers are voters in the Raft configuration with
+// a known leader.
+func (c *Cluster) WaitForStable(ctx context.Context) error {
+	for _, consul := range c.Agents {
+		if err := consul.WaitForReady(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Every agent answered above, so any of them can observe the rest.
+	observer := c.Agents[0]
+	return observer.poll(ctx, "stable cluster", func(client *api.Client, q *api.QueryOptions) bool {
+		var members []*api.AgentMember
+		if _, err := client.Raw().Query("/v1/agent/members", &members, q); err != nil {
+			return false
+		}
+		var alive int
+		for _, member := range members {
+			if member.Status == serfStatusAlive {
+				alive++
+			}
+		}
+		if alive < len(c.Agents) {
+			return false
+		}
+
+		raft, err := client.Operator().RaftGetConfiguration(q)
+		if err != nil {
+			return false
+		}
+		var voters int
+		var leader bool
+		for _, server := range raft.Servers {
+			if server.Voter {
+				voters++
+			}
+			if server.Leader {
+				leader = true
+			}
+		}
+		return leader && voters == len(c.Servers())
+	})
+}
+
 func (c *Cluster) Shutdown() error {
 	for _, consul := range c.Agents {
 		if err := consul.Shutdown(); err != nil {
 			return err
 		}
 	}
+	if c.Network != nil {
+		c.Network.close()
+	}
+
+	if c.Preserve {
+		log.Printf("Preserving data dir %q, agent logs are in %q", c.DataDir, c.LogDir)
+		return nil
+	}
 
 	if err := os.RemoveAll(c.DataDir); err != nil {
 		return err
 	}
 	return nil
 }
+
+// Upgrade gracefully stops the agent at the given index and starts it back up
+// using the given executable, keeping the same arguments and data dir.
+func (c *Cluster) Upgrade(idx int, executable string) error {
+	if idx < 0 || idx >= len(c.Agents) {
+		return fmt.Errorf("agent index %d out of range", idx)
+	}
+
+	consul := c.Agents[idx]
+	if err := consul.Stop(os.Interrupt, 30*time.Second); err != nil {
+		return err
+	}
+	consul.Executable = executable
+	return consul.Start()
+}
+
+// Servers returns the agents running in server mode.
+func (c *Cluster) Servers() []*Consul {
+	var servers []*Consul
+	for _, consul := range c.Agents {
+		if consul.Server {
+			servers = append(servers, consul)
+		}
+	}
+	return servers
+}
+
+// Clients returns the agents running in client mode.
+func (c *Cluster) Clients() []*Consul {
+	var clients []*Consul
+	for _, consul := range c.Agents {
+		if !consul.Server {
+			clients = append(clients, consul)
+		}
+	}
+	return clients
+}
+
+// AgentByNode returns the agent with the given node name, or nil if there's
+// no such agent in the cluster.
+func (c *Cluster) AgentByNode(node string) *Consul {
+	for _, consul := range c.Agents {
+		if consul.Name == node {
+			return consul
+		}
+	}
+	return nil
+}
+
+// Leader asks the running agents who the current leader is and returns the
+// matching server. Paused agents are skipped since they'd never answer.
+func (c *Cluster) Leader() (*Consul, error) {
+	var lastErr error
+	for _, consul := range c.Agents {
+		if !consul.Running() || consul.Paused() {
+			continue
+		}
+
+		addr, err := consul.Client.Status().Leader()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("cluster doesn't have a leader")
+		}
+
+		for _, server := range c.Servers() {
+			if addr == fmt.Sprintf("127.0.0.1:%d", server.Ports.Server) {
+				return server, nil
+			}
+		}
+		return nil, fmt.Errorf("leader %q isn't part of the cluster", addr)
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no agents are running and unpaused")
+}
@@ -0,0 +1,154 @@
+package live
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCluster_StartAndLeader(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 3, Clients: 2})
+
+	if got := len(cluster.Servers()); got != 3 {
+		t.Fatalf("bad: %d servers", got)
+	}
+	if got := len(cluster.Clients()); got != 2 {
+		t.Fatalf("bad: %d clients", got)
+	}
+	for _, consul := range cluster.Agents {
+		if !consul.Running() || consul.Pid() == 0 {
+			t.Fatalf("agent %q isn't running", consul.Name)
+		}
+		if cluster.AgentByNode(consul.Name) != consul {
+			t.Fatalf("agent %q not found by node", consul.Name)
+		}
+	}
+
+	leader, err := cluster.Leader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !leader.Server {
+		t.Fatalf("leader %q isn't a server", leader.Name)
+	}
+}
+
+func TestCluster_Failover(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 3})
+
+	old, err := cluster.Leader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := old.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code, ok := old.ExitStatus(); !ok || code != -1 {
+		t.Fatalf("bad: %d %v", code, ok)
+	}
+
+	var leader *Consul
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if leader, err = cluster.Leader(); err == nil && leader != old {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if leader == nil || leader == old {
+		t.Fatalf("no new leader: %v", err)
+	}
+
+	// The old leader should rejoin with its data dir intact.
+	if err := old.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForStable(t, cluster)
+}
+
+func TestCluster_Upgrade(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 3})
+
+	for i, consul := range cluster.Agents {
+		pid := consul.Pid()
+		if err := cluster.Upgrade(i, consul.Executable); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if code, ok := consul.ExitStatus(); ok {
+			t.Fatalf("agent %q exited with %d", consul.Name, code)
+		}
+		if consul.Pid() == pid {
+			t.Fatalf("agent %q wasn't restarted", consul.Name)
+		}
+		waitForStable(t, cluster)
+	}
+
+	if err := cluster.Upgrade(len(cluster.Agents), "consul"); err == nil {
+		t.Fatalf("should have failed")
+	}
+}
+
+func TestCluster_Shutdown(t *testing.T) {
+	cluster, err := NewCluster(&ClusterConfig{Executable: fakeConsul(t), Servers: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForStable(t, cluster)
+
+	if err := cluster.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cluster.Agents[0].Running() {
+		t.Fatalf("agent still running")
+	}
+	if _, err := os.Stat(cluster.DataDir); !os.IsNotExist(err) {
+		t.Fatalf("data dir wasn't removed: %v", err)
+	}
+}
+
+func TestCluster_PausedAgent(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 3})
+
+	// Pause the first agent, which would otherwise be the one asked.
+	paused := cluster.Agents[0]
+	if err := paused.Pause(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !paused.Paused() {
+		t.Fatalf("agent should be paused")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cluster.Leader()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("leader lookup hung")
+	}
+
+	// The paused agent never answers, so this has to give up at the
+	// deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := cluster.WaitForStable(ctx); err == nil {
+		t.Fatalf("should have failed")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Fatalf("took too long to give up: %s", elapsed)
+	}
+
+	if err := paused.Resume(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForStable(t, cluster)
+}
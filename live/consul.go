@@ -1,66 +1,331 @@
 package live
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
+// pollInterval is how often we check on an agent when waiting for it to
+// reach some state.
+const pollInterval = 250 * time.Millisecond
+
+// Ports holds the ports an agent listens on.
+type Ports struct {
+	DNS     int
+	HTTP    int
+	SerfLAN int
+	SerfWAN int
+	Server  int
+}
+
 type Consul struct {
-	Command *exec.Cmd
+	// Name is the agent's node name.
+	Name       string
+	Server     bool
+	Datacenter string
+	Ports      Ports
+	HTTPAddr   string
+	Client     *api.Client
+
+	// Token and TLS are what API clients need to talk to the agent when
+	// ACLs or TLS are turned on. TLS is nil for plain HTTP.
+	Token string
+	TLS   *api.TLSConfig
+
+	Executable string
+	Args       []string
+	LogPath    string
+	Tee        bool
+	Command    *exec.Cmd
+
+	logFile *os.File
+
+	// paused is set while the agent is frozen with SIGSTOP.
+	paused bool
+
+	// done is closed once the running command exits, after which state
+	// holds the final status of the process.
+	done  chan struct{}
+	state *os.ProcessState
+
+	// pid is the running process's ID, or 0. It has its own lock since a
+	// Network's proxies look it up from their goroutines while the agent is
+	// being started and stopped.
+	pidLock sync.Mutex
+	pid     int
 }
 
 func NewConsul(executable string, args []string) (*Consul, error) {
-	c := &Consul{}
-	c.Command = exec.Command(executable, args...)
-	c.Command.Stdout = os.Stdout
-	c.Command.Stderr = os.Stderr
+	cfg := api.DefaultConfig()
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Consul{
+		HTTPAddr:   cfg.Address,
+		Client:     client,
+		Executable: executable,
+		Args:       args,
+	}
+	c.Command = c.newCommand()
 	return c, nil
 }
 
+// APIConfig returns the configuration for a new API client that talks to
+// the agent, using its token and TLS settings.
+func (c *Consul) APIConfig() *api.Config {
+	cfg := api.DefaultConfig()
+	cfg.Address = c.HTTPAddr
+	if c.Token != "" {
+		cfg.Token = c.Token
+	}
+	if c.TLS != nil {
+		cfg.Scheme = "https"
+		cfg.TLSConfig = *c.TLS
+	}
+	return cfg
+}
+
+func (c *Consul) newCommand() *exec.Cmd {
+	cmd := exec.Command(c.Executable, c.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Start runs the agent. An agent that has been stopped can be started again,
+// in which case it picks up with the same arguments and data dir.
 func (c *Consul) Start() error {
+	if c.Running() {
+		return fmt.Errorf("agent is already running")
+	}
+	if c.Command == nil || c.Command.Process != nil {
+		c.Command = c.newCommand()
+	}
+
+	if c.LogPath != "" {
+		f, err := os.OpenFile(c.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		c.logFile = f
+
+		var out io.Writer = f
+		if c.Tee {
+			out = io.MultiWriter(f, newPrefixWriter(os.Stdout, c.Name))
+		}
+		c.Command.Stdout = out
+		c.Command.Stderr = out
+	}
+
 	if err := c.Command.Start(); err != nil {
+		c.closeLog()
 		return err
 	}
+
+	c.state = nil
+	c.paused = false
+	c.done = make(chan struct{})
+	c.setPid(c.Command.Process.Pid)
+	go c.wait(c.Command, c.done)
 	return nil
 }
 
-func (c *Consul) Shutdown() error {
-	if c.Command == nil {
+// wait reaps the given command and records how it exited. We wait on the
+// command rather than the process so any output still being copied to the
+// log makes it there before we close it.
+func (c *Consul) wait(cmd *exec.Cmd, done chan struct{}) {
+	cmd.Wait()
+	c.setPid(0)
+	c.state = cmd.ProcessState
+	c.closeLog()
+	close(done)
+}
+
+// Running returns true if the agent has been started and hasn't exited yet.
+func (c *Consul) Running() bool {
+	if c.done == nil {
+		return false
+	}
+
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Pid returns the process ID of the agent, or 0 if it's not running. This is
+// safe to call from any goroutine.
+func (c *Consul) Pid() int {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	return c.pid
+}
+
+func (c *Consul) setPid(pid int) {
+	c.pidLock.Lock()
+	defer c.pidLock.Unlock()
+	c.pid = pid
+}
+
+// ExitStatus returns the exit code from the last time the agent ran. This
+// returns false if the agent is running or was never started. The code will
+// be -1 if the agent was terminated by a signal.
+func (c *Consul) ExitStatus() (int, bool) {
+	if c.done == nil || c.Running() {
+		return 0, false
+	}
+	return c.state.ExitCode(), true
+}
+
+// Stop sends the given signal to the agent and waits up to the timeout for it
+// to exit, killing it if it's still running after that.
+func (c *Consul) Stop(sig os.Signal, timeout time.Duration) error {
+	if !c.Running() {
 		return nil
 	}
 
+	// A paused agent can't handle the signal until it's resumed.
+	if err := c.Resume(); err != nil {
+		return err
+	}
+	if err := c.Command.Process.Signal(sig); err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(timeout):
+	}
+
 	if err := c.Command.Process.Kill(); err != nil {
 		return err
 	}
+	<-c.done
+	return fmt.Errorf("agent didn't exit within %s after %v, killed it", timeout, sig)
+}
+
+// Signal sends the given signal to the running agent.
+func (c *Consul) Signal(sig os.Signal) error {
+	if !c.Running() {
+		return fmt.Errorf("agent %q isn't running", c.Name)
+	}
+	return c.Command.Process.Signal(sig)
+}
 
-	if _, err := c.Command.Process.Wait(); err != nil {
+// Pause freezes the agent with SIGSTOP, which looks a lot like a very long
+// garbage collection pause to the rest of the cluster. This isn't supported
+// on platforms without SIGSTOP, such as Windows.
+func (c *Consul) Pause() error {
+	if !c.Running() {
+		return fmt.Errorf("agent %q isn't running", c.Name)
+	}
+	if err := pauseProcess(c.Command.Process); err != nil {
 		return err
 	}
+	c.paused = true
+	return nil
+}
 
-	c.Command = nil
+// Resume unfreezes an agent that was paused. This does nothing if the agent
+// isn't paused.
+func (c *Consul) Resume() error {
+	if !c.paused {
+		return nil
+	}
+	if !c.Running() {
+		return fmt.Errorf("agent %q isn't running", c.Name)
+	}
+	if err := resumeProcess(c.Command.Process); err != nil {
+		return err
+	}
+	c.paused = false
 	return nil
 }
 
-func (c *Consul) WaitForLeader() error {
-	client, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
+// Paused returns true if the agent is running but frozen by Pause.
+func (c *Consul) Paused() bool {
+	return c.paused && c.Running()
+}
+
+// Restart gracefully stops the agent with an interrupt, waiting up to the
+// timeout, and then starts it again with the same arguments and data dir.
+func (c *Consul) Restart(timeout time.Duration) error {
+	if err := c.Stop(os.Interrupt, timeout); err != nil {
 		return err
 	}
+	return c.Start()
+}
+
+// Shutdown kills the agent immediately.
+func (c *Consul) Shutdown() error {
+	if !c.Running() {
+		return nil
+	}
+
+	if err := c.Command.Process.Kill(); err != nil {
+		return err
+	}
+	<-c.done
+	return nil
+}
 
-	catalog := client.Catalog()
+func (c *Consul) closeLog() {
+	if c.logFile != nil {
+		c.logFile.Close()
+		c.logFile = nil
+	}
+}
+
+// poll calls fn until it returns true, giving up if the context is done or
+// the agent exits. The query options given to fn carry the context, so a hung
+// agent can't hold up a request past the deadline.
+func (c *Consul) poll(ctx context.Context, what string, fn func(*api.Client, *api.QueryOptions) bool) error {
 	for {
-		_, meta, err := catalog.Nodes(&api.QueryOptions{})
-		if err != nil {
-			goto RETRY
+		if !c.Running() {
+			code, _ := c.ExitStatus()
+			return fmt.Errorf("agent %q exited with status %d while waiting for %s", c.Name, code, what)
 		}
-		if meta.KnownLeader && meta.LastIndex > 0 {
+		if fn(c.Client, (&api.QueryOptions{}).WithContext(ctx)) {
 			return nil
 		}
 
-	RETRY:
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s on agent %q: %v", what, c.Name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
 	}
 }
+
+// WaitForReady waits until the agent's HTTP API is answering requests.
+func (c *Consul) WaitForReady(ctx context.Context) error {
+	return c.poll(ctx, "HTTP API", func(client *api.Client, q *api.QueryOptions) bool {
+		var self map[string]map[string]interface{}
+		_, err := client.Raw().Query("/v1/agent/self", &self, q)
+		return err == nil
+	})
+}
+
+// WaitForLeader waits until the agent knows about a leader and the catalog
+// has been initialized.
+func (c *Consul) WaitForLeader(ctx context.Context) error {
+	return c.poll(ctx, "leader", func(client *api.Client, q *api.QueryOptions) bool {
+		_, meta, err := client.Catalog().Nodes(q)
+		if err != nil {
+			return false
+		}
+		return meta.KnownLeader && meta.LastIndex > 0
+	})
+}
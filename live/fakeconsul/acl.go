@@ -0,0 +1,112 @@
+package fakeconsul
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-uuid"
+)
+
+// setACL creates or updates an ACL token, making up an ID if there isn't
+// one.
+func (s *state) setACL(entry *api.ACLEntry) (string, error) {
+	if entry.Type == "" {
+		entry.Type = api.ACLClientType
+	}
+	if entry.Type != api.ACLClientType && entry.Type != api.ACLManagementType {
+		return "", errorf(http.StatusBadRequest, "Invalid ACL Type")
+	}
+	if entry.ID == "" {
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", err
+		}
+		entry.ID = id
+	}
+
+	idx := s.next()
+	entry.CreateIndex = idx
+	if existing, ok := s.ACLs[entry.ID]; ok {
+		entry.CreateIndex = existing.CreateIndex
+	}
+	entry.ModifyIndex = idx
+	s.ACLs[entry.ID] = entry
+	return entry.ID, nil
+}
+
+func (a *agent) aclEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/acl/")
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	var arg string
+	if len(parts) > 1 {
+		arg = parts[1]
+	}
+
+	// Everything but looking up a single token needs a management token.
+	acl := func(acc access, fn handlerFunc) {
+		a.serve(w, r, acc, func(r *http.Request, st *state) (interface{}, error) {
+			if st.ACL.Datacenter == "" {
+				return nil, errorf(http.StatusUnauthorized, "ACL support disabled")
+			}
+			if parts[0] != "info" && !a.management(r, st) {
+				return nil, errPermissionDenied
+			}
+			return fn(r, st)
+		})
+	}
+
+	switch parts[0] {
+	case "create", "update":
+		acl(accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var entry api.ACLEntry
+			if err := decode(r, &entry); err != nil {
+				return nil, err
+			}
+			if parts[0] == "create" {
+				entry.ID = ""
+			} else if entry.ID == "" {
+				return nil, errorf(http.StatusBadRequest, "ACL ID must be set")
+			}
+			id, err := st.setACL(&entry)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id}, nil
+		})
+
+	case "destroy":
+		acl(accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			if _, ok := st.ACLs[arg]; ok {
+				st.next()
+				delete(st.ACLs, arg)
+			}
+			return true, nil
+		})
+
+	case "info":
+		acl(accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			entries := []*api.ACLEntry{}
+			if entry, ok := st.ACLs[arg]; ok {
+				entries = append(entries, entry)
+			}
+			return entries, nil
+		})
+
+	case "list":
+		acl(accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			entries := []*api.ACLEntry{}
+			for _, entry := range st.ACLs {
+				entries = append(entries, entry)
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+			return entries, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,398 @@
+// Package fakeconsul is a stand-in for the Consul agent that's good enough to
+// run the tools in this repo against without a real Consul executable. It
+// understands the arguments the live package passes to "consul agent" and
+// serves the parts of the HTTP API the tools use.
+//
+// The agents of a fake cluster don't talk to each other. They share a state
+// file next to their data dirs and lock it for every request, so everything
+// is consistent and deterministic. An agent is a live member as long as its
+// process is running and isn't stopped, and the leader is the first live
+// server by name once a quorum of servers is live. Killing, pausing and
+// restarting agents all work the way the tools expect, but network
+// partitions, WAN federation, DNS, session TTLs and ACL rules aren't
+// simulated.
+package fakeconsul
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Version is the version the fake reports for itself.
+const Version = "0.0.0-fake"
+
+// Main runs the fake with the given command line, not including the program
+// name, and returns the exit code.
+func Main(args []string) int {
+	log.SetFlags(log.LstdFlags)
+	log.SetPrefix("")
+
+	if len(args) > 0 && args[0] == "version" {
+		fmt.Printf("Consul v%s\n", Version)
+		return 0
+	}
+	if len(args) == 0 || args[0] != "agent" {
+		fmt.Fprintln(os.Stderr, "usage: consul agent <options>")
+		return 1
+	}
+
+	if err := run(args[1:]); err != nil {
+		log.Printf("[ERR] agent: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// agent is a running fake agent.
+type agent struct {
+	cfg   *config
+	store *store
+
+	// leave is closed when the agent has been asked to leave the cluster.
+	leave     chan struct{}
+	leaveOnce sync.Once
+}
+
+func run(args []string) error {
+	cfg, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return err
+	}
+	if cfg.Server {
+		if err := os.MkdirAll(filepath.Join(cfg.DataDir, "raft", "snapshots"), 0755); err != nil {
+			return err
+		}
+	}
+
+	// Agents that join a cluster share state with the other agents made
+	// alongside them, otherwise the agent keeps its state to itself.
+	path := filepath.Join(cfg.DataDir, stateFile)
+	if cfg.Joined {
+		path = filepath.Join(filepath.Dir(filepath.Clean(cfg.DataDir)), stateFile)
+	}
+	a := &agent{
+		cfg:   cfg,
+		store: &store{path},
+		leave: make(chan struct{}),
+	}
+
+	listeners, err := a.listen()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	srv := &http.Server{Handler: a.routes()}
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+
+	log.Printf("==> Starting fake Consul agent %s...", Version)
+	log.Printf("           Node name: '%s'", cfg.Node)
+	log.Printf("          Datacenter: '%s'", cfg.Datacenter)
+	log.Printf("              Server: %v (bootstrap expect: %d)", cfg.Server, cfg.Expect)
+	log.Printf("         Client Addr: %s (HTTP: %d, HTTPS: %d)", cfg.ClientAddr, cfg.Ports.HTTP, cfg.Ports.HTTPS)
+	log.Printf("          State file: %s", path)
+
+	if err := a.join(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] agent: Joined cluster as %q", cfg.Node)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-sigs:
+		log.Printf("[INFO] agent: Caught signal: %v", sig)
+	case <-a.leave:
+		log.Printf("[INFO] agent: Left the cluster")
+
+		// Give the leave request a moment to get its response back.
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Printf("[INFO] agent: Shutdown complete")
+	return nil
+}
+
+// listen opens the HTTP and HTTPS listeners, skipping any whose port isn't
+// positive the way Consul does. HTTPS needs a certificate, and with
+// verify_incoming clients have to present one signed by the CA.
+func (a *agent) listen() ([]net.Listener, error) {
+	cfg := a.cfg
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	if cfg.Ports.HTTP > 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.ClientAddr, cfg.Ports.HTTP))
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if cfg.Ports.HTTPS > 0 {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return fail(fmt.Errorf("HTTPS requires cert_file and key_file"))
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fail(err)
+		}
+		tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if cfg.VerifyIncoming {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return fail(err)
+			}
+			tc.ClientCAs = x509.NewCertPool()
+			if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+				return fail(fmt.Errorf("no certificates in CA file %q", cfg.CAFile))
+			}
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.ClientAddr, cfg.Ports.HTTPS))
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, tls.NewListener(l, tc))
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no HTTP or HTTPS port is configured")
+	}
+	return listeners, nil
+}
+
+// join adds the agent to the cluster's members, or brings it back if it was
+// there before.
+func (a *agent) join() error {
+	return a.store.update(func(st *state) (bool, error) {
+		st.Members[a.cfg.Node] = &member{
+			Name:       a.cfg.Node,
+			Datacenter: a.cfg.Datacenter,
+			Server:     a.cfg.Server,
+			Ports:      a.cfg.Ports,
+			Pid:        os.Getpid(),
+			DataDir:    a.cfg.DataDir,
+		}
+		if a.cfg.Server {
+			if a.cfg.Expect > st.Expect {
+				st.Expect = a.cfg.Expect
+			}
+			st.ACL = aclConfig{
+				Datacenter:    a.cfg.ACLDatacenter,
+				MasterToken:   a.cfg.ACLMasterToken,
+				DefaultPolicy: a.cfg.ACLDefaultPolicy,
+			}
+		}
+		st.elect()
+		return true, nil
+	})
+}
+
+// agentMember returns the Serf view of a member.
+func agentMember(m *member, wan bool) *api.AgentMember {
+	role := "node"
+	if m.Server {
+		role = "consul"
+	}
+	name, port := m.Name, m.Ports.SerfLAN
+	if wan {
+		name, port = m.Name+"."+m.Datacenter, m.Ports.SerfWAN
+	}
+	return &api.AgentMember{
+		Name:   name,
+		Addr:   "127.0.0.1",
+		Port:   uint16(port),
+		Status: m.status(),
+		Tags: map[string]string{
+			"role":  role,
+			"dc":    m.Datacenter,
+			"port":  fmt.Sprintf("%d", m.Ports.Server),
+			"build": Version,
+		},
+		ProtocolMin: 1,
+		ProtocolMax: 5,
+		ProtocolCur: 2,
+		DelegateMin: 2,
+		DelegateMax: 5,
+		DelegateCur: 4,
+	}
+}
+
+func (a *agent) agentEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/agent/")
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	arg := strings.Join(parts[1:], "/")
+
+	switch parts[0] {
+	case "self":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			self := map[string]interface{}{
+				"Config": map[string]interface{}{
+					"Datacenter": a.cfg.Datacenter,
+					"NodeName":   a.cfg.Node,
+					"Server":     a.cfg.Server,
+					"Version":    Version,
+					"Revision":   "fake",
+				},
+			}
+			if m, ok := st.Members[a.cfg.Node]; ok {
+				self["Member"] = agentMember(m, false)
+			}
+			return self, nil
+		})
+
+	case "members":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			_, wan := r.URL.Query()["wan"]
+			members := []*api.AgentMember{}
+			for _, m := range st.Members {
+				if wan && !m.Server {
+					continue
+				}
+				members = append(members, agentMember(m, wan))
+			}
+			return members, nil
+		})
+
+	case "join":
+		// WAN joins aren't simulated, and everyone in a fake cluster has
+		// already joined.
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			return nil, nil
+		})
+
+	case "leave":
+		a.serve(w, r, accessMember, func(r *http.Request, st *state) (interface{}, error) {
+			if m, ok := st.Members[a.cfg.Node]; ok {
+				m.Left = true
+				st.elect()
+			}
+			return nil, nil
+		})
+		a.leaveOnce.Do(func() { close(a.leave) })
+
+	case "force-leave":
+		a.serve(w, r, accessMember, func(r *http.Request, st *state) (interface{}, error) {
+			if m, ok := st.Members[arg]; ok && !m.alive() {
+				m.Left = true
+				st.elect()
+			}
+			return nil, nil
+		})
+
+	case "metrics":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			return &api.MetricsInfo{
+				Timestamp: time.Now().UTC().Format("2006-01-02 15:04:05 -0700 MST"),
+				Gauges: []api.GaugeValue{
+					{Name: "consul.fake.index", Value: float32(st.Index)},
+				},
+			}, nil
+		})
+
+	case "services":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			services := make(map[string]*api.AgentService)
+			if n, ok := st.Nodes[a.cfg.Node]; ok {
+				services = n.Services
+			}
+			return services, nil
+		})
+
+	case "checks":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			checks := make(map[string]*api.HealthCheck)
+			if n, ok := st.Nodes[a.cfg.Node]; ok {
+				checks = n.Checks
+			}
+			return checks, nil
+		})
+
+	case "service":
+		a.agentServiceEndpoint(w, r, parts)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// agentServiceEndpoint registers and deregisters services on the agent's own
+// node. Checks given with a service are ignored.
+func (a *agent) agentServiceEndpoint(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 2 && parts[1] == "register":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var reg api.AgentServiceRegistration
+			if err := decode(r, &reg); err != nil {
+				return nil, err
+			}
+			if reg.Name == "" {
+				return nil, errorf(http.StatusBadRequest, "Missing service name")
+			}
+			n, ok := st.Nodes[a.cfg.Node]
+			if !ok {
+				return nil, errorf(http.StatusInternalServerError, "Agent isn't registered in the catalog yet")
+			}
+			st.register(&api.CatalogRegistration{
+				Node:            a.cfg.Node,
+				Address:         n.Node.Address,
+				TaggedAddresses: n.Node.TaggedAddresses,
+				NodeMeta:        n.Node.Meta,
+				Service: &api.AgentService{
+					ID:                reg.ID,
+					Service:           reg.Name,
+					Tags:              reg.Tags,
+					Port:              reg.Port,
+					Address:           reg.Address,
+					EnableTagOverride: reg.EnableTagOverride,
+				},
+			})
+			return nil, nil
+		})
+
+	case len(parts) == 3 && parts[1] == "deregister":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			st.deregister(&api.CatalogDeregistration{
+				Node:      a.cfg.Node,
+				ServiceID: parts[2],
+			})
+			return nil, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
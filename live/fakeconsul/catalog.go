@@ -0,0 +1,392 @@
+package fakeconsul
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// register applies a catalog registration, which has already been checked.
+func (s *state) register(reg *api.CatalogRegistration) {
+	idx := s.next()
+
+	n, ok := s.Nodes[reg.Node]
+	if !ok {
+		n = &node{
+			Node:     &api.Node{Node: reg.Node, CreateIndex: idx},
+			Services: make(map[string]*api.AgentService),
+			Checks:   make(map[string]*api.HealthCheck),
+		}
+		s.Nodes[reg.Node] = n
+	}
+	if reg.ID != "" {
+		n.Node.ID = reg.ID
+	}
+	n.Node.Address = reg.Address
+	n.Node.TaggedAddresses = reg.TaggedAddresses
+	n.Node.Meta = reg.NodeMeta
+	n.Node.ModifyIndex = idx
+
+	if reg.Service != nil {
+		service := *reg.Service
+		if service.ID == "" {
+			service.ID = service.Service
+		}
+		service.CreateIndex = idx
+		if existing, ok := n.Services[service.ID]; ok {
+			service.CreateIndex = existing.CreateIndex
+		}
+		service.ModifyIndex = idx
+		n.Services[service.ID] = &service
+	}
+
+	if reg.Check != nil {
+		check := &api.HealthCheck{
+			Node:      reg.Node,
+			CheckID:   reg.Check.CheckID,
+			Name:      reg.Check.Name,
+			Status:    reg.Check.Status,
+			Notes:     reg.Check.Notes,
+			Output:    reg.Check.Output,
+			ServiceID: reg.Check.ServiceID,
+		}
+		if check.CheckID == "" {
+			check.CheckID = check.Name
+		}
+		if check.Status == "" {
+			check.Status = api.HealthCritical
+		}
+		if service, ok := n.Services[check.ServiceID]; ok {
+			check.ServiceName = service.Service
+			check.ServiceTags = service.Tags
+		}
+		n.Checks[check.CheckID] = check
+
+		if check.Status == api.HealthCritical {
+			s.invalidateSessions(func(se *api.SessionEntry) bool {
+				return se.Node == reg.Node && hasString(se.Checks, check.CheckID)
+			})
+		}
+	}
+}
+
+// checkRegistration makes sure a registration can be applied.
+func (s *state) checkRegistration(reg *api.CatalogRegistration) error {
+	if reg.Node == "" || reg.Address == "" {
+		return errorf(http.StatusBadRequest, "Must provide node and address")
+	}
+	if reg.Service != nil && reg.Service.ID == "" && reg.Service.Service == "" {
+		return errorf(http.StatusBadRequest, "Must provide service name with ID")
+	}
+	if reg.Check != nil {
+		if reg.Check.CheckID == "" && reg.Check.Name == "" {
+			return errorf(http.StatusBadRequest, "Must provide check name with ID")
+		}
+		if id := reg.Check.ServiceID; id != "" {
+			_, registered := s.Nodes[reg.Node]
+			pending := reg.Service != nil && (reg.Service.ID == id || reg.Service.ID == "" && reg.Service.Service == id)
+			if !pending && (!registered || s.Nodes[reg.Node].Services[id] == nil) {
+				return errorf(http.StatusInternalServerError, "Unknown service '%s' for check '%s'", id, reg.Check.CheckID)
+			}
+		}
+	}
+	return nil
+}
+
+// deregister applies a catalog deregistration of a whole node, a service or
+// a check.
+func (s *state) deregister(dereg *api.CatalogDeregistration) {
+	n, ok := s.Nodes[dereg.Node]
+	if !ok {
+		return
+	}
+
+	switch {
+	case dereg.ServiceID != "":
+		if _, ok := n.Services[dereg.ServiceID]; !ok {
+			return
+		}
+		s.next()
+		delete(n.Services, dereg.ServiceID)
+		for id, check := range n.Checks {
+			if check.ServiceID == dereg.ServiceID {
+				s.deleteCheck(n, id)
+			}
+		}
+
+	case dereg.CheckID != "":
+		if _, ok := n.Checks[dereg.CheckID]; !ok {
+			return
+		}
+		s.next()
+		s.deleteCheck(n, dereg.CheckID)
+
+	default:
+		s.deregisterNode(dereg.Node)
+	}
+}
+
+func (s *state) deregisterNode(name string) {
+	s.next()
+	delete(s.Nodes, name)
+	delete(s.Coords, name)
+	s.invalidateSessions(func(se *api.SessionEntry) bool {
+		return se.Node == name
+	})
+}
+
+func (s *state) deleteCheck(n *node, id string) {
+	delete(n.Checks, id)
+	s.invalidateSessions(func(se *api.SessionEntry) bool {
+		return se.Node == n.Node.Node && hasString(se.Checks, id)
+	})
+}
+
+// sortedNodes returns the catalog nodes sorted by name.
+func (s *state) sortedNodes() []*node {
+	var nodes []*node
+	for _, n := range s.Nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node.Node < nodes[j].Node.Node })
+	return nodes
+}
+
+// serviceEntries returns the instances of the given service along with
+// their checks, keeping only the ones whose checks all pass the filter.
+func (s *state) serviceEntries(name string, filter func(*api.HealthCheck) bool) []api.ServiceEntry {
+	entries := []api.ServiceEntry{}
+	for _, n := range s.sortedNodes() {
+		for _, service := range n.Services {
+			if service.Service != name {
+				continue
+			}
+
+			var checks api.HealthChecks
+			keep := true
+			for _, check := range n.Checks {
+				if check.ServiceID != "" && check.ServiceID != service.ID {
+					continue
+				}
+				checks = append(checks, check)
+				keep = keep && filter(check)
+			}
+			if !keep {
+				continue
+			}
+			entries = append(entries, api.ServiceEntry{
+				Node:    n.Node,
+				Service: service,
+				Checks:  checks,
+			})
+		}
+	}
+	return entries
+}
+
+func (a *agent) catalogEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/catalog/")
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[0] {
+	case "register":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var reg api.CatalogRegistration
+			if err := decode(r, &reg); err != nil {
+				return nil, err
+			}
+			if err := st.checkRegistration(&reg); err != nil {
+				return nil, err
+			}
+			st.register(&reg)
+			return true, nil
+		})
+
+	case "deregister":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var dereg api.CatalogDeregistration
+			if err := decode(r, &dereg); err != nil {
+				return nil, err
+			}
+			if dereg.Node == "" {
+				return nil, errorf(http.StatusBadRequest, "Must provide node")
+			}
+			st.deregister(&dereg)
+			return true, nil
+		})
+
+	case "datacenters":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			return []string{a.cfg.Datacenter}, nil
+		})
+
+	case "nodes":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			nodes := []*api.Node{}
+			for _, n := range st.sortedNodes() {
+				nodes = append(nodes, n.Node)
+			}
+			return nodes, nil
+		})
+
+	case "node":
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			n, ok := st.Nodes[parts[1]]
+			if !ok {
+				return nil, nil
+			}
+			return &api.CatalogNode{Node: n.Node, Services: n.Services}, nil
+		})
+
+	case "services":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			services := make(map[string][]string)
+			for _, n := range st.Nodes {
+				for _, service := range n.Services {
+					tags := services[service.Service]
+					for _, tag := range service.Tags {
+						if !hasString(tags, tag) {
+							tags = append(tags, tag)
+						}
+					}
+					if tags == nil {
+						tags = []string{}
+					}
+					services[service.Service] = tags
+				}
+			}
+			return services, nil
+		})
+
+	case "service":
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			services := []*api.CatalogService{}
+			for _, entry := range st.serviceEntries(parts[1], anyStatus) {
+				n, service := entry.Node, entry.Service
+				services = append(services, &api.CatalogService{
+					ID:                       n.ID,
+					Node:                     n.Node,
+					Address:                  n.Address,
+					Datacenter:               a.cfg.Datacenter,
+					TaggedAddresses:          n.TaggedAddresses,
+					NodeMeta:                 n.Meta,
+					ServiceID:                service.ID,
+					ServiceName:              service.Service,
+					ServiceAddress:           service.Address,
+					ServiceTags:              service.Tags,
+					ServicePort:              service.Port,
+					ServiceEnableTagOverride: service.EnableTagOverride,
+					CreateIndex:              service.CreateIndex,
+					ModifyIndex:              service.ModifyIndex,
+				})
+			}
+			return services, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *agent) healthEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/health/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[0] {
+	case "node":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			checks := []*api.HealthCheck{}
+			if n, ok := st.Nodes[parts[1]]; ok {
+				for _, check := range n.Checks {
+					checks = append(checks, check)
+				}
+			}
+			sort.Slice(checks, func(i, j int) bool { return checks[i].CheckID < checks[j].CheckID })
+			return checks, nil
+		})
+
+	case "service":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			filter := anyStatus
+			if _, ok := r.URL.Query()["passing"]; ok {
+				filter = onlyPassing
+			}
+			return st.serviceEntries(parts[1], filter), nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// coordinateUpdate is the body of a coordinate update.
+type coordinateUpdate struct {
+	Node  string
+	Coord *coordinate.Coordinate
+}
+
+func (a *agent) coordinateEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/coordinate/update":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var update coordinateUpdate
+			if err := decode(r, &update); err != nil {
+				return nil, err
+			}
+			if _, ok := st.Nodes[update.Node]; !ok || update.Coord == nil {
+				return nil, errorf(http.StatusInternalServerError, "Unknown node '%s' for coordinate update", update.Node)
+			}
+			st.next()
+			st.Coords[update.Node] = update.Coord
+			return true, nil
+		})
+
+	case "/v1/coordinate/nodes":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			entries := []*api.CoordinateEntry{}
+			for name, coord := range st.Coords {
+				entries = append(entries, &api.CoordinateEntry{Node: name, Coord: coord})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Node < entries[j].Node })
+			return entries, nil
+		})
+
+	case "/v1/coordinate/datacenters":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			return []*api.CoordinateDatacenterMap{{Datacenter: a.cfg.Datacenter}}, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// These are filters for serviceEntries.
+func anyStatus(check *api.HealthCheck) bool   { return true }
+func onlyPassing(check *api.HealthCheck) bool { return check.Status == api.HealthPassing }
+func notCritical(check *api.HealthCheck) bool { return check.Status != api.HealthCritical }
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
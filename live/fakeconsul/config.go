@@ -0,0 +1,255 @@
+package fakeconsul
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// config is the part of Consul's agent configuration the fake understands.
+// Anything else on the command line or in a config file is ignored.
+type config struct {
+	Node       string
+	Datacenter string
+	DataDir    string
+	ClientAddr string
+	Server     bool
+	Expect     int
+	Joined     bool
+	Ports      ports
+
+	ACLDatacenter    string
+	ACLMasterToken   string
+	ACLDefaultPolicy string
+
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+	VerifyIncoming bool
+}
+
+// ports holds the ports an agent says it listens on. Only the HTTP and HTTPS
+// ports are actually served, the rest are just reported back through the
+// API.
+type ports struct {
+	DNS     int
+	HTTP    int
+	HTTPS   int
+	SerfLAN int
+	SerfWAN int
+	Server  int
+}
+
+// fileConfig is the subset of a JSON config file that the fake reads.
+type fileConfig struct {
+	Server           bool           `json:"server"`
+	Bootstrap        bool           `json:"bootstrap"`
+	BootstrapExpect  int            `json:"bootstrap_expect"`
+	DataDir          string         `json:"data_dir"`
+	Datacenter       string         `json:"datacenter"`
+	NodeName         string         `json:"node_name"`
+	ClientAddr       string         `json:"client_addr"`
+	Ports            map[string]int `json:"ports"`
+	ACLMasterToken   string         `json:"acl_master_token"`
+	ACLDatacenter    string         `json:"acl_datacenter"`
+	ACLDefaultPolicy string         `json:"acl_default_policy"`
+	CAFile           string         `json:"ca_file"`
+	CertFile         string         `json:"cert_file"`
+	KeyFile          string         `json:"key_file"`
+	VerifyIncoming   bool           `json:"verify_incoming"`
+}
+
+// stringsFlag collects a flag that can be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// parseArgs reads the arguments given to "consul agent", in the form the
+// live package passes them.
+func parseArgs(args []string) (*config, error) {
+	cfg := &config{
+		Datacenter:       "dc1",
+		ClientAddr:       "127.0.0.1",
+		ACLDefaultPolicy: "allow",
+		Ports: ports{
+			DNS:     8600,
+			HTTP:    8500,
+			SerfLAN: 8301,
+			SerfWAN: 8302,
+			Server:  8300,
+		},
+	}
+
+	var hcl, files, joins stringsFlag
+	var bootstrap bool
+	var ignored string
+	f := flag.NewFlagSet("agent", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	f.StringVar(&cfg.Node, "node", "", "")
+	f.StringVar(&cfg.Datacenter, "datacenter", cfg.Datacenter, "")
+	f.StringVar(&cfg.DataDir, "data-dir", "", "")
+	f.StringVar(&cfg.ClientAddr, "client", cfg.ClientAddr, "")
+	f.BoolVar(&cfg.Server, "server", false, "")
+	f.IntVar(&cfg.Expect, "bootstrap-expect", 0, "")
+	f.BoolVar(&bootstrap, "bootstrap", false, "")
+	f.Var(&hcl, "hcl", "")
+	f.Var(&files, "config-file", "")
+	f.Var(&joins, "retry-join", "")
+	f.Var(&joins, "join", "")
+	for _, name := range []string{"bind", "advertise", "advertise-wan", "log-level", "encrypt"} {
+		f.StringVar(&ignored, name, "", "")
+	}
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.Joined = len(joins) > 0
+
+	for _, path := range files {
+		if err := cfg.readFile(path, &bootstrap); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range hcl {
+		if err := cfg.parseHCL(h); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DataDir == "" {
+		return nil, fmt.Errorf("a data dir is required")
+	}
+	if cfg.Node == "" {
+		port := cfg.Ports.HTTP
+		if port <= 0 {
+			port = cfg.Ports.HTTPS
+		}
+		cfg.Node = fmt.Sprintf("node-%d", port)
+	}
+	if bootstrap {
+		cfg.Expect = 1
+	}
+	if cfg.Server && cfg.Expect == 0 {
+		return nil, fmt.Errorf("servers need -bootstrap or -bootstrap-expect")
+	}
+	return cfg, nil
+}
+
+func (c *config) readFile(path string, bootstrap *bool) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fc fileConfig
+	if err := json.Unmarshal(content, &fc); err != nil {
+		return fmt.Errorf("failed to parse config file %q: %v", path, err)
+	}
+
+	c.Server = c.Server || fc.Server
+	*bootstrap = *bootstrap || fc.Bootstrap
+	if fc.BootstrapExpect != 0 {
+		c.Expect = fc.BootstrapExpect
+	}
+	setString(&c.DataDir, fc.DataDir)
+	setString(&c.Datacenter, fc.Datacenter)
+	setString(&c.Node, fc.NodeName)
+	setString(&c.ClientAddr, fc.ClientAddr)
+	setString(&c.ACLMasterToken, fc.ACLMasterToken)
+	setString(&c.ACLDatacenter, fc.ACLDatacenter)
+	setString(&c.ACLDefaultPolicy, fc.ACLDefaultPolicy)
+	setString(&c.CAFile, fc.CAFile)
+	setString(&c.CertFile, fc.CertFile)
+	setString(&c.KeyFile, fc.KeyFile)
+	c.VerifyIncoming = c.VerifyIncoming || fc.VerifyIncoming
+	for name, port := range fc.Ports {
+		c.setPort(name, port)
+	}
+	return nil
+}
+
+var (
+	hclPorts  = regexp.MustCompile(`^ports\s*=\s*\{(.*)\}$`)
+	hclAssign = regexp.MustCompile(`([a-z_]+)\s*=\s*("[^"]*"|[^\s{}]+)`)
+)
+
+// parseHCL handles the simple one-line HCL snippets given with -hcl, which
+// are either a ports block or a single key = value. Other blocks are
+// ignored.
+func (c *config) parseHCL(h string) error {
+	h = strings.TrimSpace(h)
+	if m := hclPorts.FindStringSubmatch(h); m != nil {
+		for _, kv := range hclAssign.FindAllStringSubmatch(m[1], -1) {
+			port, err := strconv.Atoi(kv[2])
+			if err != nil {
+				return fmt.Errorf("bad port in %q: %v", h, err)
+			}
+			c.setPort(kv[1], port)
+		}
+		return nil
+	}
+	if strings.Contains(h, "{") {
+		return nil
+	}
+
+	m := hclAssign.FindStringSubmatch(h)
+	if m == nil {
+		return fmt.Errorf("can't parse HCL %q", h)
+	}
+	value := strings.Trim(m[2], `"`)
+	switch m[1] {
+	case "datacenter":
+		c.Datacenter = value
+	case "node_name":
+		c.Node = value
+	case "data_dir":
+		c.DataDir = value
+	case "acl_datacenter":
+		c.ACLDatacenter = value
+	case "acl_master_token":
+		c.ACLMasterToken = value
+	case "acl_default_policy":
+		c.ACLDefaultPolicy = value
+	case "ca_file":
+		c.CAFile = value
+	case "cert_file":
+		c.CertFile = value
+	case "key_file":
+		c.KeyFile = value
+	case "verify_incoming":
+		c.VerifyIncoming = value == "true"
+	}
+	return nil
+}
+
+func (c *config) setPort(name string, port int) {
+	switch name {
+	case "dns":
+		c.Ports.DNS = port
+	case "http":
+		c.Ports.HTTP = port
+	case "https":
+		c.Ports.HTTPS = port
+	case "serf_lan":
+		c.Ports.SerfLAN = port
+	case "serf_wan":
+		c.Ports.SerfWAN = port
+	case "server":
+		c.Ports.Server = port
+	}
+}
+
+func setString(s *string, value string) {
+	if value != "" {
+		*s = value
+	}
+}
@@ -0,0 +1,217 @@
+package fakeconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// blockPoll is how often a blocking query checks for a new index.
+	blockPoll = 50 * time.Millisecond
+
+	// defaultWait and maxWait bound how long blocking queries wait, the same
+	// as Consul.
+	defaultWait = 5 * time.Minute
+	maxWait     = 10 * time.Minute
+)
+
+// httpError is an error that gets sent back with a particular status code.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &httpError{code, fmt.Sprintf(format, args...)}
+}
+
+var (
+	errNoLeader         = errorf(http.StatusInternalServerError, "No cluster leader")
+	errPermissionDenied = errorf(http.StatusForbidden, "Permission denied")
+	errNotFound         = errorf(http.StatusNotFound, "")
+)
+
+// access says what a request needs from the cluster.
+type access int
+
+const (
+	// accessLocal requests are answered by the agent, even without a
+	// leader.
+	accessLocal access = iota
+
+	// accessRead requests need a leader unless they allow stale results,
+	// and may block.
+	accessRead
+
+	// accessWrite requests need a leader and save their changes.
+	accessWrite
+
+	// accessMember requests change the agent's membership, which is saved
+	// even without a leader.
+	accessMember
+)
+
+// handlerFunc answers a request from the state. The result is encoded as
+// JSON unless it's a []byte, which is sent as is.
+type handlerFunc func(r *http.Request, st *state) (interface{}, error)
+
+// routes returns the HTTP API the fake supports.
+func (a *agent) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/", a.agentEndpoint)
+	mux.HandleFunc("/v1/status/", a.statusEndpoint)
+	mux.HandleFunc("/v1/operator/", a.operatorEndpoint)
+	mux.HandleFunc("/v1/kv/", a.kvEndpoint)
+	mux.HandleFunc("/v1/catalog/", a.catalogEndpoint)
+	mux.HandleFunc("/v1/health/", a.healthEndpoint)
+	mux.HandleFunc("/v1/coordinate/", a.coordinateEndpoint)
+	mux.HandleFunc("/v1/session/", a.sessionEndpoint)
+	mux.HandleFunc("/v1/acl/", a.aclEndpoint)
+	mux.HandleFunc("/v1/query", a.queryEndpoint)
+	mux.HandleFunc("/v1/query/", a.queryEndpoint)
+	mux.HandleFunc("/v1/snapshot", a.snapshotEndpoint)
+	return mux
+}
+
+// serve runs fn against the state with the given access, and sends back the
+// result along with the usual Consul headers.
+func (a *agent) serve(w http.ResponseWriter, r *http.Request, acc access, fn handlerFunc) {
+	q := r.URL.Query()
+	_, stale := q["stale"]
+
+	var minIndex uint64
+	wait := defaultWait
+	if acc == accessRead {
+		minIndex, _ = strconv.ParseUint(q.Get("index"), 10, 64)
+		if d, err := time.ParseDuration(q.Get("wait")); err == nil && d > 0 {
+			wait = d
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		var out interface{}
+		var index uint64
+		var leader bool
+		err := a.store.update(func(st *state) (bool, error) {
+			index, leader = st.Index, st.Leader != ""
+			if acc == accessRead || acc == accessWrite {
+				if !leader && (acc == accessWrite || !stale) {
+					return false, errNoLeader
+				}
+				if !a.allowed(r, st) {
+					return false, errPermissionDenied
+				}
+			}
+
+			var err error
+			out, err = fn(r, st)
+			index = st.Index
+			return (acc == accessWrite || acc == accessMember) && err == nil, err
+		})
+
+		// Blocking queries wait for the index to move past the one they
+		// were given.
+		if (err == nil || err == errNotFound) && minIndex > 0 && index <= minIndex && time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(blockPoll):
+			}
+			continue
+		}
+
+		respond(w, index, leader, out, err)
+		return
+	}
+}
+
+func respond(w http.ResponseWriter, index uint64, leader bool, out interface{}, err error) {
+	h := w.Header()
+	h.Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	h.Set("X-Consul-KnownLeader", strconv.FormatBool(leader))
+	h.Set("X-Consul-LastContact", "0")
+
+	if err != nil {
+		code := http.StatusInternalServerError
+		if e, ok := err.(*httpError); ok {
+			code = e.code
+		}
+		w.WriteHeader(code)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	if raw, ok := out.([]byte); ok {
+		w.Write(raw)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// token returns the ACL token given with a request.
+func token(r *http.Request) string {
+	if t := r.Header.Get("X-Consul-Token"); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+// management returns true if the request has a management token.
+func (a *agent) management(r *http.Request, st *state) bool {
+	t := token(r)
+	if t == "" {
+		return false
+	}
+	if t == st.ACL.MasterToken {
+		return true
+	}
+	acl, ok := st.ACLs[t]
+	return ok && acl.Type == api.ACLManagementType
+}
+
+// allowed applies a very coarse version of ACLs: when the default policy is
+// deny, only management tokens get through. Rules aren't evaluated.
+func (a *agent) allowed(r *http.Request, st *state) bool {
+	if st.ACL.Datacenter == "" || st.ACL.DefaultPolicy != "deny" {
+		return true
+	}
+	return a.management(r, st)
+}
+
+// decode reads a JSON request body.
+func decode(r *http.Request, out interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		return errorf(http.StatusBadRequest, "Request decode failed: %v", err)
+	}
+	return nil
+}
+
+// split returns the parts of the path after the given prefix.
+func split(r *http.Request, prefix string) []string {
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+}
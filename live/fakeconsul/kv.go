@@ -0,0 +1,192 @@
+package fakeconsul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// sortedKeys returns the keys with the given prefix, in order.
+func (s *state) sortedKeys(prefix string) []string {
+	var keys []string
+	for key := range s.KV {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// kvSet applies a KV write with the given options. Like Consul, a plain set
+// leaves any lock on the key alone. This returns false if a check-and-set
+// or lock operation didn't apply.
+func (s *state) kvSet(key string, value []byte, q map[string][]string) (bool, error) {
+	get := func(name string) (string, bool) {
+		v, ok := q[name]
+		if !ok || len(v) == 0 {
+			return "", ok
+		}
+		return v[0], true
+	}
+
+	var flags uint64
+	if v, ok := get("flags"); ok {
+		f, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return false, errorf(http.StatusBadRequest, "Invalid flags: %v", err)
+		}
+		flags = f
+	}
+
+	existing, exists := s.KV[key]
+	if v, ok := get("cas"); ok {
+		cas, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return false, errorf(http.StatusBadRequest, "Invalid cas index: %v", err)
+		}
+		if cas == 0 && exists || cas != 0 && (!exists || existing.ModifyIndex != cas) {
+			return false, nil
+		}
+	}
+
+	pair := &api.KVPair{
+		Key:   key,
+		Flags: flags,
+		Value: value,
+	}
+	if exists {
+		pair.CreateIndex = existing.CreateIndex
+		pair.LockIndex = existing.LockIndex
+		pair.Session = existing.Session
+	}
+
+	if id, ok := get("acquire"); ok {
+		if _, ok := s.Sessions[id]; !ok {
+			return false, errorf(http.StatusInternalServerError, "invalid session %q", id)
+		}
+		if pair.Session != "" && pair.Session != id {
+			return false, nil
+		}
+		if pair.Session != id {
+			pair.Session = id
+			pair.LockIndex++
+		}
+	} else if id, ok := get("release"); ok {
+		if pair.Session != id {
+			return false, nil
+		}
+		pair.Session = ""
+	}
+
+	idx := s.next()
+	if !exists {
+		pair.CreateIndex = idx
+	}
+	pair.ModifyIndex = idx
+	s.KV[key] = pair
+	return true, nil
+}
+
+// kvDelete deletes a key or, with recurse, every key with the prefix. This
+// returns false if a check-and-set delete didn't apply.
+func (s *state) kvDelete(key string, q map[string][]string) (bool, error) {
+	if _, ok := q["recurse"]; ok {
+		keys := s.sortedKeys(key)
+		if len(keys) > 0 {
+			s.next()
+		}
+		for _, k := range keys {
+			delete(s.KV, k)
+		}
+		return true, nil
+	}
+
+	existing, exists := s.KV[key]
+	if v, ok := q["cas"]; ok && len(v) > 0 {
+		cas, err := strconv.ParseUint(v[0], 10, 64)
+		if err != nil {
+			return false, errorf(http.StatusBadRequest, "Invalid cas index: %v", err)
+		}
+		if !exists || existing.ModifyIndex != cas {
+			return false, nil
+		}
+	}
+	if exists {
+		s.next()
+		delete(s.KV, key)
+	}
+	return true, nil
+}
+
+func (a *agent) kvEndpoint(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			if _, ok := q["keys"]; ok {
+				return st.kvKeys(key, q.Get("separator"))
+			}
+
+			var pairs []*api.KVPair
+			if _, ok := q["recurse"]; ok {
+				for _, k := range st.sortedKeys(key) {
+					pairs = append(pairs, st.KV[k])
+				}
+			} else if pair, ok := st.KV[key]; ok {
+				pairs = append(pairs, pair)
+			}
+			if len(pairs) == 0 {
+				return nil, errNotFound
+			}
+			if _, ok := q["raw"]; ok {
+				return pairs[0].Value, nil
+			}
+			return pairs, nil
+		})
+
+	case "PUT":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			value, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			return st.kvSet(key, value, q)
+		})
+
+	case "DELETE":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			return st.kvDelete(key, q)
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// kvKeys lists the keys with the given prefix, rolling up everything after
+// the separator if one is given.
+func (s *state) kvKeys(prefix, separator string) ([]string, error) {
+	var keys []string
+	for _, key := range s.sortedKeys(prefix) {
+		if separator != "" {
+			rest := strings.TrimPrefix(key, prefix)
+			if idx := strings.Index(rest, separator); idx >= 0 {
+				key = prefix + rest[:idx+len(separator)]
+			}
+		}
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errNotFound
+	}
+	return keys, nil
+}
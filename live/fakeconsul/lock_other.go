@@ -0,0 +1,50 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package fakeconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockRetryInterval is how often we try again for a lock that's held.
+const lockRetryInterval = 5 * time.Millisecond
+
+// lockFile takes an exclusive lock by creating the given file, and returns
+// a function that releases the lock by removing it. Without flock there's
+// nothing to clean up after a killed agent, so the holder's PID goes in the
+// file and a lock whose holder has gone away is broken.
+func lockFile(path string) (func(), error) {
+	pid := os.Getpid()
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d", pid)
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// The holder may not have written its PID yet, in which case we
+		// just wait.
+		if content, err := ioutil.ReadFile(path); err == nil {
+			holder, err := strconv.Atoi(strings.TrimSpace(string(content)))
+			if err == nil && !processAlive(holder) {
+				os.Remove(path)
+				continue
+			}
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
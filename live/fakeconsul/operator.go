@@ -0,0 +1,206 @@
+package fakeconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// serverAddr is the address a server is known by in Raft.
+func serverAddr(m *member) string {
+	return fmt.Sprintf("127.0.0.1:%d", m.Ports.Server)
+}
+
+func (a *agent) statusEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/status/leader":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			if m, ok := st.Members[st.Leader]; ok {
+				return serverAddr(m), nil
+			}
+			return "", nil
+		})
+
+	case "/v1/status/peers":
+		a.serve(w, r, accessLocal, func(r *http.Request, st *state) (interface{}, error) {
+			peers := []string{}
+			if st.Bootstrapped {
+				for _, m := range st.servers() {
+					peers = append(peers, serverAddr(m))
+				}
+			}
+			return peers, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *agent) operatorEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/operator/raft/configuration":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			reply := &api.RaftConfiguration{
+				Servers: []*api.RaftServer{},
+				Index:   st.Index,
+			}
+			for _, m := range st.servers() {
+				reply.Servers = append(reply.Servers, &api.RaftServer{
+					ID:              m.Name,
+					Node:            m.Name,
+					Address:         serverAddr(m),
+					Leader:          m.Name == st.Leader,
+					ProtocolVersion: "3",
+					Voter:           true,
+				})
+			}
+			return reply, nil
+		})
+
+	case "/v1/operator/autopilot/configuration":
+		switch r.Method {
+		case "GET":
+			a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+				return st.Autopilot, nil
+			})
+
+		case "PUT":
+			a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+				var conf api.AutopilotConfiguration
+				if err := decode(r, &conf); err != nil {
+					return nil, err
+				}
+				if v := r.URL.Query().Get("cas"); v != "" {
+					cas, err := strconv.ParseUint(v, 10, 64)
+					if err != nil {
+						return nil, errorf(http.StatusBadRequest, "Invalid cas index: %v", err)
+					}
+					if cas != st.Autopilot.ModifyIndex {
+						return false, nil
+					}
+				}
+				idx := st.next()
+				conf.CreateIndex = st.Autopilot.CreateIndex
+				conf.ModifyIndex = idx
+				st.Autopilot = &conf
+				return true, nil
+			})
+
+		default:
+			methodNotAllowed(w, r)
+		}
+
+	case "/v1/operator/autopilot/health":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			reply := &api.OperatorHealthReply{
+				Healthy: true,
+				Servers: []api.ServerHealth{},
+			}
+			var healthy int
+			servers := st.servers()
+			for _, m := range servers {
+				serf := "alive"
+				if !m.alive() {
+					serf = "failed"
+				}
+				health := api.ServerHealth{
+					ID:          m.Name,
+					Name:        m.Name,
+					Address:     serverAddr(m),
+					SerfStatus:  serf,
+					Version:     Version,
+					Leader:      m.Name == st.Leader,
+					LastContact: api.NewReadableDuration(0),
+					LastTerm:    1,
+					LastIndex:   st.Index,
+					Healthy:     m.alive(),
+					Voter:       true,
+				}
+				if health.Healthy {
+					healthy++
+				} else {
+					reply.Healthy = false
+				}
+				reply.Servers = append(reply.Servers, health)
+			}
+			if tolerance := healthy - (len(servers)/2 + 1); tolerance > 0 {
+				reply.FailureTolerance = tolerance
+			}
+			return reply, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// snapshot is the fake's stand-in for a Raft snapshot, which is just the
+// data part of the state as JSON.
+type snapshot struct {
+	Index     uint64
+	Nodes     map[string]*node
+	KV        map[string]*api.KVPair
+	Sessions  map[string]*api.SessionEntry
+	ACLs      map[string]*api.ACLEntry
+	Queries   map[string]*api.PreparedQueryDefinition
+	Coords    map[string]*coordinate.Coordinate
+	Autopilot *api.AutopilotConfiguration
+}
+
+func (a *agent) snapshotEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			return json.Marshal(&snapshot{
+				Index:     st.Index,
+				Nodes:     st.Nodes,
+				KV:        st.KV,
+				Sessions:  st.Sessions,
+				ACLs:      st.ACLs,
+				Queries:   st.Queries,
+				Coords:    st.Coords,
+				Autopilot: st.Autopilot,
+			})
+		})
+
+	case "PUT":
+		// Indexes never go backwards, even when restoring an older
+		// snapshot.
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			fresh := newState()
+			snap := &snapshot{
+				Nodes:     fresh.Nodes,
+				KV:        fresh.KV,
+				Sessions:  fresh.Sessions,
+				ACLs:      fresh.ACLs,
+				Queries:   fresh.Queries,
+				Coords:    fresh.Coords,
+				Autopilot: fresh.Autopilot,
+			}
+			if err := decode(r, snap); err != nil {
+				return nil, err
+			}
+			st.Nodes = snap.Nodes
+			st.KV = snap.KV
+			st.Sessions = snap.Sessions
+			st.ACLs = snap.ACLs
+			st.Queries = snap.Queries
+			st.Coords = snap.Coords
+			st.Autopilot = snap.Autopilot
+			if snap.Index > st.Index {
+				st.Index = snap.Index
+			}
+			st.next()
+			st.reconcile()
+			return nil, nil
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,34 @@
+package fakeconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+// processAlive returns true if the given process is running and isn't
+// stopped, which is how a paused agent looks to the rest of the cluster.
+func processAlive(pid int) bool {
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return false
+	}
+
+	// The state comes after the command name, which is in parens and may
+	// have spaces in it.
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	s := string(stat)
+	idx := strings.LastIndex(s, ")")
+	if idx < 0 || idx+2 >= len(s) {
+		return false
+	}
+	switch s[idx+2] {
+	case 'T', 't', 'Z', 'X':
+		return false
+	default:
+		return true
+	}
+}
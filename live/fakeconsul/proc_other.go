@@ -0,0 +1,24 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package fakeconsul
+
+import (
+	"os"
+)
+
+// processAlive returns true if the given process exists, as far as
+// os.FindProcess can tell. On Windows that means it can be opened, and on
+// platforms without any way to check every process looks alive, as do
+// paused agents.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd netbsd openbsd solaris
+
+package fakeconsul
+
+import (
+	"syscall"
+)
+
+// processAlive returns true if the given process is running. Stopped
+// processes can't be told apart without /proc, so paused agents still look
+// alive.
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
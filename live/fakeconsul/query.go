@@ -0,0 +1,133 @@
+package fakeconsul
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-uuid"
+)
+
+// setQuery creates or updates a prepared query, making up an ID if there
+// isn't one. Only plain service queries are supported, not templates.
+func (s *state) setQuery(def *api.PreparedQueryDefinition) (string, error) {
+	if def.Service.Service == "" {
+		return "", errorf(http.StatusBadRequest, "Must provide a Service name to query")
+	}
+	for id, existing := range s.Queries {
+		if def.Name != "" && existing.Name == def.Name && id != def.ID {
+			return "", errorf(http.StatusInternalServerError, "name '%s' aliases an existing query name", def.Name)
+		}
+	}
+	if def.ID == "" {
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", err
+		}
+		def.ID = id
+	}
+
+	s.next()
+	s.Queries[def.ID] = def
+	return def.ID, nil
+}
+
+// findQuery looks up a prepared query by ID and then by name.
+func (s *state) findQuery(idOrName string) (*api.PreparedQueryDefinition, bool) {
+	if def, ok := s.Queries[idOrName]; ok {
+		return def, true
+	}
+	for _, def := range s.Queries {
+		if def.Name != "" && def.Name == idOrName {
+			return def, true
+		}
+	}
+	return nil, false
+}
+
+func (a *agent) queryEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/query")
+	if len(parts) > 0 && parts[0] == "" {
+		parts = parts[1:]
+	}
+	errQueryNotFound := errorf(http.StatusNotFound, "Query not found")
+
+	switch {
+	case len(parts) == 0 && r.Method == "POST":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var def api.PreparedQueryDefinition
+			if err := decode(r, &def); err != nil {
+				return nil, err
+			}
+			def.ID = ""
+			id, err := st.setQuery(&def)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id}, nil
+		})
+
+	case len(parts) == 0:
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			defs := []*api.PreparedQueryDefinition{}
+			for _, def := range st.Queries {
+				defs = append(defs, def)
+			}
+			sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+			return defs, nil
+		})
+
+	case len(parts) == 2 && parts[1] == "execute":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			def, ok := st.findQuery(parts[0])
+			if !ok {
+				return nil, errQueryNotFound
+			}
+			filter := notCritical
+			if def.Service.OnlyPassing {
+				filter = onlyPassing
+			}
+			return &api.PreparedQueryExecuteResponse{
+				Service:    def.Service.Service,
+				Nodes:      st.serviceEntries(def.Service.Service, filter),
+				DNS:        def.DNS,
+				Datacenter: a.cfg.Datacenter,
+			}, nil
+		})
+
+	case len(parts) == 1 && r.Method == "GET":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			def, ok := st.Queries[parts[0]]
+			if !ok {
+				return nil, errQueryNotFound
+			}
+			return []*api.PreparedQueryDefinition{def}, nil
+		})
+
+	case len(parts) == 1 && r.Method == "PUT":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			if _, ok := st.Queries[parts[0]]; !ok {
+				return nil, errQueryNotFound
+			}
+			var def api.PreparedQueryDefinition
+			if err := decode(r, &def); err != nil {
+				return nil, err
+			}
+			def.ID = parts[0]
+			_, err := st.setQuery(&def)
+			return nil, err
+		})
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			if _, ok := st.Queries[parts[0]]; ok {
+				st.next()
+				delete(st.Queries, parts[0])
+			}
+			return nil, nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
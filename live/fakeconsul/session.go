@@ -0,0 +1,198 @@
+package fakeconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-uuid"
+)
+
+// sessionRequest is the body of a session create. The lock delay is sent as
+// a string like "15s" by the api package, or as nanoseconds.
+type sessionRequest struct {
+	Name      string
+	Node      string
+	Checks    []string
+	LockDelay json.RawMessage
+	Behavior  string
+	TTL       string
+}
+
+func (r *sessionRequest) lockDelay() (time.Duration, error) {
+	if len(r.LockDelay) == 0 {
+		return 15 * time.Second, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(r.LockDelay, &s); err == nil {
+		return time.ParseDuration(s)
+	}
+	ns, err := strconv.ParseInt(string(r.LockDelay), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ns), nil
+}
+
+// createSession checks and adds a session, returning its ID.
+func (s *state) createSession(req *sessionRequest, self string) (string, error) {
+	if req.Node == "" {
+		req.Node = self
+	}
+	if req.Checks == nil {
+		req.Checks = []string{serfCheckID}
+	}
+	if req.Behavior == "" {
+		req.Behavior = api.SessionBehaviorRelease
+	}
+	if req.Behavior != api.SessionBehaviorRelease && req.Behavior != api.SessionBehaviorDelete {
+		return "", errorf(http.StatusBadRequest, "Invalid Behavior setting '%s'", req.Behavior)
+	}
+	if req.TTL != "" {
+		if _, err := time.ParseDuration(req.TTL); err != nil {
+			return "", errorf(http.StatusBadRequest, "Invalid TTL '%s': %v", req.TTL, err)
+		}
+	}
+	delay, err := req.lockDelay()
+	if err != nil {
+		return "", errorf(http.StatusBadRequest, "Invalid LockDelay: %v", err)
+	}
+
+	n, ok := s.Nodes[req.Node]
+	if !ok {
+		return "", errorf(http.StatusInternalServerError, "Missing node registration")
+	}
+	for _, id := range req.Checks {
+		check, ok := n.Checks[id]
+		if !ok {
+			return "", errorf(http.StatusInternalServerError, "Missing check '%s' registration", id)
+		}
+		if check.Status == api.HealthCritical {
+			return "", errorf(http.StatusInternalServerError, "Check '%s' is in critical state", id)
+		}
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	s.Sessions[id] = &api.SessionEntry{
+		CreateIndex: s.next(),
+		ID:          id,
+		Name:        req.Name,
+		Node:        req.Node,
+		Checks:      req.Checks,
+		LockDelay:   delay,
+		Behavior:    req.Behavior,
+		TTL:         req.TTL,
+	}
+	return id, nil
+}
+
+// invalidateSessions removes the matching sessions and releases or deletes
+// the keys they hold, depending on each session's behavior.
+func (s *state) invalidateSessions(match func(*api.SessionEntry) bool) {
+	for id, se := range s.Sessions {
+		if !match(se) {
+			continue
+		}
+		idx := s.next()
+		delete(s.Sessions, id)
+
+		for key, pair := range s.KV {
+			if pair.Session != id {
+				continue
+			}
+			if se.Behavior == api.SessionBehaviorDelete {
+				delete(s.KV, key)
+			} else {
+				pair.Session = ""
+				pair.ModifyIndex = idx
+			}
+		}
+	}
+}
+
+// sortedSessions returns the matching sessions in order of creation.
+func (s *state) sortedSessions(match func(*api.SessionEntry) bool) []*api.SessionEntry {
+	sessions := []*api.SessionEntry{}
+	for _, se := range s.Sessions {
+		if match(se) {
+			sessions = append(sessions, se)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreateIndex < sessions[j].CreateIndex })
+	return sessions
+}
+
+func (a *agent) sessionEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := split(r, "/v1/session/")
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	arg := strings.Join(parts[1:], "/")
+
+	switch parts[0] {
+	case "create":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			var req sessionRequest
+			if r.ContentLength != 0 {
+				if err := decode(r, &req); err != nil {
+					return nil, err
+				}
+			}
+			id, err := st.createSession(&req, a.cfg.Node)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"ID": id}, nil
+		})
+
+	case "destroy":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			st.invalidateSessions(func(se *api.SessionEntry) bool {
+				return se.ID == arg
+			})
+			return true, nil
+		})
+
+	case "renew":
+		a.serve(w, r, accessWrite, func(r *http.Request, st *state) (interface{}, error) {
+			se, ok := st.Sessions[arg]
+			if !ok {
+				return nil, errorf(http.StatusNotFound, "Session id '%s' not found", arg)
+			}
+			return []*api.SessionEntry{se}, nil
+		})
+
+	case "info":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			return st.sortedSessions(func(se *api.SessionEntry) bool {
+				return se.ID == arg
+			}), nil
+		})
+
+	case "node":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			return st.sortedSessions(func(se *api.SessionEntry) bool {
+				return se.Node == arg
+			}), nil
+		})
+
+	case "list":
+		a.serve(w, r, accessRead, func(r *http.Request, st *state) (interface{}, error) {
+			return st.sortedSessions(func(se *api.SessionEntry) bool {
+				return true
+			}), nil
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
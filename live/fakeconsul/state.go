@@ -0,0 +1,301 @@
+package fakeconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+const (
+	// stateFile is the name of the file the agents of a fake cluster share.
+	stateFile = "fake-consul.json"
+
+	// snapshotInterval is how many index bumps there are between the
+	// snapshot markers the servers write. This is much lower than Consul's
+	// threshold so tools waiting for a snapshot don't wait long.
+	snapshotInterval = 64
+
+	// serfCheckID is the check every agent's node gets in the catalog.
+	serfCheckID = "serfHealth"
+)
+
+// state is everything a fake cluster knows. There's no Raft or Serf, every
+// agent just locks and reads the same file, so all reads are consistent.
+// Membership and leadership come from whether the agents' processes are
+// still running.
+type state struct {
+	Index        uint64
+	Leader       string
+	Expect       int
+	Bootstrapped bool
+	Snapshot     uint64
+
+	// ACL is the ACL configuration of the servers, which is what counts
+	// for requests to any agent.
+	ACL aclConfig
+
+	Members   map[string]*member
+	Nodes     map[string]*node
+	KV        map[string]*api.KVPair
+	Sessions  map[string]*api.SessionEntry
+	ACLs      map[string]*api.ACLEntry
+	Queries   map[string]*api.PreparedQueryDefinition
+	Coords    map[string]*coordinate.Coordinate
+	Autopilot *api.AutopilotConfiguration
+}
+
+// member is an agent that's joined the cluster.
+type member struct {
+	Name       string
+	Datacenter string
+	Server     bool
+	Ports      ports
+	Pid        int
+	DataDir    string
+	Left       bool
+}
+
+// status returns the Serf status for the member: 1 for alive, 3 for left
+// and 4 for failed.
+func (m *member) status() int {
+	switch {
+	case m.Left:
+		return 3
+	case processAlive(m.Pid):
+		return 1
+	default:
+		return 4
+	}
+}
+
+func (m *member) alive() bool {
+	return m.status() == 1
+}
+
+// aclConfig is how ACLs are set up for a cluster.
+type aclConfig struct {
+	Datacenter    string
+	MasterToken   string
+	DefaultPolicy string
+}
+
+// node is a catalog node along with its services and checks.
+type node struct {
+	Node     *api.Node
+	Services map[string]*api.AgentService
+	Checks   map[string]*api.HealthCheck
+}
+
+func newState() *state {
+	return &state{
+		Members:  make(map[string]*member),
+		Nodes:    make(map[string]*node),
+		KV:       make(map[string]*api.KVPair),
+		Sessions: make(map[string]*api.SessionEntry),
+		ACLs:     make(map[string]*api.ACLEntry),
+		Queries:  make(map[string]*api.PreparedQueryDefinition),
+		Coords:   make(map[string]*coordinate.Coordinate),
+		Autopilot: &api.AutopilotConfiguration{
+			CleanupDeadServers:      true,
+			LastContactThreshold:    api.NewReadableDuration(200 * time.Millisecond),
+			MaxTrailingLogs:         250,
+			ServerStabilizationTime: api.NewReadableDuration(10 * time.Second),
+		},
+	}
+}
+
+// next bumps the index for a write and returns it.
+func (s *state) next() uint64 {
+	s.Index++
+	return s.Index
+}
+
+// servers returns the servers that haven't left, sorted by name.
+func (s *state) servers() []*member {
+	var servers []*member
+	for _, m := range s.Members {
+		if m.Server && !m.Left {
+			servers = append(servers, m)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
+
+// elect keeps the leader if it's still alive, otherwise it picks the first
+// live server if a quorum of servers is alive. Once there's a leader the
+// catalog is brought up to date with the members. This returns true if
+// anything changed.
+func (s *state) elect() bool {
+	servers := s.servers()
+	if !s.Bootstrapped && s.Expect > 0 && len(servers) >= s.Expect {
+		s.Bootstrapped = true
+	}
+
+	var alive []*member
+	for _, m := range servers {
+		if m.alive() {
+			alive = append(alive, m)
+		}
+	}
+
+	leader := s.Leader
+	if m, ok := s.Members[leader]; !ok || !m.Server || !m.alive() {
+		leader = ""
+	}
+	if !s.Bootstrapped || 2*len(alive) <= len(servers) {
+		leader = ""
+	} else if leader == "" {
+		leader = alive[0].Name
+	}
+
+	changed := leader != s.Leader
+	if changed {
+		s.Leader = leader
+		if leader != "" {
+			s.next()
+		}
+	}
+	if leader != "" && s.reconcile() {
+		changed = true
+	}
+	return changed
+}
+
+// reconcile makes sure every member has a node in the catalog with a Serf
+// health check that matches its status, the way the leader does in Consul.
+func (s *state) reconcile() bool {
+	var changed bool
+	for name, m := range s.Members {
+		n, ok := s.Nodes[name]
+		if m.Left {
+			if ok {
+				s.deregisterNode(name)
+				changed = true
+			}
+			continue
+		}
+
+		status := api.HealthPassing
+		output := "Agent alive and reachable"
+		if !m.alive() {
+			status = api.HealthCritical
+			output = "Agent not live or unreachable"
+		}
+		if ok {
+			if check, ok := n.Checks[serfCheckID]; ok && check.Status == status {
+				continue
+			}
+		}
+
+		s.register(&api.CatalogRegistration{
+			Node:    name,
+			Address: "127.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan": "127.0.0.1",
+				"wan": "127.0.0.1",
+			},
+			Check: &api.AgentCheck{
+				CheckID: serfCheckID,
+				Name:    "Serf Health Status",
+				Status:  status,
+				Output:  output,
+			},
+		})
+		changed = true
+	}
+	return changed
+}
+
+// snapshot writes a snapshot marker into each server's data dir once enough
+// writes have gone by, which is what tools look for to know that the state
+// has been compacted.
+func (s *state) snapshot() {
+	if s.Index-s.Snapshot < snapshotInterval {
+		return
+	}
+	s.Snapshot = s.Index
+
+	name := fmt.Sprintf("1-%d-%d", s.Index, time.Now().UnixNano()/int64(time.Millisecond))
+	for _, m := range s.servers() {
+		dir := filepath.Join(m.DataDir, "raft", "snapshots", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("[ERR] fake: Failed to write snapshot: %v", err)
+			continue
+		}
+		meta := fmt.Sprintf(`{"Index":%d,"Term":1}`, s.Index)
+		if err := ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(meta), 0644); err != nil {
+			log.Printf("[ERR] fake: Failed to write snapshot: %v", err)
+		}
+	}
+}
+
+// store is the shared state file, guarded by an exclusive lock on a file
+// next to it.
+type store struct {
+	path string
+}
+
+// update locks the state and calls fn with it, after making sure the
+// leadership is current. The state is saved afterwards if fn says it made
+// changes.
+func (s *store) update(fn func(*state) (bool, error)) error {
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	dirty := st.elect()
+	changed, err := fn(st)
+	if !dirty && !changed {
+		return err
+	}
+
+	st.snapshot()
+	if saveErr := s.save(st); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+func (s *store) load() (*state, error) {
+	st := newState()
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, st); err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %v", s.path, err)
+	}
+	return st, nil
+}
+
+// save writes the state to a temporary file and renames it into place, so
+// a killed agent can't leave a partial file behind.
+func (s *store) save(st *state) error {
+	content, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
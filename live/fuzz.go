@@ -1,204 +1,555 @@
 package live
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
 )
 
+// coordinateSettleTime is how long we give the servers to apply a coordinate
+// update, since they are batched up and written periodically.
+const coordinateSettleTime = 30 * time.Second
+
 type verifier func() error
 
 type Fuzz struct {
-	Client  *api.Client
-	Checks  []verifier
+	// Client is used for every request, and can be changed between calls,
+	// such as to verify a cluster restored from a snapshot.
+	Client *api.Client
+
+	// Token is the management token used for ACL operations and for
+	// reading everything back, defaults to "root".
+	Token string
+
+	// Model tracks the expected state of everything the fuzzer has written
+	// to the catalog, KV store, sessions and ACLs.
+	Model *Model
+
+	// Checks holds verifiers for the things the model doesn't cover, keyed
+	// by the object they check.
+	Checks  map[string]verifier
 	Counter int
+
+	// Seed drives every random choice the fuzzer makes, so a run can be
+	// reproduced by using the same seed.
+	Seed int64
+	rand *rand.Rand
+
+	indexes indexTracker
+
+	// These are the objects that are free to be changed or deleted, since
+	// no other objects depend on them.
+	nodes    []*api.CatalogRegistration
+	keys     []*api.KVPair
+	sessions []*api.SessionEntry
+	acls     []*api.ACLEntry
 }
 
-func NewFuzz(client *api.Client) (*Fuzz, error) {
-	f := &Fuzz{Client: client}
+func NewFuzz(client *api.Client, seed int64) (*Fuzz, error) {
+	f := &Fuzz{
+		Client:  client,
+		Token:   "root",
+		Model:   NewModel(),
+		Checks:  make(map[string]verifier),
+		Seed:    seed,
+		rand:    rand.New(rand.NewSource(seed)),
+		indexes: make(indexTracker),
+	}
 	return f, nil
 }
 
 func (f *Fuzz) Populate() error {
-	if _, err := f.fuzzRegister(); err != nil {
+	if err := f.populate(); err != nil {
+		return fmt.Errorf("fuzz populate failed (seed %d): %v", f.Seed, err)
+	}
+	return nil
+}
+
+func (f *Fuzz) populate() error {
+	reg, err := f.fuzzRegister()
+	if err != nil {
+		return err
+	}
+	f.nodes = append(f.nodes, reg)
+
+	s, err := f.fuzzSession()
+	if err != nil {
+		return err
+	}
+	f.sessions = append(f.sessions, s)
+
+	p, err := f.fuzzKV()
+	if err != nil {
 		return err
 	}
-	if _, err := f.fuzzSession(); err != nil {
+	f.keys = append(f.keys, p)
+
+	a, err := f.fuzzACL()
+	if err != nil {
 		return err
 	}
-	if _, err := f.fuzzKV(); err != nil {
+	f.acls = append(f.acls, a)
+
+	if _, err := f.fuzzPreparedQuery(); err != nil {
 		return err
 	}
-	if _, err := f.fuzzACL(); err != nil {
+	if _, err := f.fuzzLock(); err != nil {
 		return err
 	}
+	if _, err := f.fuzzSemaphore(); err != nil {
+		return err
+	}
+	if _, err := f.fuzzCoordinate(); err != nil {
+		return err
+	}
+
+	// Change or delete some of the objects we've made so far.
+	for i := 0; i < 2; i++ {
+		if err := f.fuzzMutate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (f *Fuzz) Verify() error {
-	log.Printf("Running %d fuzz checks...", len(f.Checks))
-	for _, f := range f.Checks {
-		if err := f(); err != nil {
+	log.Printf("Comparing %d modelled objects and running %d fuzz checks...", f.Model.Size(), len(f.Checks))
+	dump, err := f.Model.Dump(f.Client, f.Token)
+	if err != nil {
+		return fmt.Errorf("fuzz dump failed (seed %d): %v", f.Seed, err)
+	}
+	if err := diffError(f.Model.Diff(dump)); err != nil {
+		return fmt.Errorf("fuzz verify failed (seed %d): %v", f.Seed, err)
+	}
+	if err := f.checkIndexes(dump); err != nil {
+		return fmt.Errorf("fuzz verify failed (seed %d): %v", f.Seed, err)
+	}
+
+	var names []string
+	for name := range f.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := f.Checks[name](); err != nil {
+			return fmt.Errorf("fuzz verify failed (seed %d): %s: %v", f.Seed, name, err)
+		}
+	}
+	return nil
+}
+
+// checkIndexes makes sure none of the dumped objects' indexes went backwards
+// since the last verify.
+func (f *Fuzz) checkIndexes(dump *Model) error {
+	for name, node := range dump.Nodes {
+		if err := f.indexes.check("node "+name, node.ModifyIndex); err != nil {
+			return err
+		}
+		for id, service := range node.Services {
+			if err := f.indexes.check("service "+id, service.ModifyIndex); err != nil {
+				return err
+			}
+		}
+	}
+	for key, pair := range dump.Keys {
+		if err := f.indexes.check("key "+key, pair.ModifyIndex); err != nil {
+			return err
+		}
+	}
+	for id, s := range dump.Sessions {
+		if err := f.indexes.check("session "+id, s.CreateIndex); err != nil {
+			return err
+		}
+	}
+	for id, a := range dump.ACLs {
+		if err := f.indexes.check("ACL "+id, a.ModifyIndex); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// check sets the verifier for the given object, replacing any existing one.
+func (f *Fuzz) check(name string, v verifier) {
+	f.Checks[name] = v
+}
+
 func (f *Fuzz) generateName(base string) string {
 	f.Counter++
-	return fmt.Sprintf("%s%d", base, f.Counter)
+	return fmt.Sprintf("%s%d-%s", base, f.Counter, f.generateString(6))
+}
+
+// generateString returns a random string of lowercase letters and digits,
+// which is safe to use in names and keys.
+func (f *Fuzz) generateString(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = chars[f.rand.Intn(len(chars))]
+	}
+	return string(buf)
+}
+
+// generateValue returns a random binary value of up to the given size.
+func (f *Fuzz) generateValue(max int) []byte {
+	buf := make([]byte, f.rand.Intn(max+1))
+	f.rand.Read(buf)
+	return buf
+}
+
+// indexTracker makes sure the Raft indexes we see for an object never go
+// backwards between verifications.
+type indexTracker map[string]uint64
+
+func (t indexTracker) check(what string, index uint64) error {
+	if index == 0 {
+		return fmt.Errorf("%s has a zero index", what)
+	}
+	if last, ok := t[what]; ok && index < last {
+		return fmt.Errorf("%s index went backwards from %d to %d", what, last, index)
+	}
+	t[what] = index
+	return nil
+}
+
+func (f *Fuzz) generateTags() []string {
+	var tags []string
+	for i := f.rand.Intn(4); i > 0; i-- {
+		tags = append(tags, f.generateString(8))
+	}
+	return tags
+}
+
+func (f *Fuzz) generateAddress() string {
+	return fmt.Sprintf("127.0.%d.%d", f.rand.Intn(256), 1+f.rand.Intn(254))
+}
+
+func (f *Fuzz) generateStatus(allowCritical bool) string {
+	statuses := []string{api.HealthPassing, api.HealthWarning}
+	if allowCritical {
+		statuses = append(statuses, api.HealthCritical)
+	}
+	return statuses[f.rand.Intn(len(statuses))]
 }
 
 func (f *Fuzz) fuzzRegister() (*api.CatalogRegistration, error) {
 	reg := &api.CatalogRegistration{
 		Node:    f.generateName("node"),
 		Address: "127.0.0.1",
+		TaggedAddresses: map[string]string{
+			"wan": f.generateAddress(),
+		},
+		NodeMeta: map[string]string{
+			"fuzz": f.generateString(12),
+		},
 		Service: &api.AgentService{
-			Service: f.generateName("service"),
-			Port:    1234,
+			ID:                f.generateName("service-id"),
+			Service:           f.generateName("service"),
+			Tags:              f.generateTags(),
+			Address:           f.generateAddress(),
+			Port:              1024 + f.rand.Intn(64511),
+			EnableTagOverride: f.rand.Intn(2) == 0,
 		},
 		Check: &api.AgentCheck{
-			Name:   f.generateName("check"),
-			Status: "passing",
+			CheckID: f.generateName("check-id"),
+			Name:    f.generateName("check"),
+			Status:  f.generateStatus(false),
+			Notes:   f.generateString(f.rand.Intn(32)),
+			Output:  f.generateString(f.rand.Intn(256)),
 		},
 	}
+	reg.Check.ServiceID = reg.Service.ID
 
-	catalog := f.Client.Catalog()
-	if _, err := catalog.Register(reg, &api.WriteOptions{}); err != nil {
+	if _, err := f.Client.Catalog().Register(reg, &api.WriteOptions{}); err != nil {
 		return nil, err
 	}
+	f.Model.Register(reg)
+	return reg, nil
+}
 
-	f.Checks = append(f.Checks, func() error {
-		node, _, err := catalog.Node(reg.Node, &api.QueryOptions{})
-		if err != nil {
-			return err
-		}
-		if node.Node.Node != reg.Node || node.Node.Address != reg.Address {
-			return fmt.Errorf("bad: %v", node)
-		}
-		if _, ok := node.Services[reg.Service.Service]; !ok {
-			return fmt.Errorf("bad: %v", node)
-		}
+func (f *Fuzz) fuzzSession() (*api.SessionEntry, error) {
+	reg, err := f.fuzzRegister()
+	if err != nil {
+		return nil, err
+	}
 
-		services, _, err := catalog.Service(reg.Service.Service, "", &api.QueryOptions{})
-		if err != nil {
-			return err
-		}
-		if len(services) != 1 {
-			return fmt.Errorf("bad: %v", services)
-		}
-		service := services[0]
-		if service.Node != reg.Node ||
-			service.ServiceName != reg.Service.Service ||
-			service.ServicePort != reg.Service.Port {
-			return fmt.Errorf("bad: %v", service)
-		}
+	// Lock delays are never zero, since the api package leaves a zero delay
+	// out of the request and Consul would fill in its 15s default. TTLs are
+	// long enough that sessions won't expire during a run, but still get
+	// persisted and restored along with the rest of the session.
+	behaviors := []string{api.SessionBehaviorRelease, api.SessionBehaviorDelete}
+	s := &api.SessionEntry{
+		Name:      f.generateName("session"),
+		Node:      reg.Node,
+		Checks:    []string{reg.Check.CheckID},
+		LockDelay: time.Duration(1+f.rand.Intn(59)) * time.Second,
+		Behavior:  behaviors[f.rand.Intn(len(behaviors))],
+	}
+	if f.rand.Intn(2) == 0 {
+		s.TTL = fmt.Sprintf("%ds", 3600+f.rand.Intn(82800))
+	}
 
-		health := f.Client.Health()
-		checks, _, err := health.Node(reg.Node, &api.QueryOptions{})
-		if err != nil {
-			return err
-		}
-		if len(checks) != 1 {
-			return fmt.Errorf("bad: %v", checks)
-		}
-		check := checks[0]
-		if check.Node != reg.Node ||
-			check.Name != reg.Check.Name ||
-			check.Status != reg.Check.Status {
-			return fmt.Errorf("bad: %v", check)
-		}
-		return nil
-	})
+	id, _, err := f.Client.Session().Create(s, &api.WriteOptions{})
+	if err != nil {
+		return nil, err
+	}
+	s.ID = id
+	f.Model.CreateSession(s)
+	return s, nil
+}
 
-	return reg, nil
+func (f *Fuzz) fuzzKV() (*api.KVPair, error) {
+	p := &api.KVPair{
+		Key:   f.generateName("key"),
+		Flags: uint64(f.rand.Int63()),
+		Value: f.generateValue(512),
+	}
+
+	if _, err := f.Client.KV().Put(p, &api.WriteOptions{}); err != nil {
+		return nil, err
+	}
+	f.Model.Put(p)
+	return p, nil
+}
+
+func (f *Fuzz) generateRules() string {
+	return fmt.Sprintf("key %q { policy = \"read\" }", f.generateName("key"))
 }
 
-func (f *Fuzz) fuzzSession() (string, error) {
+func (f *Fuzz) fuzzACL() (*api.ACLEntry, error) {
+	a := &api.ACLEntry{
+		Name:  f.generateName("acl"),
+		Type:  api.ACLClientType,
+		Rules: f.generateRules(),
+	}
+
+	id, _, err := f.Client.ACL().Create(a, &api.WriteOptions{Token: f.Token})
+	if err != nil {
+		return nil, err
+	}
+	a.ID = id
+	f.Model.SetACL(a)
+	return a, nil
+}
+
+func (f *Fuzz) fuzzPreparedQuery() (string, error) {
 	reg, err := f.fuzzRegister()
 	if err != nil {
 		return "", err
 	}
 
-	s := &api.SessionEntry{
-		Node:   reg.Node,
-		Checks: []string{reg.Check.Name},
+	def := &api.PreparedQueryDefinition{
+		Name: f.generateName("query"),
+		Service: api.ServiceQuery{
+			Service: reg.Service.Service,
+		},
 	}
 
-	session := f.Client.Session()
-	id, _, err := session.Create(s, &api.WriteOptions{})
+	id, _, err := f.Client.PreparedQuery().Create(def, &api.WriteOptions{})
 	if err != nil {
 		return "", err
 	}
 
-	f.Checks = append(f.Checks, func() error {
-		entries, _, err := session.Node(reg.Node, &api.QueryOptions{})
+	// Checks use the fuzzer's current client, which may have been pointed
+	// at another cluster since.
+	f.check("query/"+id, func() error {
+		query := f.Client.PreparedQuery()
+		defs, _, err := query.Get(id, &api.QueryOptions{})
 		if err != nil {
 			return err
 		}
-		if len(entries) != 1 {
-			return fmt.Errorf("bad: %v", entries)
+		if len(defs) != 1 {
+			return fmt.Errorf("bad: %v", defs)
 		}
-		entry := entries[0]
-		if entry.ID != id || entry.Node != reg.Node {
+		entry := defs[0]
+		if entry.ID != id ||
+			entry.Name != def.Name ||
+			entry.Service.Service != def.Service.Service {
 			return fmt.Errorf("bad: %v", entry)
 		}
+
+		// Execute it by name to make sure the name index and the
+		// service lookup both work.
+		results, _, err := query.Execute(def.Name, &api.QueryOptions{})
+		if err != nil {
+			return err
+		}
+		if results.Service != reg.Service.Service || len(results.Nodes) != 1 {
+			return fmt.Errorf("bad: %v", results)
+		}
+		result := results.Nodes[0]
+		if result.Node.Node != reg.Node ||
+			result.Service.Service != reg.Service.Service ||
+			result.Service.Port != reg.Service.Port {
+			return fmt.Errorf("bad: %v", result)
+		}
 		return nil
 	})
 
 	return id, nil
 }
 
-func (f *Fuzz) fuzzKV() (*api.KVPair, error) {
+func (f *Fuzz) fuzzLock() (*api.KVPair, error) {
+	s, err := f.fuzzSession()
+	if err != nil {
+		return nil, err
+	}
+
 	p := &api.KVPair{
-		Key:   f.generateName("key"),
-		Value: []byte(f.generateName("value")),
+		Key:     f.generateName("lock"),
+		Value:   f.generateValue(64),
+		Flags:   api.LockFlagValue,
+		Session: s.ID,
 	}
 
-	kv := f.Client.KV()
-	_, err := kv.Put(p, &api.WriteOptions{})
+	ok, _, err := f.Client.KV().Acquire(p, &api.WriteOptions{})
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, fmt.Errorf("failed to acquire lock %q", p.Key)
+	}
+	f.Model.Acquire(p)
+	return p, nil
+}
 
-	f.Checks = append(f.Checks, func() error {
-		pair, _, err := kv.Get(p.Key, &api.QueryOptions{})
+// semaphoreLock mirrors the lock entry the api package's semaphore uses to
+// track holders.
+type semaphoreLock struct {
+	Limit   int
+	Holders map[string]bool
+}
+
+func (f *Fuzz) fuzzSemaphore() (string, error) {
+	const holders = 2
+
+	prefix := f.generateName("semaphore")
+	lock := &semaphoreLock{
+		Limit:   holders,
+		Holders: make(map[string]bool),
+	}
+
+	kv := f.Client.KV()
+	for i := 0; i < holders; i++ {
+		s, err := f.fuzzSession()
 		if err != nil {
-			return err
+			return "", err
 		}
-		if pair.Key != p.Key || string(pair.Value) != string(p.Value) {
-			return fmt.Errorf("bad: %v", pair)
+
+		contender := &api.KVPair{
+			Key:     fmt.Sprintf("%s/%s", prefix, s.ID),
+			Flags:   api.SemaphoreFlagValue,
+			Session: s.ID,
 		}
-		return nil
-	})
+		ok, _, err := kv.Acquire(contender, &api.WriteOptions{})
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("failed to acquire contender %q", contender.Key)
+		}
+		f.Model.Acquire(contender)
+		lock.Holders[s.ID] = true
+	}
 
-	return p, nil
+	value, err := json.Marshal(lock)
+	if err != nil {
+		return "", err
+	}
+	p := &api.KVPair{
+		Key:   fmt.Sprintf("%s/%s", prefix, api.DefaultSemaphoreKey),
+		Value: value,
+		Flags: api.SemaphoreFlagValue,
+	}
+	ok, _, err := kv.CAS(p, &api.WriteOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("failed to create semaphore lock %q", p.Key)
+	}
+	f.Model.Put(p)
+	return prefix, nil
 }
 
-func (f *Fuzz) fuzzACL() (string, error) {
-	a := &api.ACLEntry{
-		Name: f.generateName("acl"),
-		Type: "client",
-	}
+// coordinateUpdate is the body for the coordinate update endpoint, which the
+// api package doesn't wrap.
+type coordinateUpdate struct {
+	Node  string
+	Coord *coordinate.Coordinate
+}
 
-	acl := f.Client.ACL()
-	id, _, err := acl.Create(a, &api.WriteOptions{Token: "root"})
+func (f *Fuzz) fuzzCoordinate() (*coordinate.Coordinate, error) {
+	reg, err := f.fuzzRegister()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	f.Checks = append(f.Checks, func() error {
-		entry, _, err := acl.Info(id, &api.QueryOptions{})
-		if err != nil {
-			return err
-		}
-		if entry.ID != id || entry.Name != a.Name {
-			return fmt.Errorf("bad: %v", entry)
+	coord := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	for i := range coord.Vec {
+		coord.Vec[i] = f.rand.NormFloat64() / 100.0
+	}
+	coord.Error = f.rand.Float64()
+	coord.Adjustment = f.rand.Float64() / 1000.0
+	coord.Height = f.rand.Float64() / 1000.0
+
+	update := &coordinateUpdate{
+		Node:  reg.Node,
+		Coord: coord,
+	}
+	if _, err := f.Client.Raw().Write("/v1/coordinate/update", update, nil, &api.WriteOptions{}); err != nil {
+		return nil, err
+	}
+
+	written := time.Now()
+	f.check("coordinate/"+reg.Node, func() error {
+		for {
+			entries, _, err := f.Client.Coordinate().Nodes(&api.QueryOptions{})
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.Node != reg.Node {
+					continue
+				}
+				if !reflect.DeepEqual(entry.Coord, coord) {
+					return fmt.Errorf("bad: %v", entry.Coord)
+				}
+				return nil
+			}
+
+			// Updates are applied in batches, so give the servers a
+			// chance to catch up with recent ones.
+			if time.Now().Sub(written) > coordinateSettleTime {
+				return fmt.Errorf("missing coordinate for node %q", reg.Node)
+			}
+			time.Sleep(time.Second)
 		}
-		return nil
 	})
 
-	return id, nil
+	return coord, nil
+}
+
+// sameStrings compares two string slices, treating nil and empty the same.
+func sameStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// sameMap compares two string maps, treating nil and empty the same.
+func sameMap(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
 }
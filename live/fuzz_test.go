@@ -0,0 +1,62 @@
+package live
+
+import (
+	"testing"
+)
+
+func TestFuzz_PopulateVerify(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 1, ServerArgs: aclServerArgs})
+
+	// Several seeds make sure verification doesn't depend on lucky random
+	// choices.
+	for seed := int64(1); seed <= 3; seed++ {
+		fuzz, err := NewFuzz(cluster.Client, seed)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := fuzz.Populate(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if err := fuzz.Verify(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if fuzz.Model.Size() == 0 {
+			t.Fatalf("nothing was modelled")
+		}
+	}
+}
+
+func TestFuzz_VerifyCatchesChanges(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 1, ServerArgs: aclServerArgs})
+
+	fuzz, err := NewFuzz(cluster.Client, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := fuzz.Populate(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := fuzz.Verify(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deleting a key behind the fuzzer's back should be caught.
+	var key string
+	for k := range fuzz.Model.Keys {
+		key = k
+		break
+	}
+	if key == "" {
+		t.Fatalf("no keys were modelled")
+	}
+	if _, err := cluster.Client.KV().Delete(key, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fuzz.Verify(); err == nil {
+		t.Fatalf("should have failed")
+	}
+}
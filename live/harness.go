@@ -0,0 +1,129 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"time"
+)
+
+// TestingT is the part of testing.TB the test harness needs, so tests can
+// pass in their *testing.T without this package importing "testing".
+type TestingT interface {
+	Cleanup(func())
+	Failed() bool
+	Fatalf(format string, args ...interface{})
+	Helper()
+	Logf(format string, args ...interface{})
+}
+
+const (
+	// harnessTimeout is how long the test helpers wait for a cluster to
+	// settle down before failing the test.
+	harnessTimeout = 2 * time.Minute
+
+	// harnessLogLines is how much of each agent's log gets dumped into the
+	// test log when a test fails.
+	harnessLogLines = 200
+)
+
+// StartCluster makes and starts a cluster for a test and waits for it to be
+// stable. The cluster is shut down when the test finishes; if the test failed
+// then the tail of each agent's log is dumped to the test log and the data
+// dir is kept around. If the config doesn't give an executable then "consul"
+// is run from the PATH.
+func StartCluster(t TestingT, cfg *ClusterConfig) *Cluster {
+	t.Helper()
+
+	cc := *cfg
+	if cc.Executable == "" {
+		cc.Executable = "consul"
+	}
+	cluster, err := NewCluster(&cc)
+	if err != nil {
+		t.Fatalf("failed to make cluster: %v", err)
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			dumpLogs(t, cluster)
+		}
+		cluster.Preserve = t.Failed()
+		if err := cluster.Shutdown(); err != nil {
+			t.Logf("failed to shut down cluster: %v", err)
+		}
+	})
+
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+	RequireStable(t, cluster)
+	return cluster
+}
+
+// RequireStable waits for the cluster to be stable, failing the test if it
+// doesn't settle down in time.
+func RequireStable(t TestingT, cluster *Cluster) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), harnessTimeout)
+	defer cancel()
+	if err := cluster.WaitForStable(ctx); err != nil {
+		t.Fatalf("cluster isn't stable: %v", err)
+	}
+}
+
+// RequireLeader waits for the cluster to have a leader and returns it,
+// failing the test if there's no leader in time. This is handy after taking
+// out the old leader.
+func RequireLeader(t TestingT, cluster *Cluster) *Consul {
+	t.Helper()
+
+	var lastErr error
+	deadline := time.Now().Add(harnessTimeout)
+	for time.Now().Before(deadline) {
+		leader, err := cluster.Leader()
+		if err == nil && leader.Running() && !leader.Paused() {
+			return leader
+		}
+		lastErr = err
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("cluster doesn't have a leader after %s: %v", harnessTimeout, lastErr)
+	return nil
+}
+
+// dumpLogs writes the end of each agent's log to the test log.
+func dumpLogs(t TestingT, cluster *Cluster) {
+	for _, consul := range cluster.Agents {
+		lines, err := tailFile(consul.LogPath, harnessLogLines)
+		if err != nil {
+			t.Logf("failed to read log for %q: %v", consul.Name, err)
+			continue
+		}
+
+		t.Logf("Last %d lines of the log for %q (full log is in %q):", len(lines), consul.Name, consul.LogPath)
+		for _, line := range lines {
+			t.Logf("[%s] %s", consul.Name, line)
+		}
+	}
+}
+
+// tailFile returns up to the last n lines of the given file.
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,138 @@
+package live
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockT is a TestingT that records what happens to it. Fatalf stops the
+// calling goroutine like the real thing, so helpers have to be run with
+// mockT.run.
+type mockT struct {
+	mu       sync.Mutex
+	failed   bool
+	logs     []string
+	cleanups []func()
+}
+
+func (m *mockT) Cleanup(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanups = append(m.cleanups, fn)
+}
+
+func (m *mockT) Failed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed
+}
+
+func (m *mockT) Fatalf(format string, args ...interface{}) {
+	m.mu.Lock()
+	m.failed = true
+	m.logs = append(m.logs, fmt.Sprintf(format, args...))
+	m.mu.Unlock()
+	runtime.Goexit()
+}
+
+func (m *mockT) Helper() {}
+
+func (m *mockT) Logf(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logs = append(m.logs, fmt.Sprintf(format, args...))
+}
+
+// run calls fn in its own goroutine so Fatalf can stop it, and returns once
+// it's done.
+func (m *mockT) run(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	<-done
+}
+
+// finish runs the cleanups the way the testing package does, last first.
+func (m *mockT) finish() {
+	for i := len(m.cleanups) - 1; i >= 0; i-- {
+		m.cleanups[i]()
+	}
+}
+
+func (m *mockT) logged(s string) bool {
+	for _, line := range m.logs {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHarness_StartCluster(t *testing.T) {
+	cluster := StartCluster(t, &ClusterConfig{Executable: fakeConsul(t), Servers: 3})
+	RequireStable(t, cluster)
+
+	leader := RequireLeader(t, cluster)
+	if !leader.Server {
+		t.Fatalf("leader %q isn't a server", leader.Name)
+	}
+	if err := leader.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if next := RequireLeader(t, cluster); next == leader {
+		t.Fatalf("leader didn't change")
+	}
+
+	if err := leader.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	RequireStable(t, cluster)
+}
+
+func TestHarness_FailedTest(t *testing.T) {
+	m := &mockT{}
+	var cluster *Cluster
+	m.run(func() {
+		cluster = StartCluster(m, &ClusterConfig{Executable: fakeConsul(t), Servers: 1})
+	})
+	if m.Failed() || cluster == nil {
+		t.Fatalf("bad: %v", m.logs)
+	}
+	defer os.RemoveAll(cluster.DataDir)
+
+	// Failing the test should dump the agent logs and keep the data dir
+	// when the cluster is cleaned up.
+	m.failed = true
+	m.finish()
+	if cluster.Agents[0].Running() {
+		t.Fatalf("agent still running")
+	}
+	if !m.logged("Last") || !m.logged("["+cluster.Agents[0].Name+"]") {
+		t.Fatalf("logs weren't dumped: %v", m.logs)
+	}
+	if _, err := os.Stat(cluster.DataDir); err != nil {
+		t.Fatalf("data dir wasn't kept: %v", err)
+	}
+}
+
+func TestHarness_BadExecutable(t *testing.T) {
+	m := &mockT{}
+	m.run(func() {
+		StartCluster(m, &ClusterConfig{
+			Executable: filepath.Join(t.TempDir(), "nope"),
+			Servers:    1,
+		})
+		t.Errorf("should have stopped")
+	})
+	if !m.Failed() || !m.logged("failed to start cluster") {
+		t.Fatalf("bad: %v", m.logs)
+	}
+	m.finish()
+}
@@ -0,0 +1,125 @@
+package live
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// These are the kinds of KV operations a history can hold.
+const (
+	OpRead  = "read"
+	OpWrite = "write"
+	OpCAS   = "cas"
+)
+
+// KVOp is a single operation against a key, from when a client invoked it to
+// when it got a response.
+type KVOp struct {
+	Client int    `json:"client"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+
+	// Value is the value written for writes and CAS operations, and the
+	// value seen for reads, where Found says whether the key existed.
+	Value string `json:"value"`
+	Found bool   `json:"found"`
+
+	// Expect is the value a CAS operation expects the key to have, where
+	// ExpectFound says whether the key is expected to exist. OK says
+	// whether the CAS was applied.
+	Expect      string `json:"expect,omitempty"`
+	ExpectFound bool   `json:"expect_found,omitempty"`
+	OK          bool   `json:"ok,omitempty"`
+
+	// Unknown is set if the operation failed in a way that leaves us not
+	// knowing whether it was applied, such as a timeout.
+	Unknown bool `json:"unknown,omitempty"`
+
+	// Call and Return are in nanoseconds since the start of the history.
+	Call   int64 `json:"call"`
+	Return int64 `json:"return"`
+}
+
+// unknown returns true if we don't know the outcome of the operation, either
+// because it failed or because it never got a response.
+func (op *KVOp) unknown() bool {
+	return op.Unknown || op.Return == 0
+}
+
+// History records KV operations from concurrent clients.
+type History struct {
+	Ops []*KVOp
+
+	start time.Time
+	lock  sync.Mutex
+}
+
+func NewHistory() *History {
+	return &History{
+		start: time.Now(),
+	}
+}
+
+// Invoke records the start of an operation. The caller fills in the rest of
+// the operation and then calls Complete or Fail.
+func (h *History) Invoke(client int, kind, key string) *KVOp {
+	op := &KVOp{
+		Client: client,
+		Kind:   kind,
+		Key:    key,
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	op.Call = h.now()
+	h.Ops = append(h.Ops, op)
+	return op
+}
+
+// Complete records the response for an operation.
+func (h *History) Complete(op *KVOp) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	op.Return = h.now()
+}
+
+// Fail records that an operation got an error, so we don't know if it was
+// applied.
+func (h *History) Fail(op *KVOp) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	op.Return = h.now()
+	op.Unknown = true
+}
+
+func (h *History) now() int64 {
+	return time.Now().Sub(h.start).Nanoseconds()
+}
+
+// Write saves the history as JSON.
+func (h *History) Write(path string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	buf, err := json.MarshalIndent(h.Ops, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// ReadHistory loads a history saved by Write.
+func ReadHistory(path string) (*History, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &History{}
+	if err := json.Unmarshal(buf, &h.Ops); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
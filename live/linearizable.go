@@ -0,0 +1,234 @@
+package live
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CheckLinearizable checks a KV history for linearizability, treating each
+// key as an independent register. It returns the keys whose operations can't
+// be linearized, sorted.
+//
+// This uses the Wing & Gong search with Lowe's memoization, the same approach
+// as Knossos. Operations with an unknown outcome are given a return time of
+// infinity, so they may take effect at any point after they were invoked, or
+// not at all. Reads with an unknown outcome tell us nothing so they are
+// dropped. CAS operations are checked by value, so every value written to a
+// key should be unique.
+func CheckLinearizable(h *History) []string {
+	byKey := make(map[string][]*KVOp)
+	for _, op := range h.Ops {
+		if op.unknown() && op.Kind == OpRead {
+			continue
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	var bad []string
+	for key, ops := range byKey {
+		if !checkRegister(ops) {
+			bad = append(bad, key)
+		}
+	}
+	sort.Strings(bad)
+	return bad
+}
+
+// register is the state of a single key.
+type register struct {
+	Value string
+	Found bool
+}
+
+// step applies an operation to the register, returning the new state and
+// whether the operation's result is consistent with the old state.
+func (r register) step(op *KVOp) (register, bool) {
+	unknown := op.unknown()
+	switch op.Kind {
+	case OpRead:
+		return r, r.Found == op.Found && r.Value == op.Value
+
+	case OpWrite:
+		return register{op.Value, true}, true
+
+	case OpCAS:
+		match := r.Found == op.ExpectFound && r.Value == op.Expect
+		switch {
+		case unknown && match:
+			return register{op.Value, true}, true
+		case unknown:
+			return r, true
+		case op.OK:
+			return register{op.Value, true}, match
+		default:
+			return r, !match
+		}
+
+	default:
+		return r, false
+	}
+}
+
+// event is a call or return in the time-ordered list that the search walks.
+type event struct {
+	id    int
+	call  bool
+	time  int64
+	match *event
+	prev  *event
+	next  *event
+}
+
+// lift removes a call and its matching return from the list.
+func (e *event) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts a call and its matching return back where they were.
+func (e *event) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key(r register) string {
+	buf := make([]byte, 0, 8*len(b)+len(r.Value)+1)
+	for _, word := range b {
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, byte(word>>i))
+		}
+	}
+	if r.Found {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return string(append(buf, r.Value...))
+}
+
+// checkRegister runs the search for the operations on a single key.
+func checkRegister(ops []*KVOp) bool {
+	var events []*event
+	for i, op := range ops {
+		ret := op.Return
+		if op.unknown() {
+			ret = math.MaxInt64
+		}
+		call := &event{id: i, call: true, time: op.Call}
+		call.match = &event{id: i, time: ret}
+		events = append(events, call, call.match)
+	}
+
+	// Calls sort ahead of returns with the same time, which treats the
+	// operations as concurrent.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	type frame struct {
+		e     *event
+		state register
+	}
+	var (
+		state      register
+		stack      []frame
+		linearized = newBitset(len(ops))
+		seen       = make(map[string]bool)
+	)
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			next, ok := state.step(ops[e.id])
+			if ok {
+				linearized.set(e.id)
+				k := linearized.key(next)
+				if !seen[k] {
+					seen[k] = true
+					stack = append(stack, frame{e, state})
+					state = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.id)
+			}
+			e = e.next
+			continue
+		}
+
+		// We hit a return for an operation we couldn't linearize, so
+		// back out the last operation we did and try the next one.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.e.id)
+		top.e.unlift()
+		e = top.e.next
+	}
+	return true
+}
+
+// FormatOp returns a readable description of an operation for reports.
+func FormatOp(op *KVOp) string {
+	var desc string
+	switch op.Kind {
+	case OpRead:
+		if op.Found {
+			desc = fmt.Sprintf("read %q", op.Value)
+		} else {
+			desc = "read <none>"
+		}
+	case OpWrite:
+		desc = fmt.Sprintf("write %q", op.Value)
+	case OpCAS:
+		expect := "<none>"
+		if op.ExpectFound {
+			expect = fmt.Sprintf("%q", op.Expect)
+		}
+		desc = fmt.Sprintf("cas %s -> %q ok=%v", expect, op.Value, op.OK)
+	default:
+		desc = op.Kind
+	}
+
+	ret := fmt.Sprintf("%.6fs", float64(op.Return)/1e9)
+	if op.unknown() {
+		desc += " (unknown)"
+		ret = "?"
+	}
+	return fmt.Sprintf("[%.6fs, %s] client %d %s", float64(op.Call)/1e9, ret, op.Client, desc)
+}
@@ -0,0 +1,127 @@
+package live
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// These build ops on key "k" for the tables below. A ret of 0 means the op
+// never returned, so its outcome is unknown.
+func read(call, ret int64, value string) *KVOp {
+	return &KVOp{Kind: OpRead, Key: "k", Value: value, Found: value != "", Call: call, Return: ret}
+}
+
+func write(call, ret int64, value string) *KVOp {
+	return &KVOp{Kind: OpWrite, Key: "k", Value: value, Call: call, Return: ret}
+}
+
+func cas(call, ret int64, expect, value string, ok bool) *KVOp {
+	return &KVOp{
+		Kind:        OpCAS,
+		Key:         "k",
+		Value:       value,
+		Expect:      expect,
+		ExpectFound: expect != "",
+		OK:          ok,
+		Call:        call,
+		Return:      ret,
+	}
+}
+
+// failed marks an op as having got an error, so its outcome is unknown even
+// though it returned.
+func failed(op *KVOp) *KVOp {
+	op.Unknown = true
+	return op
+}
+
+func TestCheckLinearizable_Register(t *testing.T) {
+	cases := []struct {
+		name string
+		ops  []*KVOp
+		ok   bool
+	}{
+		{"empty", nil, true},
+		{"read missing key", []*KVOp{read(1, 2, "")}, true},
+		{"write then read", []*KVOp{write(1, 2, "a"), read(3, 4, "a")}, true},
+		{"read value never written", []*KVOp{write(1, 2, "a"), read(3, 4, "b")}, false},
+		{"read missing after write", []*KVOp{write(1, 2, "a"), read(3, 4, "")}, false},
+		{"stale read", []*KVOp{write(1, 2, "a"), write(3, 4, "b"), read(5, 6, "a")}, false},
+
+		// Concurrent overlaps.
+		{"read during write sees old", []*KVOp{write(1, 10, "a"), read(2, 3, ""), read(4, 5, "a")}, true},
+		{"read during write sees new", []*KVOp{write(1, 10, "a"), read(2, 3, "a")}, true},
+		{"reads during write go back", []*KVOp{write(1, 10, "a"), read(2, 3, "a"), read(4, 5, "")}, false},
+		{"concurrent writes either order", []*KVOp{write(1, 5, "a"), write(2, 6, "b"), read(7, 8, "a")}, true},
+		{"concurrent writes both orders", []*KVOp{write(1, 5, "a"), write(2, 6, "b"), read(7, 8, "a"), read(9, 10, "b")}, false},
+		{"concurrent reads disagree", []*KVOp{write(1, 2, "a"), write(3, 10, "b"), read(4, 9, "b"), read(5, 8, "a")}, true},
+		{"same call and return time is concurrent", []*KVOp{write(1, 5, "a"), read(5, 6, "")}, true},
+
+		// CAS.
+		{"cas applied", []*KVOp{write(1, 2, "a"), cas(3, 4, "a", "b", true), read(5, 6, "b")}, true},
+		{"cas applied on missing key", []*KVOp{cas(1, 2, "", "a", true), read(3, 4, "a")}, true},
+		{"cas applied with wrong expect", []*KVOp{write(1, 2, "a"), cas(3, 4, "x", "b", true)}, false},
+		{"cas rejected with right expect", []*KVOp{write(1, 2, "a"), cas(3, 4, "a", "b", false)}, false},
+		{"cas rejected with wrong expect", []*KVOp{write(1, 2, "a"), cas(3, 4, "x", "b", false), read(5, 6, "a")}, true},
+		{"cas rejected but value changed", []*KVOp{write(1, 2, "a"), cas(3, 4, "x", "b", false), read(5, 6, "b")}, false},
+		{"concurrent cas both applied", []*KVOp{write(1, 2, "a"), cas(3, 6, "a", "b", true), cas(4, 7, "a", "c", true)}, false},
+		{"concurrent cas one applied", []*KVOp{write(1, 2, "a"), cas(3, 6, "a", "b", true), cas(4, 7, "a", "c", false), read(8, 9, "b")}, true},
+
+		// Unknown outcomes.
+		{"unknown write applied", []*KVOp{write(1, 0, "a"), read(5, 6, "a")}, true},
+		{"unknown write not applied", []*KVOp{write(1, 2, "a"), failed(write(3, 4, "b")), read(5, 6, "a")}, true},
+		{"unknown write applied late", []*KVOp{write(1, 0, "a"), read(5, 6, ""), read(7, 8, "a")}, true},
+		{"unknown write can't undo", []*KVOp{write(1, 2, "a"), write(3, 0, "b"), read(5, 6, "b"), read(7, 8, "a")}, false},
+		{"unknown write before invoke", []*KVOp{read(1, 2, "a"), write(3, 0, "a")}, false},
+		{"unknown cas applied", []*KVOp{write(1, 2, "a"), failed(cas(3, 4, "a", "b", false)), read(5, 6, "b")}, true},
+		{"unknown cas not applied", []*KVOp{write(1, 2, "a"), cas(3, 0, "a", "b", false), read(5, 6, "a")}, true},
+		{"unknown cas with wrong expect", []*KVOp{write(1, 2, "a"), cas(3, 0, "x", "b", false), read(5, 6, "b")}, false},
+		{"unknown read is dropped", []*KVOp{write(1, 2, "a"), failed(read(3, 4, "zzz"))}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bad := CheckLinearizable(&History{Ops: tc.ops})
+			if ok := len(bad) == 0; ok != tc.ok {
+				t.Fatalf("bad: linearizable=%v, want %v", ok, tc.ok)
+			}
+		})
+	}
+}
+
+func TestCheckLinearizable_Keys(t *testing.T) {
+	var ops []*KVOp
+	add := func(key string, op *KVOp) {
+		op.Key = key
+		ops = append(ops, op)
+	}
+	add("good", write(1, 2, "a"))
+	add("good", read(3, 4, "a"))
+	add("bad2", write(1, 2, "a"))
+	add("bad2", read(3, 4, "b"))
+	add("bad1", read(1, 2, "a"))
+
+	bad := CheckLinearizable(&History{Ops: ops})
+	if want := []string{"bad1", "bad2"}; !reflect.DeepEqual(bad, want) {
+		t.Fatalf("bad: %v", bad)
+	}
+}
+
+func TestCheckLinearizable_ManyConcurrent(t *testing.T) {
+	// Without memoization this would try every ordering of the writes, and
+	// the failing case has to rule out every subset of them.
+	var ops []*KVOp
+	for i := 0; i < 12; i++ {
+		ops = append(ops, write(1, 100, fmt.Sprintf("v%d", i)))
+	}
+	ops = append(ops, read(101, 102, "v7"), read(103, 104, "v7"))
+	if bad := CheckLinearizable(&History{Ops: ops}); len(bad) != 0 {
+		t.Fatalf("bad: %v", bad)
+	}
+
+	ops = append(ops, read(105, 106, "v3"))
+	if bad := CheckLinearizable(&History{Ops: ops}); len(bad) != 1 {
+		t.Fatalf("bad: %v", bad)
+	}
+}
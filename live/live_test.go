@@ -0,0 +1,66 @@
+package live
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-live/live/fakeconsul"
+)
+
+// TestMain runs the fake agent when the test binary is started as an agent,
+// so the tests can run clusters without a real Consul.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_CONSUL") == "1" {
+		os.Exit(fakeconsul.Main(os.Args[1:]))
+	}
+	os.Setenv("FAKE_CONSUL", "1")
+	os.Exit(m.Run())
+}
+
+// fakeConsul returns the executable to run fake agents with.
+func fakeConsul(t *testing.T) string {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return exe
+}
+
+// testCluster makes and starts a cluster of fake agents, which is shut down
+// when the test finishes.
+func testCluster(t *testing.T, cfg *ClusterConfig) *Cluster {
+	cfg.Executable = fakeConsul(t)
+	cluster, err := NewCluster(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() {
+		cluster.Preserve = t.Failed()
+		if err := cluster.Shutdown(); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	})
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForStable(t, cluster)
+	return cluster
+}
+
+func waitForStable(t *testing.T, cluster *Cluster) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := cluster.WaitForStable(ctx); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// aclServerArgs turn on ACLs with "root" as the master token, which the
+// fuzzer needs.
+var aclServerArgs = []string{
+	"-hcl", `acl_datacenter="dc1"`,
+	"-hcl", `acl_master_token="root"`,
+	"-hcl", `acl_default_policy="allow"`,
+}
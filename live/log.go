@@ -0,0 +1,46 @@
+package live
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// prefixWriter writes each complete line it's given to an underlying writer
+// with a fixed prefix, so output from several agents can share a stream and
+// still be told apart.
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+
+	lock sync.Mutex
+	buf  []byte
+}
+
+func newPrefixWriter(out io.Writer, name string) *prefixWriter {
+	return &prefixWriter{
+		out:    out,
+		prefix: []byte(fmt.Sprintf("[%s] ", name)),
+	}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := append(append([]byte{}, w.prefix...), w.buf[:idx+1]...)
+		if _, err := w.out.Write(line); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
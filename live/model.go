@@ -0,0 +1,468 @@
+package live
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// defaultLockDelay is the lock delay Consul gives sessions that don't set
+// one.
+const defaultLockDelay = 15 * time.Second
+
+// Model is an in-memory copy of what the fuzzer has written to the catalog,
+// KV store, sessions and ACLs. It follows the state store's rules for things
+// like session invalidation, so it can be diffed against a dump of a live
+// cluster to find lost writes as well as phantom ones.
+type Model struct {
+	Nodes    map[string]*ModelNode
+	Keys     map[string]*api.KVPair
+	Sessions map[string]*api.SessionEntry
+	ACLs     map[string]*api.ACLEntry
+
+	// written has every object the model has ever held, including deleted
+	// ones, which is what limits a dump to the fuzzer's objects and lets
+	// us catch deleted objects that come back.
+	written map[string]bool
+}
+
+// ModelNode is a catalog node along with its services and checks.
+type ModelNode struct {
+	Node            string
+	Address         string
+	TaggedAddresses map[string]string
+	Meta            map[string]string
+	Services        map[string]*api.AgentService
+	Checks          map[string]*api.AgentCheck
+
+	// ModifyIndex is only filled in for dumped nodes.
+	ModifyIndex uint64
+}
+
+func NewModel() *Model {
+	return &Model{
+		Nodes:    make(map[string]*ModelNode),
+		Keys:     make(map[string]*api.KVPair),
+		Sessions: make(map[string]*api.SessionEntry),
+		ACLs:     make(map[string]*api.ACLEntry),
+		written:  make(map[string]bool),
+	}
+}
+
+// Register applies a catalog registration.
+func (m *Model) Register(reg *api.CatalogRegistration) {
+	m.written["node/"+reg.Node] = true
+
+	node, ok := m.Nodes[reg.Node]
+	if !ok {
+		node = &ModelNode{
+			Node:     reg.Node,
+			Services: make(map[string]*api.AgentService),
+			Checks:   make(map[string]*api.AgentCheck),
+		}
+		m.Nodes[reg.Node] = node
+	}
+	node.Address = reg.Address
+	node.TaggedAddresses = reg.TaggedAddresses
+	node.Meta = reg.NodeMeta
+
+	if reg.Service != nil {
+		service := *reg.Service
+		node.Services[service.ID] = &service
+	}
+	if reg.Check != nil {
+		check := *reg.Check
+		check.Node = reg.Node
+		if service, ok := node.Services[check.ServiceID]; ok {
+			check.ServiceName = service.Service
+		}
+		node.Checks[check.CheckID] = &check
+
+		// Sessions can't survive a critical check.
+		if check.Status == api.HealthCritical {
+			m.invalidateSessions(func(s *api.SessionEntry) bool {
+				return s.Node == reg.Node && hasString(s.Checks, check.CheckID)
+			})
+		}
+	}
+}
+
+// Deregister applies a catalog deregistration of a whole node, a service or
+// a check.
+func (m *Model) Deregister(dereg *api.CatalogDeregistration) {
+	node, ok := m.Nodes[dereg.Node]
+	if !ok {
+		return
+	}
+
+	switch {
+	case dereg.ServiceID != "":
+		delete(node.Services, dereg.ServiceID)
+		for id, check := range node.Checks {
+			if check.ServiceID == dereg.ServiceID {
+				m.deleteCheck(node, id)
+			}
+		}
+
+	case dereg.CheckID != "":
+		m.deleteCheck(node, dereg.CheckID)
+
+	default:
+		delete(m.Nodes, dereg.Node)
+		m.invalidateSessions(func(s *api.SessionEntry) bool {
+			return s.Node == dereg.Node
+		})
+	}
+}
+
+func (m *Model) deleteCheck(node *ModelNode, id string) {
+	delete(node.Checks, id)
+	m.invalidateSessions(func(s *api.SessionEntry) bool {
+		return s.Node == node.Node && hasString(s.Checks, id)
+	})
+}
+
+// CreateSession adds a session, which must already have its ID filled in.
+func (m *Model) CreateSession(s *api.SessionEntry) {
+	m.written["session/"+s.ID] = true
+	entry := *s
+
+	// The api package leaves out a zero lock delay, so Consul uses its
+	// default.
+	if entry.LockDelay == 0 {
+		entry.LockDelay = defaultLockDelay
+	}
+	m.Sessions[s.ID] = &entry
+}
+
+// DestroySession removes a session and releases or deletes the keys it
+// holds, depending on the session's behavior.
+func (m *Model) DestroySession(id string) {
+	m.invalidateSessions(func(s *api.SessionEntry) bool {
+		return s.ID == id
+	})
+}
+
+func (m *Model) invalidateSessions(match func(*api.SessionEntry) bool) {
+	for id, s := range m.Sessions {
+		if !match(s) {
+			continue
+		}
+		delete(m.Sessions, id)
+
+		for key, p := range m.Keys {
+			if p.Session != id {
+				continue
+			}
+			if s.Behavior == api.SessionBehaviorDelete {
+				delete(m.Keys, key)
+			} else {
+				p.Session = ""
+			}
+		}
+	}
+}
+
+// Put sets a key. Like the state store, this leaves any lock on the key in
+// place.
+func (m *Model) Put(p *api.KVPair) {
+	m.written["key/"+p.Key] = true
+	pair := &api.KVPair{
+		Key:   p.Key,
+		Flags: p.Flags,
+		Value: p.Value,
+	}
+	if existing, ok := m.Keys[p.Key]; ok {
+		pair.Session = existing.Session
+		pair.LockIndex = existing.LockIndex
+	}
+	m.Keys[p.Key] = pair
+}
+
+// Acquire sets a key and locks it with the pair's session.
+func (m *Model) Acquire(p *api.KVPair) {
+	m.written["key/"+p.Key] = true
+	pair := &api.KVPair{
+		Key:       p.Key,
+		Flags:     p.Flags,
+		Value:     p.Value,
+		Session:   p.Session,
+		LockIndex: 1,
+	}
+	if existing, ok := m.Keys[p.Key]; ok {
+		pair.LockIndex = existing.LockIndex
+		if existing.Session != p.Session {
+			pair.LockIndex++
+		}
+	}
+	m.Keys[p.Key] = pair
+}
+
+// Delete removes a key.
+func (m *Model) Delete(key string) {
+	delete(m.Keys, key)
+}
+
+// SetACL creates or updates an ACL, which must already have its ID filled in.
+func (m *Model) SetACL(a *api.ACLEntry) {
+	m.written["acl/"+a.ID] = true
+	entry := *a
+	m.ACLs[a.ID] = &entry
+}
+
+// DeleteACL removes an ACL.
+func (m *Model) DeleteACL(id string) {
+	delete(m.ACLs, id)
+}
+
+// Dump reads the current state of every object the model has ever held from
+// the cluster. The token is used to list ACLs, which needs a management token.
+func (m *Model) Dump(client *api.Client, token string) (*Model, error) {
+	dump := NewModel()
+	for name := range m.written {
+		dump.written[name] = true
+	}
+
+	catalog := client.Catalog()
+	nodes, _, err := catalog.Nodes(&api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if !m.written["node/"+n.Node] {
+			continue
+		}
+
+		node, _, err := catalog.Node(n.Node, &api.QueryOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, fmt.Errorf("node %q disappeared during dump", n.Node)
+		}
+		checks, _, err := client.Health().Node(n.Node, &api.QueryOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		dumped := &ModelNode{
+			Node:            node.Node.Node,
+			Address:         node.Node.Address,
+			TaggedAddresses: node.Node.TaggedAddresses,
+			Meta:            node.Node.Meta,
+			Services:        node.Services,
+			Checks:          make(map[string]*api.AgentCheck),
+			ModifyIndex:     node.Node.ModifyIndex,
+		}
+		if dumped.Services == nil {
+			dumped.Services = make(map[string]*api.AgentService)
+		}
+		for _, check := range checks {
+			dumped.Checks[check.CheckID] = &api.AgentCheck{
+				Node:        check.Node,
+				CheckID:     check.CheckID,
+				Name:        check.Name,
+				Status:      check.Status,
+				Notes:       check.Notes,
+				Output:      check.Output,
+				ServiceID:   check.ServiceID,
+				ServiceName: check.ServiceName,
+			}
+		}
+		dump.Nodes[n.Node] = dumped
+	}
+
+	pairs, _, err := client.KV().List("", &api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		if m.written["key/"+pair.Key] {
+			dump.Keys[pair.Key] = pair
+		}
+	}
+
+	sessions, _, err := client.Session().List(&api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		if m.written["session/"+s.ID] {
+			dump.Sessions[s.ID] = s
+		}
+	}
+
+	acls, _, err := client.ACL().List(&api.QueryOptions{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range acls {
+		if m.written["acl/"+a.ID] {
+			dump.ACLs[a.ID] = a
+		}
+	}
+
+	return dump, nil
+}
+
+// Diff compares the model with a dump and returns a description of every
+// missing, extra or changed object, sorted so the output is stable.
+func (m *Model) Diff(dump *Model) []string {
+	var diffs []string
+	report := func(format string, args ...interface{}) {
+		diffs = append(diffs, fmt.Sprintf(format, args...))
+	}
+
+	for name, want := range m.Nodes {
+		got, ok := dump.Nodes[name]
+		if !ok {
+			report("missing node %q", name)
+			continue
+		}
+		if got.Address != want.Address ||
+			!sameMap(got.TaggedAddresses, want.TaggedAddresses) ||
+			!sameMap(got.Meta, want.Meta) {
+			report("changed node %q: want %v %v %v, got %v %v %v", name,
+				want.Address, want.TaggedAddresses, want.Meta,
+				got.Address, got.TaggedAddresses, got.Meta)
+		}
+
+		for id, service := range want.Services {
+			actual, ok := got.Services[id]
+			if !ok {
+				report("missing service %q on node %q", id, name)
+				continue
+			}
+			if !sameService(actual, service) {
+				report("changed service %q on node %q: want %+v, got %+v", id, name, *service, *actual)
+			}
+		}
+		for id := range got.Services {
+			if _, ok := want.Services[id]; !ok {
+				report("extra service %q on node %q", id, name)
+			}
+		}
+
+		for id, check := range want.Checks {
+			actual, ok := got.Checks[id]
+			if !ok {
+				report("missing check %q on node %q", id, name)
+				continue
+			}
+			if *actual != *check {
+				report("changed check %q on node %q: want %+v, got %+v", id, name, *check, *actual)
+			}
+		}
+		for id := range got.Checks {
+			if _, ok := want.Checks[id]; !ok {
+				report("extra check %q on node %q", id, name)
+			}
+		}
+	}
+	for name := range dump.Nodes {
+		if _, ok := m.Nodes[name]; !ok {
+			report("extra node %q", name)
+		}
+	}
+
+	for key, want := range m.Keys {
+		got, ok := dump.Keys[key]
+		if !ok {
+			report("missing key %q", key)
+			continue
+		}
+		if got.Flags != want.Flags ||
+			got.Session != want.Session ||
+			got.LockIndex != want.LockIndex ||
+			string(got.Value) != string(want.Value) {
+			report("changed key %q: want flags=%d session=%q lock=%d len=%d, got flags=%d session=%q lock=%d len=%d",
+				key, want.Flags, want.Session, want.LockIndex, len(want.Value),
+				got.Flags, got.Session, got.LockIndex, len(got.Value))
+		}
+	}
+	for key := range dump.Keys {
+		if _, ok := m.Keys[key]; !ok {
+			report("extra key %q", key)
+		}
+	}
+
+	for id, want := range m.Sessions {
+		got, ok := dump.Sessions[id]
+		if !ok {
+			report("missing session %q", id)
+			continue
+		}
+		if got.Name != want.Name ||
+			got.Node != want.Node ||
+			!sameStrings(got.Checks, want.Checks) ||
+			got.LockDelay != want.LockDelay ||
+			got.Behavior != want.Behavior ||
+			got.TTL != want.TTL {
+			report("changed session %q: want %+v, got %+v", id, *want, *got)
+		}
+	}
+	for id := range dump.Sessions {
+		if _, ok := m.Sessions[id]; !ok {
+			report("extra session %q", id)
+		}
+	}
+
+	for id, want := range m.ACLs {
+		got, ok := dump.ACLs[id]
+		if !ok {
+			report("missing ACL %q", id)
+			continue
+		}
+		if got.Name != want.Name ||
+			got.Type != want.Type ||
+			got.Rules != want.Rules {
+			report("changed ACL %q: want %+v, got %+v", id, *want, *got)
+		}
+	}
+	for id := range dump.ACLs {
+		if _, ok := m.ACLs[id]; !ok {
+			report("extra ACL %q", id)
+		}
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
+
+// Size returns the number of objects in the model.
+func (m *Model) Size() int {
+	n := len(m.Keys) + len(m.Sessions) + len(m.ACLs)
+	for _, node := range m.Nodes {
+		n += 1 + len(node.Services) + len(node.Checks)
+	}
+	return n
+}
+
+func sameService(a, b *api.AgentService) bool {
+	return a.ID == b.ID &&
+		a.Service == b.Service &&
+		sameStrings(a.Tags, b.Tags) &&
+		a.Port == b.Port &&
+		a.Address == b.Address &&
+		a.EnableTagOverride == b.EnableTagOverride
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// diffError rolls up a list of differences into a single error.
+func diffError(diffs []string) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d differences from the model:\n    %s", len(diffs), strings.Join(diffs, "\n    "))
+}
@@ -0,0 +1,386 @@
+package live
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// testModel returns a model holding one of each kind of object, with a key
+// locked by a session.
+func testModel() *Model {
+	m := NewModel()
+	m.Register(&api.CatalogRegistration{
+		Node:     "node1",
+		Address:  "10.0.0.1",
+		NodeMeta: map[string]string{"rack": "a"},
+		Service: &api.AgentService{
+			ID:      "web1",
+			Service: "web",
+			Tags:    []string{"v1"},
+			Port:    8080,
+		},
+		Check: &api.AgentCheck{
+			CheckID:   "web-check",
+			Name:      "web check",
+			Status:    api.HealthPassing,
+			ServiceID: "web1",
+		},
+	})
+	m.CreateSession(&api.SessionEntry{
+		ID:        "session1",
+		Name:      "session",
+		Node:      "node1",
+		Checks:    []string{"web-check"},
+		LockDelay: 5e9,
+		Behavior:  api.SessionBehaviorRelease,
+	})
+	m.Put(&api.KVPair{Key: "key1", Value: []byte("hello")})
+	m.Acquire(&api.KVPair{Key: "lock1", Value: []byte("held"), Session: "session1"})
+	m.SetACL(&api.ACLEntry{ID: "acl1", Name: "acl", Type: api.ACLClientType, Rules: `key "" { policy = "read" }`})
+	return m
+}
+
+// copyModel makes a deep enough copy of the model to act as a dump that can
+// be changed without touching the model.
+func copyModel(m *Model) *Model {
+	dump := NewModel()
+	for name, node := range m.Nodes {
+		n := *node
+		n.Services = make(map[string]*api.AgentService)
+		for id, service := range node.Services {
+			s := *service
+			n.Services[id] = &s
+		}
+		n.Checks = make(map[string]*api.AgentCheck)
+		for id, check := range node.Checks {
+			c := *check
+			n.Checks[id] = &c
+		}
+		dump.Nodes[name] = &n
+	}
+	for key, pair := range m.Keys {
+		p := *pair
+		dump.Keys[key] = &p
+	}
+	for id, session := range m.Sessions {
+		s := *session
+		dump.Sessions[id] = &s
+	}
+	for id, acl := range m.ACLs {
+		a := *acl
+		dump.ACLs[id] = &a
+	}
+	return dump
+}
+
+func TestModel_Diff(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(m, dump *Model)
+		want   []string
+	}{
+		{
+			"same",
+			func(m, dump *Model) {},
+			nil,
+		},
+		{
+			"missing node",
+			func(m, dump *Model) { delete(dump.Nodes, "node1") },
+			[]string{`missing node "node1"`},
+		},
+		{
+			"extra node",
+			func(m, dump *Model) { dump.Nodes["node2"] = &ModelNode{Node: "node2"} },
+			[]string{`extra node "node2"`},
+		},
+		{
+			"changed node",
+			func(m, dump *Model) { dump.Nodes["node1"].Address = "10.0.0.2" },
+			[]string{`changed node "node1"`},
+		},
+		{
+			"missing service",
+			func(m, dump *Model) { delete(dump.Nodes["node1"].Services, "web1") },
+			[]string{`missing service "web1" on node "node1"`},
+		},
+		{
+			"extra service",
+			func(m, dump *Model) { dump.Nodes["node1"].Services["db1"] = &api.AgentService{ID: "db1"} },
+			[]string{`extra service "db1" on node "node1"`},
+		},
+		{
+			"changed service",
+			func(m, dump *Model) { dump.Nodes["node1"].Services["web1"].Tags = []string{"v2"} },
+			[]string{`changed service "web1" on node "node1"`},
+		},
+		{
+			"missing check",
+			func(m, dump *Model) { delete(dump.Nodes["node1"].Checks, "web-check") },
+			[]string{`missing check "web-check" on node "node1"`},
+		},
+		{
+			"extra check",
+			func(m, dump *Model) { dump.Nodes["node1"].Checks["other"] = &api.AgentCheck{CheckID: "other"} },
+			[]string{`extra check "other" on node "node1"`},
+		},
+		{
+			"changed check",
+			func(m, dump *Model) { dump.Nodes["node1"].Checks["web-check"].Status = api.HealthWarning },
+			[]string{`changed check "web-check" on node "node1"`},
+		},
+		{
+			"missing key",
+			func(m, dump *Model) { delete(dump.Keys, "key1") },
+			[]string{`missing key "key1"`},
+		},
+		{
+			"extra key",
+			func(m, dump *Model) { dump.Keys["key2"] = &api.KVPair{Key: "key2"} },
+			[]string{`extra key "key2"`},
+		},
+		{
+			"changed key value",
+			func(m, dump *Model) { dump.Keys["key1"].Value = []byte("world") },
+			[]string{`changed key "key1"`},
+		},
+		{
+			"changed key lock",
+			func(m, dump *Model) { dump.Keys["lock1"].LockIndex = 2 },
+			[]string{`changed key "lock1"`},
+		},
+		{
+			"missing session",
+			func(m, dump *Model) { delete(dump.Sessions, "session1") },
+			[]string{`missing session "session1"`},
+		},
+		{
+			"extra session",
+			func(m, dump *Model) { dump.Sessions["session2"] = &api.SessionEntry{ID: "session2"} },
+			[]string{`extra session "session2"`},
+		},
+		{
+			"changed session",
+			func(m, dump *Model) { dump.Sessions["session1"].LockDelay = defaultLockDelay },
+			[]string{`changed session "session1"`},
+		},
+		{
+			"missing ACL",
+			func(m, dump *Model) { delete(dump.ACLs, "acl1") },
+			[]string{`missing ACL "acl1"`},
+		},
+		{
+			"extra ACL",
+			func(m, dump *Model) { dump.ACLs["acl2"] = &api.ACLEntry{ID: "acl2"} },
+			[]string{`extra ACL "acl2"`},
+		},
+		{
+			"changed ACL",
+			func(m, dump *Model) { dump.ACLs["acl1"].Rules = "" },
+			[]string{`changed ACL "acl1"`},
+		},
+		{
+			// A deleted key that's still in the cluster is a lost delete.
+			"tombstoned key comes back",
+			func(m, dump *Model) { m.Delete("key1") },
+			[]string{`extra key "key1"`},
+		},
+		{
+			"deleted ACL comes back",
+			func(m, dump *Model) { m.DeleteACL("acl1") },
+			[]string{`extra ACL "acl1"`},
+		},
+		{
+			"several differences are sorted",
+			func(m, dump *Model) {
+				delete(dump.Keys, "key1")
+				delete(dump.ACLs, "acl1")
+				dump.Keys["key2"] = &api.KVPair{Key: "key2"}
+			},
+			[]string{`extra key "key2"`, `missing ACL "acl1"`, `missing key "key1"`},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := testModel()
+			dump := copyModel(m)
+			tc.change(m, dump)
+
+			diffs := m.Diff(dump)
+			if len(diffs) != len(tc.want) {
+				t.Fatalf("bad: %v", diffs)
+			}
+			for i, want := range tc.want {
+				if !strings.HasPrefix(diffs[i], want) {
+					t.Fatalf("bad: %q doesn't start with %q", diffs[i], want)
+				}
+			}
+			if err := diffError(diffs); (err == nil) != (len(tc.want) == 0) {
+				t.Fatalf("bad: %v", err)
+			}
+		})
+	}
+}
+
+func TestModel_Sessions(t *testing.T) {
+	cases := []struct {
+		name     string
+		behavior string
+		change   func(m *Model)
+		want     *api.KVPair
+	}{
+		{
+			"destroy releases",
+			api.SessionBehaviorRelease,
+			func(m *Model) { m.DestroySession("session1") },
+			&api.KVPair{Key: "lock1", Value: []byte("held"), LockIndex: 1},
+		},
+		{
+			"destroy deletes",
+			api.SessionBehaviorDelete,
+			func(m *Model) { m.DestroySession("session1") },
+			nil,
+		},
+		{
+			"critical check invalidates",
+			api.SessionBehaviorDelete,
+			func(m *Model) {
+				m.Register(&api.CatalogRegistration{
+					Node:    "node1",
+					Address: "10.0.0.1",
+					Check: &api.AgentCheck{
+						CheckID:   "web-check",
+						Status:    api.HealthCritical,
+						ServiceID: "web1",
+					},
+				})
+			},
+			nil,
+		},
+		{
+			"deregistered node invalidates",
+			api.SessionBehaviorRelease,
+			func(m *Model) { m.Deregister(&api.CatalogDeregistration{Node: "node1"}) },
+			&api.KVPair{Key: "lock1", Value: []byte("held"), LockIndex: 1},
+		},
+		{
+			"put keeps the lock",
+			api.SessionBehaviorRelease,
+			func(m *Model) { m.Put(&api.KVPair{Key: "lock1", Value: []byte("new")}) },
+			&api.KVPair{Key: "lock1", Value: []byte("new"), Session: "session1", LockIndex: 1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := testModel()
+			m.Sessions["session1"].Behavior = tc.behavior
+			tc.change(m)
+
+			got := m.Keys["lock1"]
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("bad: %#v", got)
+			}
+			if _, ok := m.Sessions["session1"]; ok == (tc.want == nil || tc.want.Session == "") {
+				t.Fatalf("bad: session still exists = %v", ok)
+			}
+		})
+	}
+}
+
+func TestModel_CreateSessionLockDelay(t *testing.T) {
+	m := NewModel()
+	m.CreateSession(&api.SessionEntry{ID: "session1"})
+	if got := m.Sessions["session1"].LockDelay; got != defaultLockDelay {
+		t.Fatalf("bad: %s", got)
+	}
+}
+
+func TestModel_Dump(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 1, ServerArgs: aclServerArgs})
+	client := cluster.Client
+
+	m := NewModel()
+	reg := &api.CatalogRegistration{
+		Node:    "fuzz-node",
+		Address: "10.0.0.1",
+		Service: &api.AgentService{ID: "web1", Service: "web", Port: 8080},
+		Check: &api.AgentCheck{
+			Node:      "fuzz-node",
+			CheckID:   "web-check",
+			Name:      "web check",
+			Status:    api.HealthPassing,
+			ServiceID: "web1",
+		},
+	}
+	if _, err := client.Catalog().Register(reg, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.Register(reg)
+
+	s := &api.SessionEntry{
+		Name:      "session",
+		Node:      "fuzz-node",
+		Checks:    []string{"web-check"},
+		LockDelay: 5e9,
+		Behavior:  api.SessionBehaviorRelease,
+	}
+	id, _, err := client.Session().Create(s, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.ID = id
+	m.CreateSession(s)
+
+	for _, key := range []string{"fuzz/keep", "fuzz/tombstone"} {
+		p := &api.KVPair{Key: key, Value: []byte(key)}
+		if _, err := client.KV().Put(p, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		m.Put(p)
+	}
+
+	// Objects the model never wrote are left out of the dump.
+	if _, err := client.KV().Put(&api.KVPair{Key: "other"}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dump, err := m.Dump(client, "root")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diffs := m.Diff(dump); len(diffs) != 0 {
+		t.Fatalf("bad: %v", diffs)
+	}
+	if _, ok := dump.Keys["other"]; ok {
+		t.Fatalf("dump has a key the model never wrote")
+	}
+	if dump.Nodes["fuzz-node"].ModifyIndex == 0 {
+		t.Fatalf("dumped node is missing its index")
+	}
+
+	// A key deleted from the model but not the cluster shows up as extra,
+	// and once it's deleted for real the dump agrees again.
+	m.Delete("fuzz/tombstone")
+	dump, err = m.Dump(client, "root")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diffs := m.Diff(dump); len(diffs) != 1 || diffs[0] != `extra key "fuzz/tombstone"` {
+		t.Fatalf("bad: %v", diffs)
+	}
+	if _, err := client.KV().Delete("fuzz/tombstone", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dump, err = m.Dump(client, "root")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diffs := m.Diff(dump); len(diffs) != 0 {
+		t.Fatalf("bad: %v", diffs)
+	}
+}
@@ -0,0 +1,182 @@
+package live
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// fuzzMutate picks one of the objects the fuzzer has made and changes or
+// deletes it, updating the model to match.
+func (f *Fuzz) fuzzMutate() error {
+	var mutators []func() error
+	if len(f.nodes) > 0 {
+		mutators = append(mutators, f.mutateNode)
+	}
+	if len(f.keys) > 0 {
+		mutators = append(mutators, f.mutateKV)
+	}
+	if len(f.sessions) > 0 {
+		mutators = append(mutators, f.mutateSession)
+	}
+	if len(f.acls) > 0 {
+		mutators = append(mutators, f.mutateACL)
+	}
+	if len(mutators) == 0 {
+		return nil
+	}
+	return mutators[f.rand.Intn(len(mutators))]()
+}
+
+func (f *Fuzz) mutateNode() error {
+	idx := f.rand.Intn(len(f.nodes))
+	reg := f.nodes[idx]
+	catalog := f.Client.Catalog()
+
+	// Copy the registration so the changes below don't touch the state
+	// we expected before.
+	next := &api.CatalogRegistration{
+		Node:            reg.Node,
+		Address:         reg.Address,
+		TaggedAddresses: reg.TaggedAddresses,
+		NodeMeta:        reg.NodeMeta,
+	}
+	if reg.Service != nil {
+		service := *reg.Service
+		next.Service = &service
+	}
+	if reg.Check != nil {
+		check := *reg.Check
+		next.Check = &check
+	}
+
+	switch op := f.rand.Intn(4); {
+	case op == 0:
+		next.TaggedAddresses = map[string]string{
+			"wan": f.generateAddress(),
+		}
+		next.NodeMeta = map[string]string{
+			"fuzz": f.generateString(12),
+		}
+		if next.Service != nil {
+			next.Service.Tags = f.generateTags()
+			next.Service.Address = f.generateAddress()
+			next.Service.Port = 1024 + f.rand.Intn(64511)
+			next.Service.EnableTagOverride = f.rand.Intn(2) == 0
+		}
+		if next.Check != nil {
+			next.Check.Status = f.generateStatus(true)
+			next.Check.Output = f.generateString(f.rand.Intn(256))
+		}
+		if _, err := catalog.Register(next, &api.WriteOptions{}); err != nil {
+			return err
+		}
+		f.Model.Register(next)
+
+	case op == 1 && next.Service != nil:
+		dereg := &api.CatalogDeregistration{
+			Node:      next.Node,
+			ServiceID: next.Service.ID,
+		}
+		if _, err := catalog.Deregister(dereg, &api.WriteOptions{}); err != nil {
+			return err
+		}
+		f.Model.Deregister(dereg)
+
+		// Checks bound to the service go away with it.
+		if next.Check != nil && next.Check.ServiceID == next.Service.ID {
+			next.Check = nil
+		}
+		next.Service = nil
+
+	case op == 2 && next.Check != nil:
+		dereg := &api.CatalogDeregistration{
+			Node:    next.Node,
+			CheckID: next.Check.CheckID,
+		}
+		if _, err := catalog.Deregister(dereg, &api.WriteOptions{}); err != nil {
+			return err
+		}
+		f.Model.Deregister(dereg)
+		next.Check = nil
+
+	default:
+		dereg := &api.CatalogDeregistration{
+			Node: next.Node,
+		}
+		if _, err := catalog.Deregister(dereg, &api.WriteOptions{}); err != nil {
+			return err
+		}
+		f.Model.Deregister(dereg)
+		f.nodes = append(f.nodes[:idx], f.nodes[idx+1:]...)
+		return nil
+	}
+
+	f.nodes[idx] = next
+	return nil
+}
+
+func (f *Fuzz) mutateKV() error {
+	idx := f.rand.Intn(len(f.keys))
+	p := f.keys[idx]
+	kv := f.Client.KV()
+
+	if f.rand.Intn(2) == 0 {
+		next := &api.KVPair{
+			Key:   p.Key,
+			Flags: uint64(f.rand.Int63()),
+			Value: f.generateValue(512),
+		}
+		if _, err := kv.Put(next, &api.WriteOptions{}); err != nil {
+			return err
+		}
+		f.Model.Put(next)
+		f.keys[idx] = next
+		return nil
+	}
+
+	if _, err := kv.Delete(p.Key, &api.WriteOptions{}); err != nil {
+		return err
+	}
+	f.Model.Delete(p.Key)
+	f.keys = append(f.keys[:idx], f.keys[idx+1:]...)
+	return nil
+}
+
+func (f *Fuzz) mutateSession() error {
+	idx := f.rand.Intn(len(f.sessions))
+	s := f.sessions[idx]
+
+	if _, err := f.Client.Session().Destroy(s.ID, &api.WriteOptions{}); err != nil {
+		return err
+	}
+	f.Model.DestroySession(s.ID)
+	f.sessions = append(f.sessions[:idx], f.sessions[idx+1:]...)
+	return nil
+}
+
+func (f *Fuzz) mutateACL() error {
+	idx := f.rand.Intn(len(f.acls))
+	a := f.acls[idx]
+	acl := f.Client.ACL()
+
+	if f.rand.Intn(2) == 0 {
+		next := &api.ACLEntry{
+			ID:    a.ID,
+			Name:  f.generateName("acl"),
+			Type:  a.Type,
+			Rules: f.generateRules(),
+		}
+		if _, err := acl.Update(next, &api.WriteOptions{Token: f.Token}); err != nil {
+			return err
+		}
+		f.Model.SetACL(next)
+		f.acls[idx] = next
+		return nil
+	}
+
+	if _, err := acl.Destroy(a.ID, &api.WriteOptions{Token: f.Token}); err != nil {
+		return err
+	}
+	f.Model.DeleteACL(a.ID)
+	f.acls = append(f.acls[:idx], f.acls[idx+1:]...)
+	return nil
+}
@@ -0,0 +1,255 @@
+package live
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// proxyBindAddr is where agents bind their Serf and server ports when their
+// traffic goes through a Network. The proxies listen on the same ports on
+// 127.0.0.1, which is what the agents advertise to each other. This needs
+// the whole 127.0.0.0/8 block to be usable, which is the default on Linux;
+// on macOS run "sudo ifconfig lo0 alias 127.0.0.2 up" first.
+const proxyBindAddr = "127.0.0.2"
+
+// link is a direction of traffic between two agents, by node name.
+type link struct {
+	src string
+	dst string
+}
+
+// Network routes the Serf and server traffic between a cluster's agents
+// through proxies so the agents can be partitioned from each other, and so
+// the links between them can be slowed down.
+//
+// UDP traffic is attributed to an agent by its source port. TCP connections
+// are attributed by looking up which agent process owns the other end of
+// the connection, which is only supported on Linux, so partitions return an
+// error on other platforms rather than leaving TCP open. Connections that
+// can't be attributed are always let through.
+type Network struct {
+	agents []*Consul
+
+	lock      sync.Mutex
+	blocked   map[link]bool
+	shapes    map[link]LinkConfig
+	busy      map[link]time.Time
+	rand      *rand.Rand
+	conns     map[net.Conn]link
+	listeners []net.Listener
+	packets   []*net.UDPConn
+	started   bool
+	closed    bool
+}
+
+// newNetwork makes a network between the given agents. The seed drives the
+// random packet loss and jitter on its links.
+func newNetwork(agents []*Consul, seed int64) *Network {
+	return &Network{
+		agents:  agents,
+		blocked: make(map[link]bool),
+		shapes:  make(map[link]LinkConfig),
+		busy:    make(map[link]time.Time),
+		rand:    rand.New(rand.NewSource(seed)),
+		conns:   make(map[net.Conn]link),
+	}
+}
+
+// start sets up the proxies for every agent.
+func (n *Network) start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.started {
+		return nil
+	}
+
+	for _, consul := range n.agents {
+		for _, port := range []int{consul.Ports.SerfLAN, consul.Ports.SerfWAN, consul.Ports.Server} {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				n.closeLocked()
+				return err
+			}
+			n.listeners = append(n.listeners, l)
+			go n.serveTCP(l, consul, port)
+		}
+
+		for _, port := range []int{consul.Ports.SerfLAN, consul.Ports.SerfWAN} {
+			pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+			if err != nil {
+				n.closeLocked()
+				return err
+			}
+			n.packets = append(n.packets, pc)
+			go n.serveUDP(pc, consul, port)
+		}
+	}
+	n.started = true
+	return nil
+}
+
+// close shuts down all the proxies.
+func (n *Network) close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.closeLocked()
+}
+
+func (n *Network) closeLocked() {
+	n.closed = true
+	for _, l := range n.listeners {
+		l.Close()
+	}
+	for _, pc := range n.packets {
+		pc.Close()
+	}
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.listeners, n.packets = nil, nil
+}
+
+// Partition splits the agents into the given groups of node names, so that
+// agents can only talk to other agents in the same group. Any agents not
+// mentioned are put in a group of their own. This replaces any existing
+// partition.
+func (n *Network) Partition(groups ...[]string) error {
+	if !socketLookups {
+		return fmt.Errorf("partitions aren't supported on %s, since TCP connections can't be traced to agents", runtime.GOOS)
+	}
+
+	group := make(map[string]int)
+	for i, nodes := range groups {
+		for _, node := range nodes {
+			if n.agent(node) == nil {
+				return fmt.Errorf("unknown node %q", node)
+			}
+			if _, ok := group[node]; ok {
+				return fmt.Errorf("node %q is in more than one group", node)
+			}
+			group[node] = i
+		}
+	}
+
+	rest := len(groups)
+	blocked := make(map[link]bool)
+	for _, src := range n.agents {
+		for _, dst := range n.agents {
+			gs, ok := group[src.Name]
+			if !ok {
+				gs = rest
+			}
+			gd, ok := group[dst.Name]
+			if !ok {
+				gd = rest
+			}
+			if gs != gd {
+				blocked[link{src.Name, dst.Name}] = true
+			}
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.blocked = blocked
+	n.cutLocked()
+	log.Printf("Partitioned network into %v", groups)
+	return nil
+}
+
+// Isolate cuts the given agent off from all the others.
+func (n *Network) Isolate(node string) error {
+	return n.Partition([]string{node})
+}
+
+// Heal removes any partition so all the agents can talk again.
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.blocked = make(map[link]bool)
+	log.Println("Healed network partition")
+}
+
+// allowed returns true if traffic can flow from src to dst. Traffic from an
+// unknown source is always allowed.
+func (n *Network) allowed(src, dst string) bool {
+	if src == "" {
+		return true
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return !n.blocked[link{src, dst}]
+}
+
+// cutLocked closes any open connections that cross the partition.
+func (n *Network) cutLocked() {
+	for conn, l := range n.conns {
+		if n.blocked[l] || n.blocked[link{l.dst, l.src}] {
+			conn.Close()
+			delete(n.conns, conn)
+		}
+	}
+}
+
+// track records an open connection so it can be cut by a partition. This
+// returns false if the network has been closed.
+func (n *Network) track(conn net.Conn, l link) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return false
+	}
+	n.conns[conn] = l
+	return true
+}
+
+func (n *Network) untrack(conn net.Conn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, conn)
+}
+
+// agent returns the agent with the given node name, or nil.
+func (n *Network) agent(node string) *Consul {
+	for _, consul := range n.agents {
+		if consul.Name == node {
+			return consul
+		}
+	}
+	return nil
+}
+
+// udpSource returns the node name of the agent that sent a packet from the
+// given address, or an empty string if it's not from one of our agents.
+func (n *Network) udpSource(addr *net.UDPAddr) string {
+	if !addr.IP.Equal(net.ParseIP(proxyBindAddr)) {
+		return ""
+	}
+	for _, consul := range n.agents {
+		if addr.Port == consul.Ports.SerfLAN || addr.Port == consul.Ports.SerfWAN {
+			return consul.Name
+		}
+	}
+	return ""
+}
+
+// tcpSource returns the node name of the agent on the other end of the given
+// connection, or an empty string if it can't be worked out.
+func (n *Network) tcpSource(conn net.Conn) string {
+	inode, ok := socketInode(conn.RemoteAddr(), conn.LocalAddr())
+	if !ok {
+		return ""
+	}
+	for _, consul := range n.agents {
+		if pid := consul.Pid(); pid != 0 && pidHasSocket(pid, inode) {
+			return consul.Name
+		}
+	}
+	return ""
+}
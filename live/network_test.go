@@ -0,0 +1,385 @@
+package live
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// freePort returns a port that's currently free on 127.0.0.1.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// testNetwork starts a network between fake agents with the given node names.
+// The first agent is given this process's PID, so connections the test makes
+// come from it. Every other agent gets a TCP echo server on its server port
+// and a UDP echo server on its LAN Serf port, where a real agent would bind.
+func testNetwork(t *testing.T, names ...string) *Network {
+	if l, err := net.Listen("tcp", proxyBindAddr+":0"); err != nil {
+		t.Skipf("can't listen on %s: %v", proxyBindAddr, err)
+	} else {
+		l.Close()
+	}
+
+	var agents []*Consul
+	for i, name := range names {
+		consul := &Consul{
+			Name: name,
+			Ports: Ports{
+				SerfLAN: freePort(t),
+				SerfWAN: freePort(t),
+				Server:  freePort(t),
+			},
+		}
+		if i == 0 {
+			consul.setPid(os.Getpid())
+		} else {
+			echoTCP(t, consul.Ports.Server)
+			echoUDP(t, consul.Ports.SerfLAN)
+		}
+		agents = append(agents, consul)
+	}
+
+	n := newNetwork(agents, 1)
+	if err := n.start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(n.close)
+	return n
+}
+
+func echoTCP(t *testing.T, port int) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(proxyBindAddr), Port: port})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					size, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:size]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func echoUDP(t *testing.T, port int) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(proxyBindAddr), Port: port})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			size, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:size], from)
+		}
+	}()
+}
+
+// dialTCP connects to the proxy for the given port.
+func dialTCP(t *testing.T, port int) net.Conn {
+	conn, err := net.Dial("tcp", (&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}).String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echoes returns true if the connection sends back what's written to it.
+func echoes(conn net.Conn) bool {
+	want := []byte("ping")
+	if _, err := conn.Write(want); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, len(want))
+	for read := 0; read < len(got); {
+		size, err := conn.Read(got[read:])
+		if err != nil {
+			return false
+		}
+		read += size
+	}
+	return bytes.Equal(got, want)
+}
+
+// echoesUDP returns true if a packet sent from the given socket to the proxy
+// for the given port gets sent back.
+func echoesUDP(pc *net.UDPConn, port int) bool {
+	want := []byte("ping")
+	to := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	if _, err := pc.WriteToUDP(want, to); err != nil {
+		return false
+	}
+	pc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	got := make([]byte, 1024)
+	size, _, err := pc.ReadFromUDP(got)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(got[:size], want)
+}
+
+func TestNetwork_PartitionErrors(t *testing.T) {
+	n := newNetwork([]*Consul{{Name: "a"}, {Name: "b"}}, 1)
+
+	if !socketLookups {
+		if err := n.Partition([]string{"a"}); err == nil {
+			t.Fatalf("should have failed")
+		}
+		t.Skip("partitions aren't supported on this platform")
+	}
+
+	cases := []struct {
+		name   string
+		groups [][]string
+		ok     bool
+	}{
+		{"isolate", [][]string{{"a"}}, true},
+		{"split", [][]string{{"a"}, {"b"}}, true},
+		{"unknown node", [][]string{{"a"}, {"nope"}}, false},
+		{"repeated node", [][]string{{"a"}, {"a", "b"}}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := n.Partition(tc.groups...)
+			if tc.ok && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("should have failed")
+			}
+		})
+	}
+}
+
+func TestNetwork_Allowed(t *testing.T) {
+	if !socketLookups {
+		t.Skip("partitions aren't supported on this platform")
+	}
+	n := newNetwork([]*Consul{{Name: "a"}, {Name: "b"}, {Name: "c"}}, 1)
+	if err := n.Partition([]string{"a"}, []string{"b"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		src, dst string
+		ok       bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"b", "a", false},
+		{"a", "c", false},
+		{"b", "c", false},
+		{"c", "c", true},
+		{"", "a", true},
+	}
+	for _, tc := range cases {
+		if got := n.allowed(tc.src, tc.dst); got != tc.ok {
+			t.Fatalf("bad: %q -> %q is %v", tc.src, tc.dst, got)
+		}
+	}
+
+	n.Heal()
+	for _, tc := range cases {
+		if !n.allowed(tc.src, tc.dst) {
+			t.Fatalf("bad: %q -> %q is still blocked", tc.src, tc.dst)
+		}
+	}
+}
+
+func TestNetwork_UDPSource(t *testing.T) {
+	a := &Consul{Name: "a", Ports: Ports{SerfLAN: 1001, SerfWAN: 1002, Server: 1003}}
+	b := &Consul{Name: "b", Ports: Ports{SerfLAN: 2001, SerfWAN: 2002, Server: 2003}}
+	n := newNetwork([]*Consul{a, b}, 1)
+
+	cases := []struct {
+		ip   string
+		port int
+		want string
+	}{
+		{proxyBindAddr, 1001, "a"},
+		{proxyBindAddr, 1002, "a"},
+		{proxyBindAddr, 2001, "b"},
+		{proxyBindAddr, 2002, "b"},
+		{proxyBindAddr, 1003, ""},
+		{proxyBindAddr, 3001, ""},
+		{"127.0.0.1", 1001, ""},
+	}
+	for _, tc := range cases {
+		addr := &net.UDPAddr{IP: net.ParseIP(tc.ip), Port: tc.port}
+		if got := n.udpSource(addr); got != tc.want {
+			t.Fatalf("bad: %s is from %q, not %q", addr, got, tc.want)
+		}
+	}
+}
+
+func TestNetwork_TCP(t *testing.T) {
+	if !socketLookups {
+		t.Skip("partitions aren't supported on this platform")
+	}
+	n := testNetwork(t, "a", "b", "c")
+	b, c := n.agents[1], n.agents[2]
+
+	// Connections are let through and attributed to the agent that made
+	// them.
+	conn := dialTCP(t, b.Ports.Server)
+	if !echoes(conn) {
+		t.Fatalf("bad: no echo before the partition")
+	}
+	n.lock.Lock()
+	var tracked int
+	for _, l := range n.conns {
+		if l != (link{"a", "b"}) {
+			t.Fatalf("bad: %v", l)
+		}
+		tracked++
+	}
+	n.lock.Unlock()
+	if tracked != 2 {
+		t.Fatalf("bad: %d tracked", tracked)
+	}
+
+	// A partition cuts the open connection and refuses new ones.
+	if err := n.Isolate("a"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if echoes(conn) {
+		t.Fatalf("bad: open connection wasn't cut")
+	}
+	if echoes(dialTCP(t, b.Ports.Server)) {
+		t.Fatalf("bad: new connection across the partition")
+	}
+	if echoes(dialTCP(t, c.Ports.Server)) {
+		t.Fatalf("bad: new connection across the partition")
+	}
+	n.lock.Lock()
+	if len(n.conns) != 0 {
+		t.Fatalf("bad: %v", n.conns)
+	}
+	n.lock.Unlock()
+
+	// Agents on the same side can still talk.
+	if err := n.Partition([]string{"a", "c"}, []string{"b"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !echoes(dialTCP(t, c.Ports.Server)) {
+		t.Fatalf("bad: no echo within a side")
+	}
+	if echoes(dialTCP(t, b.Ports.Server)) {
+		t.Fatalf("bad: new connection across the partition")
+	}
+
+	n.Heal()
+	if !echoes(dialTCP(t, b.Ports.Server)) {
+		t.Fatalf("bad: no echo after healing")
+	}
+}
+
+func TestNetwork_UDP(t *testing.T) {
+	if !socketLookups {
+		t.Skip("partitions aren't supported on this platform")
+	}
+	n := testNetwork(t, "a", "b", "c")
+	a, b, c := n.agents[0], n.agents[1], n.agents[2]
+
+	// Packets from a's Serf port are attributed to a.
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(proxyBindAddr), Port: a.Ports.SerfLAN})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pc.Close()
+
+	// Packets from anywhere else can't be attributed, so they always get
+	// through.
+	unknown, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer unknown.Close()
+
+	if !echoesUDP(pc, b.Ports.SerfLAN) {
+		t.Fatalf("bad: no echo before the partition")
+	}
+
+	if err := n.Partition([]string{"a", "c"}, []string{"b"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if echoesUDP(pc, b.Ports.SerfLAN) {
+		t.Fatalf("bad: packet crossed the partition")
+	}
+	if !echoesUDP(pc, c.Ports.SerfLAN) {
+		t.Fatalf("bad: no echo within a side")
+	}
+	if !echoesUDP(unknown, b.Ports.SerfLAN) {
+		t.Fatalf("bad: unknown source was blocked")
+	}
+
+	n.Heal()
+	if !echoesUDP(pc, b.Ports.SerfLAN) {
+		t.Fatalf("bad: no echo after healing")
+	}
+}
+
+func TestNetwork_RestartWhileProxying(t *testing.T) {
+	cluster := testCluster(t, &ClusterConfig{Servers: 1, Clients: 1, Partitionable: true})
+	client := cluster.Clients()[0]
+
+	// Keep the proxies looking up agents' PIDs while one of them restarts.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		addr := (&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: client.Ports.Server}).String()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := client.Restart(5 * time.Second); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package live
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// pauseProcess isn't supported without SIGSTOP, so agents can't be paused.
+func pauseProcess(p *os.Process) error {
+	return fmt.Errorf("pausing agents isn't supported on %s", runtime.GOOS)
+}
+
+// resumeProcess can't be called since nothing can be paused, but it errors
+// the same way to be safe.
+func resumeProcess(p *os.Process) error {
+	return fmt.Errorf("resuming agents isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package live
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseProcess freezes the process with SIGSTOP.
+func pauseProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGSTOP)
+}
+
+// resumeProcess unfreezes a process stopped by pauseProcess.
+func resumeProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGCONT)
+}
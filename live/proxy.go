@@ -0,0 +1,181 @@
+package live
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// serveTCP accepts connections for the given agent's port and forwards them
+// to the agent, unless the other end is partitioned away from it.
+func (n *Network) serveTCP(l net.Listener, dst *Consul, port int) {
+	target := fmt.Sprintf("%s:%d", proxyBindAddr, port)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go n.proxyTCP(conn, dst, target)
+	}
+}
+
+func (n *Network) proxyTCP(conn net.Conn, dst *Consul, target string) {
+	defer conn.Close()
+
+	src := n.tcpSource(conn)
+	if !n.allowed(src, dst.Name) || !n.allowed(dst.Name, src) {
+		return
+	}
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	// Both sides get tracked so a partition tears down the whole thing.
+	l := link{src, dst.Name}
+	if !n.track(conn, l) {
+		return
+	}
+	defer n.untrack(conn)
+	if !n.track(upstream, l) {
+		return
+	}
+	defer n.untrack(upstream)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n.pipe(upstream, conn, l)
+	}()
+	go func() {
+		defer wg.Done()
+		n.pipe(conn, upstream, link{dst.Name, src})
+	}()
+	wg.Wait()
+}
+
+// chunk is part of a TCP stream waiting to be sent.
+type chunk struct {
+	buf []byte
+	at  time.Time
+}
+
+// pipe copies from one connection to the other, holding back each chunk as
+// long as the link's conditions say to. Both connections are closed once
+// either side is done.
+func (n *Network) pipe(to, from net.Conn, l link) {
+	defer to.Close()
+	defer from.Close()
+
+	queue := make(chan chunk, 64)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(queue)
+		for {
+			buf := make([]byte, 32*1024)
+			size, err := from.Read(buf)
+			if size > 0 {
+				c := chunk{buf[:size], time.Now().Add(n.delay(l, size))}
+				select {
+				case queue <- c:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range queue {
+		time.Sleep(c.at.Sub(time.Now()))
+		if _, err := to.Write(c.buf); err != nil {
+			return
+		}
+	}
+}
+
+// serveUDP forwards packets for the given agent's port to the agent, and
+// sends back any replies, dropping anything that crosses a partition. Each
+// sender gets its own socket to the agent so we know where to send replies.
+func (n *Network) serveUDP(pc *net.UDPConn, dst *Consul, port int) {
+	target := &net.UDPAddr{IP: net.ParseIP(proxyBindAddr), Port: port}
+	sessions := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		size, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		src := n.udpSource(from)
+		l := link{src, dst.Name}
+		if !n.allowed(src, dst.Name) || n.drop(l) {
+			continue
+		}
+
+		session, ok := sessions[from.String()]
+		if !ok {
+			session, err = net.DialUDP("udp", nil, target)
+			if err != nil {
+				continue
+			}
+			sessions[from.String()] = session
+			go n.replyUDP(pc, session, dst, src, from)
+		}
+		n.sendUDP(l, buf[:size], func(packet []byte) {
+			session.Write(packet)
+		})
+	}
+}
+
+// sendUDP sends a packet after the link's delay, if there is one.
+func (n *Network) sendUDP(l link, packet []byte, send func([]byte)) {
+	d := n.delay(l, len(packet))
+	if d <= 0 {
+		send(packet)
+		return
+	}
+
+	held := make([]byte, len(packet))
+	copy(held, packet)
+	time.AfterFunc(d, func() {
+		send(held)
+	})
+}
+
+// replyUDP sends packets from the agent back to the original sender.
+func (n *Network) replyUDP(pc, session *net.UDPConn, dst *Consul, src string, to *net.UDPAddr) {
+	buf := make([]byte, 65536)
+	for {
+		size, err := session.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// This is usually a refused packet while the agent is
+			// down, which doesn't stop the socket from working.
+			continue
+		}
+		l := link{dst.Name, src}
+		if !n.allowed(dst.Name, src) || n.drop(l) {
+			continue
+		}
+		n.sendUDP(l, buf[:size], func(packet []byte) {
+			pc.WriteToUDP(packet, to)
+		})
+	}
+}
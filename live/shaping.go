@@ -0,0 +1,84 @@
+package live
+
+import (
+	"time"
+)
+
+// LinkConfig describes the conditions on a link between agents. The zero
+// value is a perfect link.
+type LinkConfig struct {
+	// Latency is added to every packet and every chunk of a TCP stream.
+	Latency time.Duration
+
+	// Jitter varies the latency by up to this much either way. Packets can
+	// get reordered but TCP streams stay in order.
+	Jitter time.Duration
+
+	// Loss is the fraction of packets to drop, from 0 to 1. This only
+	// applies to UDP, since TCP would just retransmit.
+	Loss float64
+
+	// Bandwidth limits the link to this many bytes per second, or is zero
+	// for no limit.
+	Bandwidth int
+}
+
+// Shape sets the conditions for traffic from src to dst, by node name. An
+// empty src or dst means traffic to or from outside the network, such as
+// other datacenters in a federation.
+func (n *Network) Shape(src, dst string, cfg LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.shapes[link{src, dst}] = cfg
+}
+
+// ShapeAll sets the conditions for traffic between every pair of agents in
+// the network.
+func (n *Network) ShapeAll(cfg LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, src := range n.agents {
+		for _, dst := range n.agents {
+			if src != dst {
+				n.shapes[link{src.Name, dst.Name}] = cfg
+			}
+		}
+	}
+}
+
+// drop returns true if a packet on the given link should be lost.
+func (n *Network) drop(l link) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	cfg := n.shapes[l]
+	return cfg.Loss > 0.0 && n.rand.Float64() < cfg.Loss
+}
+
+// delay returns how long to hold the given number of bytes before sending
+// them on the given link, accounting for latency, jitter, and the queue of
+// bytes already waiting for bandwidth.
+func (n *Network) delay(l link, size int) time.Duration {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	cfg := n.shapes[l]
+
+	d := cfg.Latency
+	if cfg.Jitter > 0 {
+		d += time.Duration(n.rand.Int63n(int64(2*cfg.Jitter))) - cfg.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	if cfg.Bandwidth > 0 {
+		now := time.Now()
+		start := n.busy[l]
+		if start.Before(now) {
+			start = now
+		}
+		done := start.Add(time.Duration(size) * time.Second / time.Duration(cfg.Bandwidth))
+		n.busy[l] = done
+		d += done.Sub(now)
+	}
+	return d
+}
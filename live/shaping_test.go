@@ -0,0 +1,156 @@
+package live
+
+import (
+	"testing"
+	"time"
+)
+
+// within returns true if the duration is within a little scheduling slack of
+// the expected one.
+func within(d, want time.Duration) bool {
+	const slack = 50 * time.Millisecond
+	return d >= want-slack && d <= want+slack
+}
+
+func TestNetwork_Drop(t *testing.T) {
+	cases := []struct {
+		loss     float64
+		min, max int
+	}{
+		{0.0, 0, 0},
+		{1.0, 1000, 1000},
+		{0.5, 400, 600},
+	}
+	for _, tc := range cases {
+		n := newNetwork(nil, 1)
+		l := link{"a", "b"}
+		n.Shape(l.src, l.dst, LinkConfig{Loss: tc.loss})
+
+		var dropped int
+		for i := 0; i < 1000; i++ {
+			if n.drop(l) {
+				dropped++
+			}
+		}
+		if dropped < tc.min || dropped > tc.max {
+			t.Fatalf("bad: loss %v dropped %d", tc.loss, dropped)
+		}
+
+		// Other links aren't affected.
+		if n.drop(link{"b", "a"}) {
+			t.Fatalf("bad: unshaped link dropped a packet")
+		}
+	}
+}
+
+func TestNetwork_DropSeed(t *testing.T) {
+	run := func(seed int64) []bool {
+		n := newNetwork(nil, seed)
+		n.Shape("a", "b", LinkConfig{Loss: 0.5})
+		var drops []bool
+		for i := 0; i < 100; i++ {
+			drops = append(drops, n.drop(link{"a", "b"}))
+		}
+		return drops
+	}
+
+	first, again, other := run(42), run(42), run(43)
+	same := true
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("bad: seed didn't reproduce drop %d", i)
+		}
+		if first[i] != other[i] {
+			same = false
+		}
+	}
+	if same {
+		t.Fatalf("bad: different seeds dropped the same packets")
+	}
+}
+
+func TestNetwork_Delay(t *testing.T) {
+	l := link{"a", "b"}
+
+	cases := []struct {
+		name     string
+		cfg      LinkConfig
+		min, max time.Duration
+	}{
+		{"perfect", LinkConfig{}, 0, 0},
+		{"latency", LinkConfig{Latency: 100 * time.Millisecond}, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"jitter", LinkConfig{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond}, 80 * time.Millisecond, 120 * time.Millisecond},
+		{"jitter past zero", LinkConfig{Jitter: 20 * time.Millisecond}, 0, 20 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := newNetwork(nil, 1)
+			n.Shape(l.src, l.dst, tc.cfg)
+
+			var spread bool
+			first := n.delay(l, 100)
+			for i := 0; i < 1000; i++ {
+				d := n.delay(l, 100)
+				if d < tc.min || d > tc.max {
+					t.Fatalf("bad: %s", d)
+				}
+				if d != first {
+					spread = true
+				}
+			}
+			if spread != (tc.cfg.Jitter > 0) {
+				t.Fatalf("bad: jitter %s gave spread %v", tc.cfg.Jitter, spread)
+			}
+		})
+	}
+}
+
+func TestNetwork_DelaySeed(t *testing.T) {
+	run := func() []time.Duration {
+		n := newNetwork(nil, 42)
+		n.Shape("a", "b", LinkConfig{Latency: time.Second, Jitter: 500 * time.Millisecond})
+		var delays []time.Duration
+		for i := 0; i < 100; i++ {
+			delays = append(delays, n.delay(link{"a", "b"}, 100))
+		}
+		return delays
+	}
+
+	first, again := run(), run()
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("bad: seed didn't reproduce delay %d", i)
+		}
+	}
+}
+
+func TestNetwork_DelayBandwidth(t *testing.T) {
+	n := newNetwork(nil, 1)
+	l := link{"a", "b"}
+	n.Shape(l.src, l.dst, LinkConfig{Latency: 100 * time.Millisecond, Bandwidth: 1000})
+
+	// Each chunk waits for the ones queued ahead of it, on top of the
+	// latency.
+	if d := n.delay(l, 500); !within(d, 600*time.Millisecond) {
+		t.Fatalf("bad: %s", d)
+	}
+	if d := n.delay(l, 500); !within(d, 1100*time.Millisecond) {
+		t.Fatalf("bad: %s", d)
+	}
+	if d := n.delay(l, 1000); !within(d, 2100*time.Millisecond) {
+		t.Fatalf("bad: %s", d)
+	}
+
+	// The other direction has its own queue, and no limit.
+	if d := n.delay(link{"b", "a"}, 1000); d != 0 {
+		t.Fatalf("bad: %s", d)
+	}
+
+	// Once the queue drains, chunks only wait for their own bytes.
+	n.lock.Lock()
+	n.busy[l] = time.Now().Add(-time.Second)
+	n.lock.Unlock()
+	if d := n.delay(l, 100); !within(d, 200*time.Millisecond) {
+		t.Fatalf("bad: %s", d)
+	}
+}
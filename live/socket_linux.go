@@ -0,0 +1,81 @@
+package live
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketLookups is true since /proc lets TCP connections through a Network be
+// attributed to agents.
+const socketLookups = true
+
+// socketInode finds the TCP socket with the given local and remote addresses
+// in /proc and returns its inode.
+func socketInode(local, remote net.Addr) (uint64, bool) {
+	l, ok := procAddr(local)
+	if !ok {
+		return 0, false
+	}
+	r, ok := procAddr(remote)
+	if !ok {
+		return 0, false
+	}
+
+	f, err := os.Open("/proc/net/tcp")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != l || fields[2] != r {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return inode, true
+	}
+	return 0, false
+}
+
+// procAddr formats an IPv4 TCP address the way /proc/net/tcp does, which is
+// the address as a host-order hex word. This assumes a little-endian host.
+func procAddr(addr net.Addr) (string, bool) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", false
+	}
+	ip := tcp.IP.To4()
+	if ip == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%08X:%04X", binary.LittleEndian.Uint32(ip), tcp.Port), true
+}
+
+// pidHasSocket returns true if the given process has an open file descriptor
+// for the socket with the given inode.
+func pidHasSocket(pid int, inode uint64) bool {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	want := fmt.Sprintf("socket:[%d]", inode)
+	for _, fd := range fds {
+		if link, err := os.Readlink(dir + "/" + fd.Name()); err == nil && link == want {
+			return true
+		}
+	}
+	return false
+}
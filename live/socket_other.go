@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package live
+
+import (
+	"net"
+)
+
+// socketLookups is false outside of Linux, where TCP connections through a
+// Network can't be attributed to an agent, so they can't be partitioned.
+const socketLookups = false
+
+func socketInode(local, remote net.Addr) (uint64, bool) {
+	return 0, false
+}
+
+func pidHasSocket(pid int, inode uint64) bool {
+	return false
+}
@@ -0,0 +1,165 @@
+package live
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// certLifetime is how long generated certificates are good for, which only
+// needs to outlast a test run.
+const certLifetime = 7 * 24 * time.Hour
+
+// CA is a throwaway certificate authority for a test cluster.
+type CA struct {
+	// CAFile is the path to the CA's PEM encoded certificate.
+	CAFile string
+
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+// Cert holds the paths to a certificate issued by a CA, along with the CA's
+// own certificate.
+type Cert struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// NewCA makes a new CA and writes its certificate into the given dir, which
+// is also where any certificates it issues are written.
+func NewCA(dir string) (*CA, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Consul Live CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CA{
+		CAFile: filepath.Join(dir, "ca.pem"),
+		dir:    dir,
+		cert:   cert,
+		key:    key,
+		serial: 1,
+	}
+	if err := writePEM(ca.CAFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Issue makes a certificate for the given name, which is also valid for the
+// given hosts. The name goes in the SANs as well as the common name, since
+// that's what verify_server_hostname checks. Hosts that parse as IPs are added as IP addresses,
+// everything else as DNS names. The certificate can be used by both sides of
+// a connection, since agents are both.
+func (ca *CA) Issue(name string, hosts ...string) (*Cert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.serial++
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &Cert{
+		CAFile:   ca.CAFile,
+		CertFile: filepath.Join(ca.dir, name+".pem"),
+		KeyFile:  filepath.Join(ca.dir, name+"-key.pem"),
+	}
+	if err := writePEM(cert.CertFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := writePEM(cert.KeyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Args returns the agent arguments that use the certificate for RPC and
+// HTTPS, verifying connections in both directions.
+func (c *Cert) Args() []string {
+	return []string{
+		"-hcl", fmt.Sprintf("ca_file=%q", c.CAFile),
+		"-hcl", fmt.Sprintf("cert_file=%q", c.CertFile),
+		"-hcl", fmt.Sprintf("key_file=%q", c.KeyFile),
+		"-hcl", "verify_incoming=true",
+		"-hcl", "verify_outgoing=true",
+		"-hcl", "verify_server_hostname=true",
+	}
+}
+
+// TLSConfig returns the configuration API clients need to present the
+// certificate and trust the CA.
+func (c *Cert) TLSConfig() *api.TLSConfig {
+	return &api.TLSConfig{
+		CAFile:   c.CAFile,
+		CertFile: c.CertFile,
+		KeyFile:  c.KeyFile,
+	}
+}
+
+func writePEM(path, kind string, der []byte, mode os.FileMode) error {
+	content := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	return ioutil.WriteFile(path, content, mode)
+}
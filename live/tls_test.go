@@ -0,0 +1,89 @@
+package live
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		t.Fatalf("bad: no PEM data in %q", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return cert
+}
+
+func TestCA_Issue(t *testing.T) {
+	ca, err := NewCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	issued, err := ca.Issue("server.dc1.consul", "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(readCert(t, issued.CAFile))
+	cert := readCert(t, issued.CertFile)
+
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"server.dc1.consul", true},
+		{"localhost", true},
+		{"127.0.0.1", true},
+		{"server.dc2.consul", false},
+		{"client.dc1.consul", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+				_, err := cert.Verify(x509.VerifyOptions{
+					DNSName:   tc.name,
+					Roots:     roots,
+					KeyUsages: []x509.ExtKeyUsage{usage},
+				})
+				if tc.ok && err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if !tc.ok && err == nil {
+					t.Fatalf("should have failed")
+				}
+			}
+		})
+	}
+}
+
+func TestCA_IssueFromOtherCA(t *testing.T) {
+	ca, err := NewCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other, err := NewCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	issued, err := other.Issue("server.dc1.consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(readCert(t, ca.CAFile))
+	cert := readCert(t, issued.CertFile)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "server.dc1.consul", Roots: roots}); err == nil {
+		t.Fatalf("should have failed")
+	}
+}
@@ -21,7 +21,11 @@ func main() {
 		"federation": commands.FederationCommandFactory,
 		"fill":       commands.FillCommandFactory,
 		"kill":       commands.KillCommandFactory,
+		"linearize":  commands.LinearizeCommandFactory,
 		"load":       commands.LoadCommandFactory,
+		"pause":      commands.PauseCommandFactory,
+		"run":        commands.RunCommandFactory,
+		"snapshot":   commands.SnapshotCommandFactory,
 		"upgrade":    commands.UpgradeCommandFactory,
 	}
 